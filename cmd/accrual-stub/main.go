@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/caarlos0/env"
+	"github.com/devsagul/gophemart/internal/accrual"
+	"github.com/shopspring/decimal"
+)
+
+func init() {
+	decimal.MarshalJSONWithoutQuotes = true
+}
+
+type config struct {
+	Address string  `env:"RUN_ADDRESS"`
+	Script  string  `env:"ACCRUAL_STUB_SCRIPT"`
+	Accrual float64 `env:"ACCRUAL_STUB_ACCRUAL"`
+	Latency string  `env:"ACCRUAL_STUB_LATENCY"`
+	Limit   int     `env:"ACCRUAL_STUB_RATE_LIMIT"`
+}
+
+type step struct {
+	Status     string           `json:"status"`
+	Accrual    *decimal.Decimal `json:"accrual"`
+	Code       int              `json:"code"`
+	RetryAfter string           `json:"retry_after"`
+	Delay      string           `json:"delay"`
+}
+
+// script describes answers of the stub, e.g.
+//
+//	{
+//	  "latency": "50ms",
+//	  "rate_limit": 60,
+//	  "default": [{"status": "PROCESSING"}, {"status": "PROCESSED", "accrual": 500}],
+//	  "orders": {
+//	    "79927398713": [{"code": 429, "retry_after": "1s"}, {"status": "INVALID"}]
+//	  }
+//	}
+type script struct {
+	Latency   string            `json:"latency"`
+	RateLimit int               `json:"rate_limit"`
+	Default   []step            `json:"default"`
+	Orders    map[string][]step `json:"orders"`
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (s step) toStep() (accrual.Step, error) {
+	retryAfter, err := parseDuration(s.RetryAfter)
+	if err != nil {
+		return accrual.Step{}, fmt.Errorf("invalid retry_after: %w", err)
+	}
+	delay, err := parseDuration(s.Delay)
+	if err != nil {
+		return accrual.Step{}, fmt.Errorf("invalid delay: %w", err)
+	}
+
+	return accrual.Step{
+		Status:     s.Status,
+		Accrual:    s.Accrual,
+		Code:       s.Code,
+		RetryAfter: retryAfter,
+		Delay:      delay,
+	}, nil
+}
+
+func toSteps(raw []step) ([]accrual.Step, error) {
+	steps := []accrual.Step{}
+	for _, s := range raw {
+		converted, err := s.toStep()
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, converted)
+	}
+	return steps, nil
+}
+
+func loadScript(fake *accrual.Fake, filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var s script
+	err = json.Unmarshal(content, &s)
+	if err != nil {
+		return err
+	}
+
+	latency, err := parseDuration(s.Latency)
+	if err != nil {
+		return fmt.Errorf("invalid latency: %w", err)
+	}
+	if latency > 0 {
+		fake.SetLatency(latency)
+	}
+	if s.RateLimit > 0 {
+		fake.SetRateLimit(s.RateLimit)
+	}
+
+	if len(s.Default) > 0 {
+		steps, err := toSteps(s.Default)
+		if err != nil {
+			return err
+		}
+		fake.SetDefault(steps...)
+	}
+
+	for orderID, raw := range s.Orders {
+		steps, err := toSteps(raw)
+		if err != nil {
+			return fmt.Errorf("invalid script for order %s: %w", orderID, err)
+		}
+		fake.Script(orderID, steps...)
+	}
+
+	return nil
+}
+
+func main() {
+	var cfg config
+
+	flag.StringVar(&cfg.Address, "a", "localhost:8080", "Address of the server (to listen to)")
+	flag.StringVar(&cfg.Script, "s", "", "JSON file with scripted answers (leave empty to process every order)")
+	flag.Float64Var(&cfg.Accrual, "accrual", 100, "Accrual of orders without a script")
+	flag.StringVar(&cfg.Latency, "latency", "", "Delay before every answer")
+	flag.IntVar(&cfg.Limit, "rate-limit", 0, "Number of requests per minute allowed (0 for no limit)")
+
+	err := env.Parse(&cfg)
+	if err != nil {
+		log.Fatalf("Could not parse config for environment: %v", err)
+	}
+
+	flag.Parse()
+
+	fake := accrual.NewFake()
+	fake.SetDefault(accrual.Registered(), accrual.Processing(), accrual.Processed(decimal.NewFromFloat(cfg.Accrual)))
+
+	latency, err := parseDuration(cfg.Latency)
+	if err != nil {
+		log.Fatalf("Invalid latency: %v", err)
+	}
+	fake.SetLatency(latency)
+	fake.SetRateLimit(cfg.Limit)
+
+	if cfg.Script != "" {
+		err = loadScript(fake, cfg.Script)
+		if err != nil {
+			log.Fatalf("Could not load script: %v", err)
+		}
+	}
+
+	log.Printf("Serving fake accrual system on %s", cfg.Address)
+	err = http.ListenAndServe(cfg.Address, fake)
+	if err != nil {
+		log.Fatalf("Could not start the HTTP server: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+func jobs(cfg config, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("Usage: gophermart [flags] jobs dead|requeue ORDER...")
+	}
+
+	if cfg.DatabaseDsn == "" {
+		log.Fatalf("Managing accrual jobs requires a database DSN to be set")
+	}
+
+	store, err := storage.NewPostgresStorage(cfg.DatabaseDsn)
+	if err != nil {
+		log.Fatalf("Could not initialize postgres database: %v", err)
+	}
+
+	switch args[0] {
+	case "dead":
+		jobs, err := store.ExtractDeadJobs()
+		if err != nil {
+			log.Fatalf("Could not extract dead accrual jobs: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ORDER\tATTEMPTS\tFAILURES\tCREATED AT\tLAST ERROR")
+		for _, job := range jobs {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", job.OrderID, job.Attempts, job.Failures, job.CreatedAt.Format("2006-01-02 15:04:05 -0700"), job.LastError)
+		}
+		err = w.Flush()
+		if err != nil {
+			log.Fatalf("Could not write dead accrual jobs: %v", err)
+		}
+	case "requeue":
+		if len(args) < 2 {
+			log.Fatalf("Usage: gophermart [flags] jobs requeue ORDER...")
+		}
+		for _, orderID := range args[1:] {
+			err = store.RequeueJob(orderID)
+			if err != nil {
+				log.Fatalf("Could not requeue order %s: %v", orderID, err)
+			}
+			log.Printf("Requeued order %s", orderID)
+		}
+	default:
+		log.Fatalf("Unknown jobs command: %s. Expected one of dead, requeue", args[0])
+	}
+}
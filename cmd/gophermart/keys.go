@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/infra"
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+func keys(cfg config, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: gophermart [flags] keys list|rotate|revoke")
+	}
+
+	if cfg.DatabaseDsn == "" {
+		log.Fatalf("Managing signing keys requires a database DSN to be set")
+	}
+
+	store, err := storage.NewPostgresStorage(cfg.DatabaseDsn)
+	if err != nil {
+		log.Fatalf("Could not initialize postgres database: %v", err)
+	}
+
+	rotator := infra.NewKeyRotator(store, cfg.SigningAlgorithm, cfg.keyPolicy())
+
+	switch args[0] {
+	case "list":
+		keys, err := store.ExtractAllKeys()
+		if err != nil {
+			log.Fatalf("Could not extract signing keys: %v", err)
+		}
+
+		sorted := []core.SigningKey{}
+		for _, key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].ExpiresAt.Before(sorted[j].ExpiresAt)
+		})
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tALGORITHM\tSIGNING\tRETIRES AT\tEXPIRES AT")
+		for _, key := range sorted {
+			signing := "no"
+			if key.Fresh() {
+				signing = "yes"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key.ID, key.Algorithm, signing, key.RetiresAt.Format("2006-01-02 15:04:05 -0700"), key.ExpiresAt.Format("2006-01-02 15:04:05 -0700"))
+		}
+		err = w.Flush()
+		if err != nil {
+			log.Fatalf("Could not write signing keys: %v", err)
+		}
+	case "rotate":
+		err = rotator.Rotate()
+		if err != nil {
+			log.Fatalf("Could not rotate signing keys: %v", err)
+		}
+	case "revoke":
+		keys, sessions, err := rotator.Revoke()
+		if err != nil {
+			log.Fatalf("Could not revoke signing keys: %v", err)
+		}
+		log.Printf("Replaced %d signing key(s) and revoked %d session(s), no token issued before is valid anymore", keys, sessions)
+	default:
+		log.Fatalf("Unknown keys command: %s. Expected one of list, rotate, revoke", args[0])
+	}
+}
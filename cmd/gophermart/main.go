@@ -3,25 +3,102 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"runtime"
 	"time"
 
 	"github.com/caarlos0/env"
+	"github.com/devsagul/gophemart/internal/accrual"
 	"github.com/devsagul/gophemart/internal/core"
 	"github.com/devsagul/gophemart/internal/infra"
+	"github.com/devsagul/gophemart/internal/notify"
 	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
 )
 
-const OrdersBufferSize = 255
 const PollInterval = 30 * time.Second
 const DatabaseHealthCheckInterval = time.Minute
 const HidrationInterval = 12 * time.Hour
+const ReconciliationInterval = time.Hour
+const IdempotencyPurgeInterval = time.Hour
 
 type config struct {
-	Address        string `env:"RUN_ADDRESS"`
-	DatabaseDsn    string `env:"DATABASE_URI"`
-	AccrualAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	Address            string        `env:"RUN_ADDRESS"`
+	DatabaseDsn        string        `env:"DATABASE_URI"`
+	AccrualAddress     string        `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	AccrualWorkers     int           `env:"ACCRUAL_WORKERS"`
+	AccrualRate        float64       `env:"ACCRUAL_RATE"`
+	AccrualMinRate     float64       `env:"ACCRUAL_MIN_RATE"`
+	AccrualMaxRate     float64       `env:"ACCRUAL_MAX_RATE"`
+	AccrualBurst       int           `env:"ACCRUAL_BURST"`
+	AccrualMaxFailures int           `env:"ACCRUAL_MAX_FAILURES"`
+	AccrualBackoff     time.Duration `env:"ACCRUAL_BACKOFF"`
+	AccrualMaxBackoff  time.Duration `env:"ACCRUAL_MAX_BACKOFF"`
+	BreakerThreshold   int           `env:"ACCRUAL_BREAKER_THRESHOLD"`
+	BreakerTimeout     time.Duration `env:"ACCRUAL_BREAKER_TIMEOUT"`
+	CallbackSecret     string        `env:"ACCRUAL_CALLBACK_SECRET"`
+	CallbackWindow     time.Duration `env:"ACCRUAL_CALLBACK_WINDOW"`
+	SigningAlgorithm   string        `env:"JWT_ALGORITHM"`
+	KeyLifetime        time.Duration `env:"JWT_KEY_LIFETIME"`
+	KeyRetirement      time.Duration `env:"JWT_KEY_RETIREMENT"`
+	KeyLookahead       time.Duration `env:"JWT_KEY_LOOKAHEAD"`
+	SigningKeys        int           `env:"JWT_SIGNING_KEYS"`
+	UserCacheTTL       time.Duration `env:"AUTH_USER_CACHE_TTL"`
+	Notifier           string        `env:"NOTIFIER"`
+	NotifierFile       string        `env:"NOTIFIER_FILE"`
+	LoginLockout       int           `env:"LOGIN_LOCKOUT_ATTEMPTS"`
+	AddressLockout     int           `env:"LOGIN_ADDRESS_LOCKOUT_ATTEMPTS"`
+	LockoutPeriod      time.Duration `env:"LOGIN_LOCKOUT_PERIOD"`
+	HashConcurrency    int           `env:"PASSWORD_HASH_CONCURRENCY"`
+	HashMemory         uint          `env:"PASSWORD_HASH_MEMORY"`
+	HashIterations     uint          `env:"PASSWORD_HASH_ITERATIONS"`
+	HashParallelism    uint          `env:"PASSWORD_HASH_PARALLELISM"`
+}
+
+func (cfg config) loginThrottle() (core.ThrottlePolicy, core.ThrottlePolicy) {
+	login := core.DefaultLoginThrottle
+	login.Lockout = cfg.LoginLockout
+	login.LockoutPeriod = cfg.LockoutPeriod
+
+	address := core.DefaultAddressThrottle
+	address.Lockout = cfg.AddressLockout
+	address.LockoutPeriod = cfg.LockoutPeriod
+
+	return login, address
+}
+
+func (cfg config) passwordParams() core.PasswordParams {
+	params := core.DefaultPasswordParams
+	params.Memory = uint32(cfg.HashMemory)
+	params.Iterations = uint32(cfg.HashIterations)
+	params.Parallelism = uint8(cfg.HashParallelism)
+	return params
+}
+
+func (cfg config) keyPolicy() core.KeyPolicy {
+	return core.KeyPolicy{
+		Lifetime:   cfg.KeyLifetime,
+		Retirement: cfg.KeyRetirement,
+		Lookahead:  cfg.KeyLookahead,
+		Keys:       cfg.SigningKeys,
+	}
+}
+
+// workerID identifies this process as an owner of leased accrual jobs
+func workerID() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), id), nil
 }
 
 func main() {
@@ -30,6 +107,33 @@ func main() {
 	flag.StringVar(&cfg.Address, "a", "localhost:8000", "Address of the server (to listen to)")
 	flag.StringVar(&cfg.DatabaseDsn, "d", "", "DSN to connect to the database (leave empty to use in-memory DB)")
 	flag.StringVar(&cfg.AccrualAddress, "r", "", "Address of the accrual system")
+	flag.IntVar(&cfg.AccrualWorkers, "w", 4, "Number of concurrent accrual workers")
+	flag.Float64Var(&cfg.AccrualRate, "rate", 10, "Initial rate of requests to the accrual system, per second")
+	flag.Float64Var(&cfg.AccrualMinRate, "min-rate", 0.1, "Rate of requests to the accrual system never goes below this value, per second")
+	flag.Float64Var(&cfg.AccrualMaxRate, "max-rate", 100, "Rate of requests to the accrual system never goes above this value, per second")
+	flag.IntVar(&cfg.AccrualBurst, "burst", 5, "Number of requests to the accrual system which may be sent at once")
+	flag.IntVar(&cfg.AccrualMaxFailures, "max-failures", 10, "Number of failed attempts after which an order is moved to dead letters")
+	flag.DurationVar(&cfg.AccrualBackoff, "backoff", 5*time.Second, "Delay before retrying an order after its first failure")
+	flag.DurationVar(&cfg.AccrualMaxBackoff, "max-backoff", time.Hour, "Maximum delay before retrying a failed order")
+	flag.IntVar(&cfg.BreakerThreshold, "breaker-threshold", 5, "Number of consecutive failures of the accrual system after which requests to it are stopped")
+	flag.DurationVar(&cfg.BreakerTimeout, "breaker-timeout", 30*time.Second, "Delay before probing the accrual system again after requests to it were stopped")
+	flag.StringVar(&cfg.CallbackSecret, "callback-secret", "", "Secret the accrual system signs pushed order statuses with (leave empty to only poll)")
+	flag.DurationVar(&cfg.CallbackWindow, "callback-window", 5*time.Minute, "Delay before polling an order the accrual system has pushed nothing for")
+	flag.StringVar(&cfg.SigningAlgorithm, "jwt-alg", core.EdDSA, "Algorithm to sign access tokens with, EdDSA or HS256")
+	flag.DurationVar(&cfg.KeyLifetime, "key-lifetime", core.DefaultKeyPolicy.Lifetime, "Time during which tokens signed with a key may be verified")
+	flag.DurationVar(&cfg.KeyRetirement, "key-retirement", core.DefaultKeyPolicy.Retirement, "Time before expiry of a key when it stops signing new tokens")
+	flag.DurationVar(&cfg.KeyLookahead, "key-lookahead", core.DefaultKeyPolicy.Lookahead, "Time before retirement of keys when their replacements are created")
+	flag.IntVar(&cfg.SigningKeys, "signing-keys", core.DefaultKeyPolicy.Keys, "Number of keys to sign tokens with")
+	flag.DurationVar(&cfg.UserCacheTTL, "user-cache-ttl", 0, "Time to cache authenticated users and sessions for (0 disables the cache)")
+	flag.StringVar(&cfg.Notifier, "notifier", "", "Way to deliver password reset tokens to users, log or file (leave empty to disable password reset)")
+	flag.StringVar(&cfg.NotifierFile, "notifier-file", "notifications.jsonl", "File the file notifier appends messages to")
+	flag.IntVar(&cfg.LoginLockout, "login-lockout", core.DefaultLoginThrottle.Lockout, "Number of failed logins as a single user after which their logins are locked out")
+	flag.IntVar(&cfg.AddressLockout, "address-lockout", core.DefaultAddressThrottle.Lockout, "Number of failed logins from a single address after which its logins are locked out")
+	flag.DurationVar(&cfg.LockoutPeriod, "lockout-period", core.DefaultLoginThrottle.LockoutPeriod, "Time logins stay locked out for")
+	flag.IntVar(&cfg.HashConcurrency, "hash-concurrency", runtime.NumCPU(), "Number of password hashes which may be computed at once")
+	flag.UintVar(&cfg.HashMemory, "hash-memory", uint(core.DefaultPasswordParams.Memory), "Memory password hashes are computed with, KiB")
+	flag.UintVar(&cfg.HashIterations, "hash-iterations", uint(core.DefaultPasswordParams.Iterations), "Number of passes password hashes are computed with")
+	flag.UintVar(&cfg.HashParallelism, "hash-parallelism", uint(core.DefaultPasswordParams.Parallelism), "Number of threads a single password hash is computed with")
 
 	err := env.Parse(&cfg)
 	if err != nil {
@@ -38,6 +142,47 @@ func main() {
 
 	flag.Parse()
 
+	if cfg.SigningAlgorithm != core.EdDSA && cfg.SigningAlgorithm != core.HS256 {
+		log.Fatalf("Unsupported token signing algorithm: %s", cfg.SigningAlgorithm)
+	}
+	err = cfg.keyPolicy().Validate()
+	if err != nil {
+		log.Fatalf("Invalid signing key policy: %v", err)
+	}
+	loginThrottle, addressThrottle := cfg.loginThrottle()
+	for _, policy := range []core.ThrottlePolicy{loginThrottle, addressThrottle} {
+		err = policy.Validate()
+		if err != nil {
+			log.Fatalf("Invalid login throttling policy: %v", err)
+		}
+	}
+	if cfg.HashMemory > math.MaxUint32 || cfg.HashIterations > math.MaxUint32 || cfg.HashParallelism > math.MaxUint8 {
+		log.Fatalf("Password hashing parameters are out of range")
+	}
+	err = cfg.passwordParams().Validate()
+	if err != nil {
+		log.Fatalf("Invalid password hashing parameters: %v", err)
+	}
+	if cfg.HashConcurrency < 1 {
+		log.Fatalf("At least one password hash should be computed at once, got %d", cfg.HashConcurrency)
+	}
+
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "migrate":
+			migrate(cfg, flag.Args()[1:])
+		case "jobs":
+			jobs(cfg, flag.Args()[1:])
+		case "keys":
+			keys(cfg, flag.Args()[1:])
+		case "users":
+			users(cfg, flag.Args()[1:])
+		default:
+			log.Fatalf("Unknown command: %s", flag.Arg(0))
+		}
+		return
+	}
+
 	log.Println("Initializing storage...")
 	var store storage.Storage
 
@@ -60,29 +205,74 @@ func main() {
 		}
 	}
 
-	log.Println("Initializing application...")
-	accrualStream := make(chan *core.Order, OrdersBufferSize)
-
 	go func() {
-		t := time.NewTicker(PollInterval)
+		t := time.NewTicker(ReconciliationInterval)
 		for range t.C {
-			orders, err := store.ExtractUnterminatedOrders()
+			mismatches, err := store.ExtractBalanceMismatches()
 			if err != nil {
-				log.Printf("Error while extracting unterminated orders: %v", err)
+				log.Printf("Error while reconciling balances with the ledger: %v", err)
 				continue
 			}
 
-			for _, order := range orders {
-				accrualStream <- order
+			for _, mismatch := range mismatches {
+				log.Printf("Balance of user %s does not match the ledger: cached %s, ledger %s", mismatch.UserID, mismatch.Cached, mismatch.Ledger)
 			}
 		}
 	}()
 
+	log.Println("Initializing application...")
+	opts := []infra.Option{
+		infra.WithSigningAlgorithm(cfg.SigningAlgorithm),
+		infra.WithKeyPolicy(cfg.keyPolicy()),
+		infra.WithUserCache(cfg.UserCacheTTL),
+		infra.WithLoginThrottle(loginThrottle, addressThrottle),
+		infra.WithHashConcurrency(cfg.HashConcurrency, infra.DefaultHashQueueTimeout),
+		infra.WithPasswordParams(cfg.passwordParams()),
+	}
+
+	switch cfg.Notifier {
+	case "":
+	case "log":
+		opts = append(opts, infra.WithNotifier(notify.NewLogNotifier()))
+	case "file":
+		opts = append(opts, infra.WithNotifier(notify.NewFileNotifier(cfg.NotifierFile)))
+	default:
+		log.Fatalf("Unsupported notifier: %s", cfg.Notifier)
+	}
+
+	if cfg.CallbackSecret != "" {
+		opts = append(opts, infra.WithAccrualCallback(cfg.CallbackSecret, cfg.CallbackWindow))
+	}
+
 	if cfg.AccrualAddress != "" {
-		go infra.Worker(accrualStream, cfg.AccrualAddress, store)
+		breaker := infra.NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerTimeout)
+		opts = append(opts, infra.WithAccrualBreaker(breaker))
+
+		owner, err := workerID()
+		if err != nil {
+			log.Fatalf("Could not generate accrual worker id: %v", err)
+		}
+
+		limiter := infra.NewRateLimiter(cfg.AccrualRate, cfg.AccrualMinRate, cfg.AccrualMaxRate, cfg.AccrualBurst)
+		retry := core.RetryPolicy{
+			BaseDelay:   cfg.AccrualBackoff,
+			MaxDelay:    cfg.AccrualMaxBackoff,
+			MaxFailures: cfg.AccrualMaxFailures,
+		}
+		client, err := accrual.NewHTTPClient(cfg.AccrualAddress)
+		if err != nil {
+			log.Fatalf("Could not parse accrual system address: %v", err)
+		}
+
+		pool, err := infra.NewWorkerPool(store, client, owner, cfg.AccrualWorkers, limiter, retry, breaker)
+		if err != nil {
+			log.Fatalf("Could not initialize accrual workers: %v", err)
+		}
+
+		go pool.Run(context.Background())
 	}
 
-	app := infra.NewApp(store, accrualStream)
+	app := infra.NewApp(store, opts...)
 	err = app.HydrateKeys()
 	if err != nil {
 		log.Fatalf("Could not hydrate the keys: %v", err)
@@ -93,7 +283,17 @@ func main() {
 		for range t.C {
 			err = app.HydrateKeys()
 			if err != nil {
-				log.Printf("Error while hydrating hmac keys: %v", err)
+				log.Printf("Error while hydrating signing keys: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		t := time.NewTicker(IdempotencyPurgeInterval)
+		for range t.C {
+			err := app.PurgeIdempotencyRecords()
+			if err != nil {
+				log.Printf("Error while purging idempotency records: %v", err)
 			}
 		}
 	}()
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+func migrate(cfg config, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: gophermart [flags] migrate up|down|status")
+	}
+
+	if cfg.DatabaseDsn == "" {
+		log.Fatalf("Migrations require a database DSN to be set")
+	}
+
+	migrator, err := storage.NewPostgresMigrator(cfg.DatabaseDsn)
+	if err != nil {
+		log.Fatalf("Could not initialize migrations: %v", err)
+	}
+	defer func() {
+		err := migrator.Close()
+		if err != nil {
+			log.Printf("Could not close database connection: %v", err)
+		}
+	}()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		n, err := migrator.Up(ctx)
+		if err != nil {
+			log.Fatalf("Could not apply migrations: %v", err)
+		}
+		log.Printf("Applied %d migration(s)", n)
+	case "down":
+		migration, err := migrator.Down(ctx)
+		if err != nil {
+			log.Fatalf("Could not roll back migration: %v", err)
+		}
+		log.Printf("Rolled back migration %04d_%s", migration.Version, migration.Name)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatalf("Could not get migrations status: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05 -0700")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		err = w.Flush()
+		if err != nil {
+			log.Fatalf("Could not write migrations status: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown migrate command: %s. Expected one of up, down, status", args[0])
+	}
+}
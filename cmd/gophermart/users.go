@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/devsagul/gophemart/internal/audit"
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+func users(cfg config, args []string) {
+	if len(args) != 3 || args[0] != "role" {
+		log.Fatalf("Usage: gophermart [flags] users role LOGIN user|support|admin")
+	}
+
+	if cfg.DatabaseDsn == "" {
+		log.Fatalf("Managing users requires a database DSN to be set")
+	}
+
+	login, role := args[1], args[2]
+	err := core.ValidateRole(role)
+	if err != nil {
+		log.Fatalf("Invalid role: %v", err)
+	}
+
+	store, err := storage.NewPostgresStorage(cfg.DatabaseDsn)
+	if err != nil {
+		log.Fatalf("Could not initialize postgres database: %v", err)
+	}
+
+	user, err := store.ExtractUser(login)
+	if err != nil {
+		log.Fatalf("Could not extract user %s: %v", login, err)
+	}
+
+	err = store.UpdateUserRole(user.ID, role)
+	if err != nil {
+		log.Fatalf("Could not update role of user %s: %v", login, err)
+	}
+
+	err = audit.NewLog(store).Record(context.Background(), core.ROLE_CHANGED, user, map[string]string{
+		"previous_role": user.Role,
+		"role":          role,
+		"source":        "cli",
+	})
+	if err != nil {
+		log.Fatalf("Could not audit role change: %v", err)
+	}
+
+	log.Printf("Changed role of user %s from %s to %s", login, user.Role, role)
+}
@@ -0,0 +1,77 @@
+package accrual
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SignatureHeader = "X-Accrual-Signature"
+const TimestampHeader = "X-Accrual-Timestamp"
+
+// callbacks signed earlier or later than that are rejected to make
+// replaying captured requests useless
+const MaxCallbackSkew = 5 * time.Minute
+
+const signaturePrefix = "sha256="
+
+type ErrInvalidSignature struct {
+	reason string
+}
+
+func (err *ErrInvalidSignature) Error() string {
+	return fmt.Sprintf("invalid callback signature: %s", err.reason)
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Sign returns the signature of the callback body sent at timestamp, which is
+// HMAC-SHA256 of "<unix timestamp>.<body>"
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	return signaturePrefix + hex.EncodeToString(mac(secret, strconv.FormatInt(timestamp.Unix(), 10), body))
+}
+
+// SignRequest sets signature headers of the callback request carrying body
+func SignRequest(r *http.Request, secret []byte, timestamp time.Time, body []byte) {
+	r.Header.Set(TimestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+	r.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+}
+
+func VerifySignature(secret []byte, signature string, timestamp string, body []byte, now time.Time) error {
+	if signature == "" || timestamp == "" {
+		return &ErrInvalidSignature{"signature headers are missing"}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &ErrInvalidSignature{"malformed timestamp"}
+	}
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew > MaxCallbackSkew || skew < -MaxCallbackSkew {
+		return &ErrInvalidSignature{"timestamp is too far from now"}
+	}
+
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return &ErrInvalidSignature{"unsupported signature scheme"}
+	}
+	provided, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil {
+		return &ErrInvalidSignature{"malformed signature"}
+	}
+
+	if !hmac.Equal(provided, mac(secret, timestamp, body)) {
+		return &ErrInvalidSignature{"signature mismatch"}
+	}
+	return nil
+}
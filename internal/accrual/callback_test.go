@@ -0,0 +1,98 @@
+package accrual
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	t.Parallel()
+
+	secret := []byte("sikret")
+	body := []byte("{\"order\": \"4561261212345467\", \"status\": \"PROCESSED\", \"accrual\": 500}")
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	type testCase struct {
+		name      string
+		secret    []byte
+		signature string
+		timestamp string
+		body      []byte
+		valid     bool
+	}
+
+	var testcases = []testCase{
+		{
+			"Valid signature",
+			secret,
+			Sign(secret, now, body),
+			timestamp,
+			body,
+			true,
+		},
+		{
+			"Wrong secret",
+			[]byte("other"),
+			Sign(secret, now, body),
+			timestamp,
+			body,
+			false,
+		},
+		{
+			"Tampered body",
+			secret,
+			Sign(secret, now, body),
+			timestamp,
+			[]byte("{\"order\": \"4561261212345467\", \"status\": \"PROCESSED\", \"accrual\": 5000}"),
+			false,
+		},
+		{
+			"Tampered timestamp",
+			secret,
+			Sign(secret, now, body),
+			strconv.FormatInt(now.Unix()+1, 10),
+			body,
+			false,
+		},
+		{
+			"Stale timestamp",
+			secret,
+			Sign(secret, now.Add(-time.Hour), body),
+			strconv.FormatInt(now.Add(-time.Hour).Unix(), 10),
+			body,
+			false,
+		},
+		{
+			"Missing signature",
+			secret,
+			"",
+			timestamp,
+			body,
+			false,
+		},
+		{
+			"Malformed signature",
+			secret,
+			"sha256=zz",
+			timestamp,
+			body,
+			false,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := VerifySignature(tc.secret, tc.signature, tc.timestamp, tc.body, now)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.IsType(t, &ErrInvalidSignature{}, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package accrual
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// statuses reported by the accrual system
+const (
+	REGISTERED = "REGISTERED"
+	PROCESSING = "PROCESSING"
+	INVALID    = "INVALID"
+	PROCESSED  = "PROCESSED"
+)
+
+type Response struct {
+	Order   string           `json:"order"`
+	Status  string           `json:"status"`
+	Accrual *decimal.Decimal `json:"accrual,omitempty"`
+}
+
+// Validate rejects accruals which cannot be credited
+func (response *Response) Validate() error {
+	if response.Accrual != nil && response.Accrual.IsNegative() {
+		return &ErrInvalidResponse{fmt.Sprintf("accrual %s of order %s is negative", response.Accrual, response.Order)}
+	}
+	return nil
+}
+
+type Client interface {
+	GetAccrual(ctx context.Context, orderID string) (*Response, error)
+}
+
+type ErrTooManyRequests struct {
+	RetryAfter time.Duration
+	// requests per second, 0 if accrual system did not tell
+	Limit float64
+}
+
+func (err *ErrTooManyRequests) Error() string {
+	return fmt.Sprintf("accrual system asked to retry after %s", err.RetryAfter)
+}
+
+// ErrUnavailable means accrual system could not serve the request at all,
+// as opposed to answering it with an error
+type ErrUnavailable struct {
+	err error
+}
+
+func (err *ErrUnavailable) Error() string {
+	return fmt.Sprintf("accrual system is unavailable: %v", err.err)
+}
+
+func (err *ErrUnavailable) Unwrap() error {
+	return err.err
+}
+
+// ErrNotRegistered means accrual system does not know the order yet, it is
+// expected to learn about it later
+type ErrNotRegistered struct {
+	order string
+}
+
+func (err *ErrNotRegistered) Error() string {
+	return fmt.Sprintf("order %s is not registered in the accrual system yet", err.order)
+}
+
+// ErrInvalidResponse means accrual system answered with something which
+// cannot be applied
+type ErrInvalidResponse struct {
+	reason string
+}
+
+func (err *ErrInvalidResponse) Error() string {
+	return fmt.Sprintf("invalid accrual system response: %s", err.reason)
+}
+
+type ErrUnexpectedStatus struct {
+	code int
+	body string
+}
+
+func (err *ErrUnexpectedStatus) Error() string {
+	return fmt.Sprintf("accrual system returned non-200 code: %d %s", err.code, err.body)
+}
@@ -0,0 +1,244 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Step is a single scripted answer of the fake accrual system. Either Code
+// is set to answer with a bare status code, or Status (and Accrual) are set
+// to answer with order information.
+type Step struct {
+	Status     string
+	Accrual    *decimal.Decimal
+	Code       int
+	RetryAfter time.Duration
+	Delay      time.Duration
+}
+
+func Registered() Step {
+	return Step{Status: REGISTERED}
+}
+
+func Processing() Step {
+	return Step{Status: PROCESSING}
+}
+
+func Invalid() Step {
+	return Step{Status: INVALID}
+}
+
+func Processed(accrual decimal.Decimal) Step {
+	return Step{Status: PROCESSED, Accrual: &accrual}
+}
+
+func TooManyRequests(retryAfter time.Duration) Step {
+	return Step{Code: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+func Failure(code int) Step {
+	return Step{Code: code}
+}
+
+// Fake is a scriptable accrual system. It can be used in-process as a Client
+// or served over HTTP. Scripts are consumed step by step, the last step of
+// a script is repeated forever. Orders without a script follow the default
+// one, or are reported as unknown if there is no default script.
+type Fake struct {
+	sync.Mutex
+	scripts   map[string][]Step
+	defaults  []Step
+	calls     map[string]int
+	throttled []Step
+	latency   time.Duration
+	rateLimit int
+	requests  []time.Time
+}
+
+func NewFake() *Fake {
+	fake := new(Fake)
+	fake.scripts = make(map[string][]Step)
+	fake.calls = make(map[string]int)
+	return fake
+}
+
+func (fake *Fake) Script(orderID string, steps ...Step) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.scripts[orderID] = steps
+}
+
+func (fake *Fake) SetDefault(steps ...Step) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.defaults = steps
+}
+
+// SetLatency delays every answer by latency, on top of steps' own delays
+func (fake *Fake) SetLatency(latency time.Duration) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.latency = latency
+}
+
+// SetRateLimit makes fake answer 429 once more than perMinute requests were
+// made during the last minute, 0 disables the limit
+func (fake *Fake) SetRateLimit(perMinute int) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	fake.rateLimit = perMinute
+}
+
+// ThrottleNext answers the next n requests with 429, whatever order they are for
+func (fake *Fake) ThrottleNext(n int, retryAfter time.Duration) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	for i := 0; i < n; i++ {
+		fake.throttled = append(fake.throttled, TooManyRequests(retryAfter))
+	}
+}
+
+func (fake *Fake) Calls(orderID string) int {
+	fake.Lock()
+	defer fake.Unlock()
+
+	return fake.calls[orderID]
+}
+
+func (fake *Fake) next(orderID string) (Step, bool) {
+	fake.Lock()
+	defer fake.Unlock()
+
+	now := time.Now()
+	fake.calls[orderID]++
+
+	if fake.rateLimit > 0 {
+		recent := fake.requests[:0]
+		for _, at := range fake.requests {
+			if now.Sub(at) < time.Minute {
+				recent = append(recent, at)
+			}
+		}
+		fake.requests = recent
+		if len(fake.requests) >= fake.rateLimit {
+			retryAfter := fake.requests[0].Add(time.Minute).Sub(now)
+			return TooManyRequests(retryAfter.Round(time.Second) + time.Second), true
+		}
+		fake.requests = append(fake.requests, now)
+	}
+
+	if len(fake.throttled) > 0 {
+		step := fake.throttled[0]
+		fake.throttled = fake.throttled[1:]
+		return step, true
+	}
+
+	script, found := fake.scripts[orderID]
+	if !found {
+		if len(fake.defaults) == 0 {
+			return Step{}, false
+		}
+		script = make([]Step, len(fake.defaults))
+		copy(script, fake.defaults)
+	}
+	if len(script) == 0 {
+		return Step{}, false
+	}
+
+	step := script[0]
+	if len(script) > 1 {
+		script = script[1:]
+	}
+	fake.scripts[orderID] = script
+	return step, true
+}
+
+// respond produces raw answer to the request for orderID, exactly as the
+// real accrual system would send it
+func (fake *Fake) respond(ctx context.Context, orderID string) (int, http.Header, []byte) {
+	header := make(http.Header)
+	step, found := fake.next(orderID)
+
+	fake.Lock()
+	delay := fake.latency + step.Delay
+	rateLimit := fake.rateLimit
+	fake.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	if !found {
+		return http.StatusNoContent, header, nil
+	}
+
+	switch step.Code {
+	case 0, http.StatusOK:
+	case http.StatusTooManyRequests:
+		header.Set("Content-Type", "text/plain")
+		header.Set("Retry-After", strconv.Itoa(int(step.RetryAfter.Seconds())))
+		body := "Too many requests"
+		if rateLimit > 0 {
+			body = fmt.Sprintf("No more than %d requests per minute allowed", rateLimit)
+		}
+		return step.Code, header, []byte(body)
+	default:
+		return step.Code, header, []byte(http.StatusText(step.Code))
+	}
+
+	body, err := json.Marshal(Response{orderID, step.Status, step.Accrual})
+	if err != nil {
+		return http.StatusInternalServerError, header, []byte(err.Error())
+	}
+	header.Set("Content-Type", "application/json")
+	return http.StatusOK, header, body
+}
+
+func (fake *Fake) GetAccrual(ctx context.Context, orderID string) (*Response, error) {
+	code, header, body := fake.respond(ctx, orderID)
+	if ctx.Err() != nil {
+		return nil, &ErrUnavailable{ctx.Err()}
+	}
+	return parseResponse(orderID, code, header, body)
+}
+
+// ServeHTTP serves GET /api/orders/{number} of the accrual system API
+func (fake *Fake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/api/orders/"
+
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+
+	orderID := strings.TrimPrefix(r.URL.Path, prefix)
+	code, header, body := fake.respond(r.Context(), orderID)
+
+	for key, values := range header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(code)
+	_, err := w.Write(body)
+	if err != nil {
+		log.Printf("Error while writing response: %v", err)
+	}
+}
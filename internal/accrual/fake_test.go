@@ -0,0 +1,97 @@
+package accrual
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	fake := NewFake()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	httpClient, err := NewHTTPClient(server.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	clients := map[string]Client{
+		"in-process": fake,
+		"http":       httpClient,
+	}
+
+	for name, client := range clients {
+		client := client
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.Background()
+
+			fake.Script(name+"-1", Registered(), Processing(), Processed(decimal.New(500, 0)))
+			res, err := client.GetAccrual(ctx, name+"-1")
+			if assert.NoError(err) {
+				assert.Equal(REGISTERED, res.Status)
+			}
+			res, err = client.GetAccrual(ctx, name+"-1")
+			if assert.NoError(err) {
+				assert.Equal(PROCESSING, res.Status)
+			}
+			for i := 0; i < 2; i++ {
+				res, err = client.GetAccrual(ctx, name+"-1")
+				if assert.NoError(err) {
+					assert.Equal(PROCESSED, res.Status)
+					assert.True(decimal.New(500, 0).Equal(*res.Accrual))
+				}
+			}
+			assert.Equal(4, fake.Calls(name+"-1"))
+
+			_, err = client.GetAccrual(ctx, name+"-unknown")
+			assert.IsType(&ErrNotRegistered{}, err)
+
+			fake.Script(name+"-3", Processed(decimal.New(-5, 0)))
+			_, err = client.GetAccrual(ctx, name+"-3")
+			assert.IsType(&ErrInvalidResponse{}, err)
+
+			fake.Script(name+"-2", Failure(http.StatusBadGateway))
+			_, err = client.GetAccrual(ctx, name+"-2")
+			assert.IsType(&ErrUnavailable{}, err)
+
+			fake.ThrottleNext(1, 2*time.Second)
+			_, err = client.GetAccrual(ctx, name+"-1")
+			if assert.IsType(&ErrTooManyRequests{}, err) {
+				assert.Equal(2*time.Second, err.(*ErrTooManyRequests).RetryAfter)
+			}
+		})
+	}
+}
+
+func TestFakeRateLimit(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	fake := NewFake()
+	fake.SetDefault(Invalid())
+	fake.SetRateLimit(2)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		res, err := fake.GetAccrual(ctx, "12345678903")
+		if assert.NoError(err) {
+			assert.Equal(INVALID, res.Status)
+		}
+	}
+
+	_, err := fake.GetAccrual(ctx, "12345678903")
+	if assert.IsType(&ErrTooManyRequests{}, err) {
+		throttled := err.(*ErrTooManyRequests)
+		assert.InDelta(2.0/60, throttled.Limit, 1e-9)
+		assert.Greater(throttled.RetryAfter, time.Duration(0))
+	}
+}
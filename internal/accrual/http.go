@@ -0,0 +1,104 @@
+package accrual
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+const DefaultRetryAfter = time.Minute
+const RequestTimeout = 10 * time.Second
+
+type HTTPClient struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+func NewHTTPClient(address string) (*HTTPClient, error) {
+	baseURL, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	client := new(HTTPClient)
+	client.baseURL = baseURL
+	client.client = &http.Client{Timeout: RequestTimeout}
+	return client, nil
+}
+
+func (client *HTTPClient) GetAccrual(ctx context.Context, orderID string) (*Response, error) {
+	apiURL := *client.baseURL
+	apiURL.Path = path.Join(client.baseURL.Path, fmt.Sprintf("/api/orders/%s", orderID))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return nil, &ErrUnavailable{err}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &ErrUnavailable{err}
+	}
+
+	err = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseResponse(orderID, resp.StatusCode, resp.Header, body)
+}
+
+func parseResponse(orderID string, code int, header http.Header, body []byte) (*Response, error) {
+	if code == http.StatusTooManyRequests {
+		var perMinute int
+		_, err := fmt.Sscanf(string(body), "No more than %d requests per minute allowed", &perMinute)
+		if err != nil {
+			perMinute = 0
+		}
+		limit := float64(perMinute) / 60
+
+		retryAfter := header.Get("Retry-After")
+		retrySeconds, err := strconv.Atoi(retryAfter)
+		if err != nil {
+			log.Printf("Error while processing retrry-after header: %v", err)
+			return nil, &ErrTooManyRequests{DefaultRetryAfter, limit}
+		}
+		return nil, &ErrTooManyRequests{time.Duration(retrySeconds) * time.Second, limit}
+	}
+
+	if code >= http.StatusInternalServerError {
+		return nil, &ErrUnavailable{fmt.Errorf("accrual system returned %d code: %s", code, body)}
+	}
+
+	if code == http.StatusNoContent {
+		return nil, &ErrNotRegistered{orderID}
+	}
+
+	if code != http.StatusOK {
+		return nil, &ErrUnexpectedStatus{code, string(body)}
+	}
+
+	var data Response
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, err
+	}
+	err = data.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
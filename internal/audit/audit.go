@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"context"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
+)
+
+// Source is what caused events recorded in a context: the request and the
+// user it was authenticated as. Events recorded by background workers have
+// no source.
+type Source struct {
+	RequestID string
+	IP        string
+	ActorID   uuid.UUID
+}
+
+type sourceKey struct{}
+
+func WithSource(ctx context.Context, source Source) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// WithActor attributes events recorded in ctx to the user once the request
+// is authenticated
+func WithActor(ctx context.Context, actorID uuid.UUID) context.Context {
+	source := SourceFrom(ctx)
+	source.ActorID = actorID
+	return WithSource(ctx, source)
+}
+
+func SourceFrom(ctx context.Context) Source {
+	source, ok := ctx.Value(sourceKey{}).(Source)
+	if !ok {
+		return Source{}
+	}
+	return source
+}
+
+// Log is the append-only trail of what users, operators and workers did
+type Log struct {
+	store storage.Storage
+}
+
+func NewLog(store storage.Storage) *Log {
+	log := new(Log)
+	log.store = store
+	return log
+}
+
+// Record records event of eventType about user, which is nil if the event
+// is not about a known user
+func (log *Log) Record(ctx context.Context, eventType core.AuditEventType, user *core.User, details map[string]string) error {
+	event, err := core.NewAuditEvent(eventType, time.Now())
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		event.UserID = user.ID
+		event.Login = user.Login
+	}
+	for key, value := range details {
+		event.Details[key] = value
+	}
+	return log.RecordEvent(ctx, event)
+}
+
+// RecordEvent fills whatever the event lacks from the source of ctx and
+// records it
+func (log *Log) RecordEvent(ctx context.Context, event *core.AuditEvent) error {
+	source := SourceFrom(ctx)
+	if event.RequestID == "" {
+		event.RequestID = source.RequestID
+	}
+	if event.IP == "" {
+		event.IP = source.IP
+	}
+	if event.ActorID == uuid.Nil {
+		event.ActorID = source.ActorID
+	}
+	return log.store.WithContext(ctx).CreateAuditEvent(event)
+}
+
+// Events returns recorded events matching filter, newest first
+func (log *Log) Events(ctx context.Context, filter storage.AuditFilter) ([]*core.AuditEvent, error) {
+	return log.store.WithContext(ctx).ExtractAuditEvents(filter)
+}
@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	log := NewLog(storage.NewMemStorage())
+
+	alice, err := core.NewUser("alice", "sikret")
+	if !assert.NoError(err) {
+		return
+	}
+	operator := uuid.New()
+	start := time.Now()
+
+	// background work has no source
+	err = log.Record(context.Background(), core.ACCRUAL_APPLIED, nil, map[string]string{"order": "4561261212345467"})
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx := WithSource(context.Background(), Source{RequestID: "req-1", IP: "192.0.2.1"})
+	err = log.Record(ctx, core.LOGIN_SUCCEEDED, alice, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx = WithActor(ctx, operator)
+	err = log.Record(ctx, core.USER_DISABLED, alice, nil)
+	if !assert.NoError(err) {
+		return
+	}
+
+	events, err := log.Events(context.Background(), storage.AuditFilter{})
+	if !assert.NoError(err) || !assert.Len(events, 3) {
+		return
+	}
+	// newest first
+	assert.Equal(core.USER_DISABLED, events[0].Type)
+	assert.Equal(alice.ID, events[0].UserID)
+	assert.Equal(operator, events[0].ActorID)
+	assert.Equal("req-1", events[0].RequestID)
+	assert.Equal("192.0.2.1", events[0].IP)
+	assert.Equal(uuid.Nil, events[1].ActorID)
+	assert.Equal("alice", events[1].Login)
+	assert.Equal("", events[2].RequestID)
+	assert.Equal("4561261212345467", events[2].Details["order"])
+
+	type testCase struct {
+		name     string
+		filter   storage.AuditFilter
+		expected []core.AuditEventType
+	}
+
+	var testCases = []testCase{
+		{
+			"By user",
+			storage.AuditFilter{UserID: alice.ID},
+			[]core.AuditEventType{core.USER_DISABLED, core.LOGIN_SUCCEEDED},
+		},
+		{
+			"By actor",
+			storage.AuditFilter{ActorID: operator},
+			[]core.AuditEventType{core.USER_DISABLED},
+		},
+		{
+			"By types",
+			storage.AuditFilter{Types: []core.AuditEventType{core.ACCRUAL_APPLIED, core.LOGIN_SUCCEEDED}},
+			[]core.AuditEventType{core.LOGIN_SUCCEEDED, core.ACCRUAL_APPLIED},
+		},
+		{
+			"By time range",
+			storage.AuditFilter{From: start, To: time.Now().Add(time.Minute)},
+			[]core.AuditEventType{core.USER_DISABLED, core.LOGIN_SUCCEEDED, core.ACCRUAL_APPLIED},
+		},
+		{
+			"Before the range",
+			storage.AuditFilter{To: start},
+			[]core.AuditEventType{},
+		},
+		{
+			"Paginated",
+			storage.AuditFilter{Limit: 1, Offset: 1},
+			[]core.AuditEventType{core.LOGIN_SUCCEEDED},
+		},
+	}
+
+	for _, tCase := range testCases {
+		events, err := log.Events(context.Background(), tCase.filter)
+		if !assert.NoError(err, tCase.name) {
+			continue
+		}
+		types := []core.AuditEventType{}
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+		assert.Equal(tCase.expected, types, tCase.name)
+	}
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/utils"
+	"github.com/google/uuid"
+)
+
+const APIKeyPrefix = "gm_"
+const APIKeyLength = 32
+const MaxAPIKeyName = 100
+
+type Scope = string
+
+// scopes API keys may be granted, access tokens are not limited by scopes
+const (
+	ORDERS_READ       = "orders:read"
+	ORDERS_WRITE      = "orders:write"
+	BALANCE_READ      = "balance:read"
+	WITHDRAWALS_READ  = "withdrawals:read"
+	WITHDRAWALS_WRITE = "withdrawals:write"
+)
+
+var Scopes = []Scope{ORDERS_READ, ORDERS_WRITE, BALANCE_READ, WITHDRAWALS_READ, WITHDRAWALS_WRITE}
+
+type ErrInvalidScope struct {
+	scope string
+}
+
+func (err *ErrInvalidScope) Error() string {
+	return fmt.Sprintf("unknown scope %s, should be one of %s", err.scope, strings.Join(Scopes, ", "))
+}
+
+// APIKey lets scripts act on behalf of a user within its scopes. As with
+// refresh tokens, only its hash is stored, Hint is kept to tell keys apart.
+type APIKey struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"-"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	Hash       []byte     `json:"-"`
+	Scopes     []Scope    `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+func HashAPIKey(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// NewAPIKey returns the key to be handed to the user once along with its
+// record to be stored
+func NewAPIKey(user *User, name string, scopes []Scope, createdAt time.Time) (string, *APIKey, error) {
+	granted := []Scope{}
+	seen := make(map[Scope]bool)
+	for _, scope := range scopes {
+		valid := false
+		for _, known := range Scopes {
+			if scope == known {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return "", nil, &ErrInvalidScope{scope}
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			granted = append(granted, scope)
+		}
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := utils.GenerateRandomBytes(APIKeyLength)
+	if err != nil {
+		return "", nil, err
+	}
+	token := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, &APIKey{
+		ID:        id,
+		UserID:    user.ID,
+		Name:      name,
+		Hint:      token[:len(APIKeyPrefix)+4] + "..." + token[len(token)-4:],
+		Hash:      HashAPIKey(token),
+		Scopes:    granted,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+func (key *APIKey) Allows(scope Scope) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
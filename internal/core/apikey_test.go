@@ -0,0 +1,40 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKey(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	user, err := NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+
+	token, key, err := NewAPIKey(user, "shop", []Scope{ORDERS_WRITE, BALANCE_READ, ORDERS_WRITE}, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(IsAPIKey(token))
+	assert.False(IsAPIKey("eyJhbGciOiJFZERTQSJ9"))
+	assert.Equal(user.ID, key.UserID)
+	assert.Equal(HashAPIKey(token), key.Hash)
+	assert.NotContains(string(key.Hash), token)
+	assert.True(strings.HasPrefix(key.Hint, APIKeyPrefix))
+	assert.True(strings.HasSuffix(key.Hint, token[len(token)-4:]))
+	assert.Nil(key.LastUsedAt)
+
+	assert.Equal([]Scope{ORDERS_WRITE, BALANCE_READ}, key.Scopes)
+	assert.True(key.Allows(ORDERS_WRITE))
+	assert.True(key.Allows(BALANCE_READ))
+	assert.False(key.Allows(WITHDRAWALS_WRITE))
+
+	_, _, err = NewAPIKey(user, "shop", []Scope{"orders:delete"}, time.Now())
+	assert.IsType(&ErrInvalidScope{}, err)
+}
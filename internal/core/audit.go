@@ -0,0 +1,68 @@
+package core
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type AuditEventType = string
+
+const (
+	LOGIN_LOCKED        = "LOGIN_LOCKED"
+	TWO_FACTOR_LOCKED   = "TWO_FACTOR_LOCKED"
+	TWO_FACTOR_ENABLED  = "TWO_FACTOR_ENABLED"
+	TWO_FACTOR_DISABLED = "TWO_FACTOR_DISABLED"
+	ROLE_CHANGED        = "ROLE_CHANGED"
+	USER_DISABLED       = "USER_DISABLED"
+	USER_ENABLED        = "USER_ENABLED"
+	USER_VIEWED         = "USER_VIEWED"
+	ORDERS_VIEWED       = "ORDERS_VIEWED"
+	WITHDRAWALS_VIEWED  = "WITHDRAWALS_VIEWED"
+	BALANCE_VIEWED      = "BALANCE_VIEWED"
+	ACCRUAL_REQUEUED    = "ACCRUAL_REQUEUED"
+	BALANCE_ADJUSTED    = "BALANCE_ADJUSTED"
+	AUDIT_VIEWED        = "AUDIT_VIEWED"
+	USER_REGISTERED     = "USER_REGISTERED"
+	LOGIN_SUCCEEDED     = "LOGIN_SUCCEEDED"
+	LOGIN_FAILED        = "LOGIN_FAILED"
+	LOGGED_OUT          = "LOGGED_OUT"
+	PASSWORD_CHANGED    = "PASSWORD_CHANGED"
+	PASSWORD_RESET      = "PASSWORD_RESET"
+	API_KEY_CREATED     = "API_KEY_CREATED"
+	API_KEY_REVOKED     = "API_KEY_REVOKED"
+	ORDER_UPLOADED      = "ORDER_UPLOADED"
+	WITHDRAWAL_CREATED  = "WITHDRAWAL_CREATED"
+	ACCRUAL_APPLIED     = "ACCRUAL_APPLIED"
+)
+
+// AuditEvent records something a user, an operator or a worker did. UserID
+// is uuid.Nil if the event is not about a known user. ActorID is who the
+// request causing the event was authenticated as, it differs from UserID
+// when an operator acts on a user and is uuid.Nil for anonymous requests
+// and background work.
+type AuditEvent struct {
+	ID        uuid.UUID         `json:"id"`
+	Type      AuditEventType    `json:"type"`
+	UserID    uuid.UUID         `json:"user_id"`
+	ActorID   uuid.UUID         `json:"actor_id"`
+	RequestID string            `json:"request_id,omitempty"`
+	Login     string            `json:"login,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+func NewAuditEvent(eventType AuditEventType, createdAt time.Time) (*AuditEvent, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditEvent{
+		ID:        id,
+		Type:      eventType,
+		Details:   map[string]string{},
+		CreatedAt: createdAt,
+	}, nil
+}
@@ -1,6 +1,9 @@
 package core
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"time"
@@ -14,6 +17,61 @@ const KeyLength = 64
 const KeyPeriod = time.Duration(30 * 24 * time.Hour)
 const KeyRefreshPeriod = time.Duration(6 * time.Hour)
 const TokenPeriod = time.Duration(3 * time.Hour)
+const ChallengePeriod = time.Duration(5 * time.Minute)
+
+// purposes of tokens other than access tokens, which have none
+const (
+	TwoFactorChallenge = "2fa"
+)
+
+// KeyPolicy describes lifecycle of signing keys. A key signs tokens until
+// Retirement before it expires and verifies them until it expires. New keys
+// are created Lookahead before the current ones retire, so that there are
+// always Keys keys to sign with.
+type KeyPolicy struct {
+	Lifetime   time.Duration
+	Retirement time.Duration
+	Lookahead  time.Duration
+	Keys       int
+}
+
+var DefaultKeyPolicy = KeyPolicy{
+	Lifetime:   KeyPeriod,
+	Retirement: 4 * KeyRefreshPeriod,
+	Lookahead:  KeyRefreshPeriod,
+	Keys:       4,
+}
+
+func (policy KeyPolicy) Validate() error {
+	if policy.Keys < 1 {
+		return fmt.Errorf("at least one signing key should be kept, got %d", policy.Keys)
+	}
+	// the last token signed by a key should not outlive it
+	if policy.Retirement < TokenPeriod {
+		return fmt.Errorf("keys should retire at least %s before they expire, got %s", TokenPeriod, policy.Retirement)
+	}
+	if policy.Lifetime <= policy.Retirement+policy.Lookahead {
+		return fmt.Errorf("key lifetime %s is too short to retire keys %s before expiry and create them %s ahead", policy.Lifetime, policy.Retirement, policy.Lookahead)
+	}
+	return nil
+}
+
+// Missing returns the number of keys to be created now for algorithm, given
+// the keys which exist already
+func (policy KeyPolicy) Missing(keys map[uuid.UUID]SigningKey, algorithm string, now time.Time) int {
+	horizon := now.Add(policy.Lookahead)
+	upcoming := 0
+	for _, key := range keys {
+		if key.Algorithm == algorithm && key.RetiresAt.After(horizon) {
+			upcoming++
+		}
+	}
+
+	if upcoming >= policy.Keys {
+		return 0
+	}
+	return policy.Keys - upcoming
+}
 
 type ErrExpiredToken struct {
 	expiredAt time.Time
@@ -25,45 +83,143 @@ func (err *ErrExpiredToken) Error() string {
 
 type ErrUnexpectedSigningMethod struct {
 	signingMethod jwt.SigningMethod
+	expected      string
 }
 
 func (err *ErrUnexpectedSigningMethod) Error() string {
-	return fmt.Sprintf("unexpected signing method: %s. HS256 expected", err.signingMethod.Alg())
+	return fmt.Sprintf("unexpected signing method: %s. %s expected", err.signingMethod.Alg(), err.expected)
 }
 
-type HmacKey struct {
+type ErrUnknownKey struct {
+	keyID uuid.UUID
+}
+
+func (err *ErrUnknownKey) Error() string {
+	return fmt.Sprintf("key with id %s not found", err.keyID)
+}
+
+type ErrUnsupportedAlgorithm struct {
+	algorithm string
+}
+
+func (err *ErrUnsupportedAlgorithm) Error() string {
+	return fmt.Sprintf("unsupported signing algorithm: %s, should be one of %s, %s", err.algorithm, EdDSA, HS256)
+}
+
+// signing algorithms, HS256 keys are shared secrets and can not be published
+const (
+	EdDSA = "EdDSA"
+	HS256 = "HS256"
+)
+
+type SigningKey struct {
 	ID        uuid.UUID
+	Algorithm string
+	// shared secret for HS256, ed25519 private key for EdDSA
 	Sign      []byte
+	RetiresAt time.Time
 	ExpiresAt time.Time
 }
 
-func (key *HmacKey) Expired() bool {
+func (key *SigningKey) Expired() bool {
 	return key.ExpiresAt.Before(time.Now())
 }
 
-func (key *HmacKey) Fresh() bool {
-	return time.Now().Before(key.ExpiresAt.Add(-4 * KeyRefreshPeriod))
+// Fresh tells whether new tokens may be signed with key
+func (key *SigningKey) Fresh() bool {
+	return time.Now().Before(key.RetiresAt)
+}
+
+func (key *SigningKey) method() jwt.SigningMethod {
+	if key.Algorithm == EdDSA {
+		return jwt.SigningMethodEdDSA
+	}
+	return jwt.SigningMethodHS256
+}
+
+func (key *SigningKey) signingKey() interface{} {
+	if key.Algorithm == EdDSA {
+		return ed25519.PrivateKey(key.Sign)
+	}
+	return key.Sign
+}
+
+func (key *SigningKey) verificationKey() interface{} {
+	if key.Algorithm == EdDSA {
+		return ed25519.PrivateKey(key.Sign).Public()
+	}
+	return key.Sign
 }
 
-func NewKey() (*HmacKey, error) {
-	expiresAt := time.Now().Add(KeyPeriod)
-	key := new(HmacKey)
+func NewKey(algorithm string, policy KeyPolicy) (*SigningKey, error) {
+	expiresAt := time.Now().Add(policy.Lifetime)
+	key := new(SigningKey)
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
 	key.ID = id
-	sign, err := utils.GenerateRandomBytes(KeyLength)
-	if err != nil {
-		return nil, err
+	key.Algorithm = algorithm
+
+	switch algorithm {
+	case EdDSA:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.Sign = private
+	case HS256:
+		sign, err := utils.GenerateRandomBytes(KeyLength)
+		if err != nil {
+			return nil, err
+		}
+		key.Sign = sign
+	default:
+		return nil, &ErrUnsupportedAlgorithm{algorithm}
 	}
-	key.Sign = sign
+
+	key.RetiresAt = expiresAt.Add(-policy.Retirement)
 	key.ExpiresAt = expiresAt
 	return key, nil
 }
 
+// JWK is the public part of a signing key as described by RFC 8037
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicJWK returns nil for symmetric keys, which must never be published
+func (key *SigningKey) PublicJWK() *JWK {
+	if key.Algorithm != EdDSA {
+		return nil
+	}
+
+	public := ed25519.PrivateKey(key.Sign).Public().(ed25519.PublicKey)
+	return &JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(public),
+		KeyID:     key.ID.String(),
+		Algorithm: EdDSA,
+		Use:       "sig",
+	}
+}
+
 type JwtClaims struct {
 	UserID uuid.UUID `json:"user,omitempty"`
+	// tokens issued before sessions were introduced have no session
+	SessionID uuid.UUID `json:"sid,omitempty"`
+	// tokens with a purpose must never be accepted as access tokens
+	Purpose string `json:"pur,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -74,21 +230,42 @@ func (claims JwtClaims) Valid() error {
 	return nil
 }
 
-func GenerateToken(user *User, key *HmacKey) (string, error) {
+func GenerateToken(user *User, session *Session, key *SigningKey) (string, error) {
 	now := time.Now()
 	expiration := now.Add(time.Duration(TokenPeriod))
 
 	claims := JwtClaims{
 		user.ID,
+		session.ID,
+		"",
 		jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiration),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return signToken(claims, key)
+}
+
+// GenerateChallengeToken returns a token proving that user has entered
+// the right password, which is exchanged for an access token once the
+// second factor is verified
+func GenerateChallengeToken(user *User, key *SigningKey, expiresAt time.Time) (string, error) {
+	claims := JwtClaims{
+		UserID:  user.ID,
+		Purpose: TwoFactorChallenge,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	return signToken(claims, key)
+}
+
+func signToken(claims JwtClaims, key *SigningKey) (string, error) {
+	token := jwt.NewWithClaims(key.method(), claims)
 	token.Header["kid"] = key.ID.String()
 
-	signed, err := token.SignedString(key.Sign)
+	signed, err := token.SignedString(key.signingKey())
 
 	if err != nil {
 		return "", err
@@ -97,12 +274,8 @@ func GenerateToken(user *User, key *HmacKey) (string, error) {
 	return signed, nil
 }
 
-func ParseToken(signed string, keys map[uuid.UUID]HmacKey) (userID uuid.UUID, err error) {
+func ParseToken(signed string, keys map[uuid.UUID]SigningKey) (*JwtClaims, error) {
 	token, err := jwt.ParseWithClaims(signed, &JwtClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, &ErrUnexpectedSigningMethod{token.Method}
-		}
-
 		kid, found := token.Header["kid"]
 		if !found {
 			return nil, errors.New("no key id provided for token validation")
@@ -119,16 +292,26 @@ func ParseToken(signed string, keys map[uuid.UUID]HmacKey) (userID uuid.UUID, er
 		}
 
 		key, found := keys[keyID]
-		if !found {
-			return nil, fmt.Errorf("key with id %s not found", keyID)
+		if !found || key.Expired() {
+			return nil, &ErrUnknownKey{keyID}
 		}
 
-		return key.Sign, nil
+		// otherwise public key of an asymmetric key could be used as an HMAC secret
+		if token.Method.Alg() != key.Algorithm {
+			return nil, &ErrUnexpectedSigningMethod{token.Method, key.Algorithm}
+		}
+
+		return key.verificationKey(), nil
 	})
 
+	// malformed tokens are not parsed at all
+	if token == nil {
+		return nil, err
+	}
+
 	if claims, ok := token.Claims.(*JwtClaims); ok && token.Valid {
-		return claims.UserID, err
+		return claims, err
 	}
 
-	return uuid.Nil, err
+	return nil, err
 }
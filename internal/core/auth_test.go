@@ -0,0 +1,179 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken(t *testing.T) {
+	t.Parallel()
+
+	user, err := NewUser("alice", "correct-horse")
+	if !assert.NoError(t, err) {
+		return
+	}
+	session, err := NewSession(user, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, algorithm := range []string{EdDSA, HS256} {
+		algorithm := algorithm
+		t.Run(algorithm, func(t *testing.T) {
+			assert := assert.New(t)
+
+			key, err := NewKey(algorithm, DefaultKeyPolicy)
+			if !assert.NoError(err) {
+				return
+			}
+			other, err := NewKey(algorithm, DefaultKeyPolicy)
+			if !assert.NoError(err) {
+				return
+			}
+
+			signed, err := GenerateToken(user, session, key)
+			if !assert.NoError(err) {
+				return
+			}
+
+			claims, err := ParseToken(signed, map[uuid.UUID]SigningKey{key.ID: *key})
+			if assert.NoError(err) {
+				assert.Equal(user.ID, claims.UserID)
+				assert.Equal(session.ID, claims.SessionID)
+			}
+
+			_, err = ParseToken(signed, map[uuid.UUID]SigningKey{other.ID: *other})
+			assert.Error(err)
+		})
+	}
+
+	t.Run("Malformed token", func(t *testing.T) {
+		claims, err := ParseToken("forged", map[uuid.UUID]SigningKey{})
+		assert.Error(t, err)
+		assert.Nil(t, claims)
+	})
+
+	t.Run("Challenge token", func(t *testing.T) {
+		key, err := NewKey(EdDSA, DefaultKeyPolicy)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		signed, err := GenerateChallengeToken(user, key, time.Now().Add(ChallengePeriod))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		claims, err := ParseToken(signed, map[uuid.UUID]SigningKey{key.ID: *key})
+		if assert.NoError(t, err) {
+			assert.Equal(t, user.ID, claims.UserID)
+			assert.Equal(t, uuid.Nil, claims.SessionID)
+			assert.Equal(t, TwoFactorChallenge, claims.Purpose)
+		}
+	})
+
+	t.Run("Unsupported algorithm", func(t *testing.T) {
+		_, err := NewKey("none", DefaultKeyPolicy)
+		assert.IsType(t, &ErrUnsupportedAlgorithm{}, err)
+	})
+
+	t.Run("Algorithm of the key is enforced", func(t *testing.T) {
+		key, err := NewKey(EdDSA, DefaultKeyPolicy)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// the published public key must not be usable as an HMAC secret
+		public := key.PublicJWK()
+		if !assert.NotNil(t, public) {
+			return
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(public.X)
+		if !assert.NoError(t, err) {
+			return
+		}
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, JwtClaims{
+			UserID: user.ID,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			},
+		})
+		forged.Header["kid"] = key.ID.String()
+		signed, err := forged.SignedString(secret)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		_, err = ParseToken(signed, map[uuid.UUID]SigningKey{key.ID: *key})
+		assert.Error(t, err)
+	})
+}
+
+func TestPublicJWK(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	key, err := NewKey(EdDSA, DefaultKeyPolicy)
+	if !assert.NoError(err) {
+		return
+	}
+	jwk := key.PublicJWK()
+	if !assert.NotNil(jwk) {
+		return
+	}
+	assert.Equal("OKP", jwk.KeyType)
+	assert.Equal("Ed25519", jwk.Curve)
+	assert.Equal(key.ID.String(), jwk.KeyID)
+	x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if assert.NoError(err) {
+		assert.Equal([]byte(ed25519.PrivateKey(key.Sign).Public().(ed25519.PublicKey)), x)
+	}
+
+	symmetric, err := NewKey(HS256, DefaultKeyPolicy)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Nil(symmetric.PublicJWK())
+}
+
+func TestKeyPolicy(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Validate", func(t *testing.T) {
+		assert.NoError(t, DefaultKeyPolicy.Validate())
+		assert.Error(t, KeyPolicy{KeyPeriod, 4 * KeyRefreshPeriod, KeyRefreshPeriod, 0}.Validate())
+		assert.Error(t, KeyPolicy{KeyPeriod, time.Hour, KeyRefreshPeriod, 4}.Validate())
+		assert.Error(t, KeyPolicy{24 * time.Hour, 20 * time.Hour, 4 * time.Hour, 4}.Validate())
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		assert := assert.New(t)
+		policy := KeyPolicy{10 * 24 * time.Hour, 24 * time.Hour, time.Hour, 2}
+		now := time.Now()
+
+		key := func(algorithm string, retiresIn time.Duration) SigningKey {
+			id := uuid.New()
+			return SigningKey{ID: id, Algorithm: algorithm, RetiresAt: now.Add(retiresIn), ExpiresAt: now.Add(retiresIn + policy.Retirement)}
+		}
+		keys := func(keys ...SigningKey) map[uuid.UUID]SigningKey {
+			res := make(map[uuid.UUID]SigningKey)
+			for _, key := range keys {
+				res[key.ID] = key
+			}
+			return res
+		}
+
+		assert.Equal(2, policy.Missing(keys(), EdDSA, now))
+		assert.Equal(0, policy.Missing(keys(key(EdDSA, 48*time.Hour), key(EdDSA, 72*time.Hour)), EdDSA, now))
+		// keys of other algorithms do not sign anything
+		assert.Equal(1, policy.Missing(keys(key(EdDSA, 48*time.Hour), key(HS256, 72*time.Hour)), EdDSA, now))
+		// keys retiring soon are replaced ahead of time
+		assert.Equal(1, policy.Missing(keys(key(EdDSA, 48*time.Hour), key(EdDSA, 30*time.Minute)), EdDSA, now))
+	})
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const MaxIdempotencyKeyLength = 255
+const IdempotencyKeyPeriod = time.Duration(24 * time.Hour)
+
+type ErrInvalidIdempotencyKey struct {
+	key string
+}
+
+func (err *ErrInvalidIdempotencyKey) Error() string {
+	return fmt.Sprintf("invalid idempotency key: %q", err.key)
+}
+
+// IdempotencyRecord is the response to the first request made with a key,
+// requests repeated with the key get it instead of being processed again.
+// Until the response is stored its Status is zero.
+type IdempotencyRecord struct {
+	UserID      uuid.UUID
+	Key         string
+	RequestHash []byte
+	Status      int
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// HashIdempotentRequest tells apart requests repeated with the same key from
+// different requests made with the same key
+func HashIdempotentRequest(method string, path string, body []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(method))
+	hash.Write([]byte{0})
+	hash.Write([]byte(path))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hash.Sum(nil)
+}
+
+func NewIdempotencyRecord(user *User, key string, requestHash []byte, createdAt time.Time) (*IdempotencyRecord, error) {
+	if len(key) == 0 || len(key) > MaxIdempotencyKeyLength {
+		return nil, &ErrInvalidIdempotencyKey{key}
+	}
+	for _, character := range key {
+		if character < ' ' || character > '~' {
+			return nil, &ErrInvalidIdempotencyKey{key}
+		}
+	}
+
+	return &IdempotencyRecord{
+		UserID:      user.ID,
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   createdAt,
+		ExpiresAt:   createdAt.Add(IdempotencyKeyPeriod),
+	}, nil
+}
+
+func (record *IdempotencyRecord) Expired() bool {
+	return record.ExpiresAt.Before(time.Now())
+}
+
+func (record *IdempotencyRecord) Completed() bool {
+	return record.Status != 0
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyRecord(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	user, err := NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+
+	hash := HashIdempotentRequest("POST", "/api/user/orders", []byte("12345678903"))
+	assert.Equal(hash, HashIdempotentRequest("POST", "/api/user/orders", []byte("12345678903")))
+	assert.NotEqual(hash, HashIdempotentRequest("POST", "/api/user/orders", []byte("4561261212345467")))
+	assert.NotEqual(hash, HashIdempotentRequest("POST", "/api/user/orders1", []byte("2345678903")))
+
+	record, err := NewIdempotencyRecord(user, "5f1c7a4e-retry", hash, time.Now())
+	if assert.NoError(err) {
+		assert.Equal(user.ID, record.UserID)
+		assert.False(record.Expired())
+		assert.False(record.Completed())
+	}
+
+	record, err = NewIdempotencyRecord(user, "stale", hash, time.Now().Add(-IdempotencyKeyPeriod-time.Second))
+	if assert.NoError(err) {
+		assert.True(record.Expired())
+	}
+
+	for _, key := range []string{"", strings.Repeat("k", MaxIdempotencyKeyLength+1), "new\nline", "ключ"} {
+		_, err = NewIdempotencyRecord(user, key, hash, time.Now())
+		assert.IsType(&ErrInvalidIdempotencyKey{}, err, key)
+	}
+}
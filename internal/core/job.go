@@ -0,0 +1,70 @@
+package core
+
+import (
+	"math/rand"
+	"time"
+)
+
+type JobStatus = string
+
+const (
+	PENDING = "PENDING"
+	DEAD    = "DEAD"
+)
+
+// AccrualJob tracks polling of the accrual system for a single order. A job
+// is leased by one worker at a time until LockedUntil.
+type AccrualJob struct {
+	OrderID       string
+	Status        JobStatus
+	Attempts      int
+	Failures      int
+	LastError     string
+	NextAttemptAt time.Time
+	LockedBy      string
+	LockedUntil   *time.Time
+	CreatedAt     time.Time
+}
+
+func NewAccrualJob(order *Order, firstAttemptAt time.Time) *AccrualJob {
+	return &AccrualJob{
+		OrderID:       order.ID,
+		Status:        PENDING,
+		NextAttemptAt: firstAttemptAt,
+		CreatedAt:     order.UploadedAt,
+	}
+}
+
+func (job *AccrualJob) Leased(now time.Time) bool {
+	return job.LockedUntil != nil && now.Before(*job.LockedUntil)
+}
+
+type RetryPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxFailures int
+}
+
+// Exhausted tells whether a job failed failures times should be given up on
+func (policy RetryPolicy) Exhausted(failures int) bool {
+	return failures >= policy.MaxFailures
+}
+
+// Backoff returns delay before the next attempt of a job failed failures
+// times: it doubles with every failure, and a random half of it is
+// jittered away so that failed jobs do not come back all at once
+func (policy RetryPolicy) Backoff(failures int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
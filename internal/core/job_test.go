@@ -0,0 +1,36 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+	policy := RetryPolicy{time.Second, time.Minute, 5}
+
+	t.Run("Backoff grows exponentially", func(t *testing.T) {
+		testcases := []struct {
+			failures int
+			expected time.Duration
+		}{
+			{1, time.Second},
+			{2, 2 * time.Second},
+			{3, 4 * time.Second},
+			{7, time.Minute},
+			{100, time.Minute},
+		}
+		for _, tCase := range testcases {
+			backoff := policy.Backoff(tCase.failures)
+			assert.GreaterOrEqual(t, backoff, tCase.expected/2)
+			assert.Less(t, backoff, tCase.expected)
+		}
+	})
+
+	t.Run("Policy is exhausted after max failures", func(t *testing.T) {
+		assert.False(t, policy.Exhausted(4))
+		assert.True(t, policy.Exhausted(5))
+	})
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+type EntryType = string
+
+const (
+	OPENING    = "OPENING"
+	ACCRUAL    = "ACCRUAL"
+	WITHDRAWAL = "WITHDRAWAL"
+	ADJUSTMENT = "ADJUSTMENT"
+)
+
+// system accounts on the other side of every user's balance movement
+const (
+	AccrualAccount    = "system:accrual"
+	WithdrawalAccount = "system:withdrawal"
+	AdjustmentAccount = "system:adjustment"
+)
+
+type AdjustmentReason = string
+
+// reasons operators may adjust balances for
+const (
+	GOODWILL              = "GOODWILL"
+	ACCRUAL_CORRECTION    = "ACCRUAL_CORRECTION"
+	WITHDRAWAL_CORRECTION = "WITHDRAWAL_CORRECTION"
+	FRAUD_REVERSAL        = "FRAUD_REVERSAL"
+	OTHER                 = "OTHER"
+)
+
+var AdjustmentReasons = []AdjustmentReason{GOODWILL, ACCRUAL_CORRECTION, WITHDRAWAL_CORRECTION, FRAUD_REVERSAL, OTHER}
+
+const MaxAdjustmentNote = 500
+
+type ErrInvalidAdjustment struct {
+	reason string
+}
+
+func (err *ErrInvalidAdjustment) Error() string {
+	return fmt.Sprintf("invalid balance adjustment: %s", err.reason)
+}
+
+func UserAccount(userID uuid.UUID) string {
+	return fmt.Sprintf("user:%s", userID)
+}
+
+// LedgerEntry moves Amount from Debit account to Credit account. Entries are
+// never changed once created, user's balance is the sum of their deltas.
+// Adjustments carry the reason and note the operator gave, the operator
+// is not disclosed to the user.
+type LedgerEntry struct {
+	ID         uuid.UUID        `json:"id"`
+	UserID     uuid.UUID        `json:"-"`
+	Type       EntryType        `json:"type"`
+	Debit      string           `json:"debit"`
+	Credit     string           `json:"credit"`
+	Amount     decimal.Decimal  `json:"amount"`
+	OrderID    string           `json:"order,omitempty"`
+	Reason     AdjustmentReason `json:"reason,omitempty"`
+	Note       string           `json:"note,omitempty"`
+	OperatorID uuid.UUID        `json:"-"`
+	CreatedAt  time.Time        `json:"created_at"`
+}
+
+func newLedgerEntry(userID uuid.UUID, entryType EntryType, debit, credit string, amount decimal.Decimal, orderID string, createdAt time.Time) (*LedgerEntry, error) {
+	if !amount.IsPositive() {
+		return nil, fmt.Errorf("ledger entry amount should be positive, got %s", amount)
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	return &LedgerEntry{
+		ID:        id,
+		UserID:    userID,
+		Type:      entryType,
+		Debit:     debit,
+		Credit:    credit,
+		Amount:    amount,
+		OrderID:   orderID,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+func NewAccrualEntry(order *Order, sum decimal.Decimal, createdAt time.Time) (*LedgerEntry, error) {
+	return newLedgerEntry(order.UserID, ACCRUAL, AccrualAccount, UserAccount(order.UserID), sum, order.ID, createdAt)
+}
+
+func NewWithdrawalEntry(withdrawal *Withdrawal, order *Order) (*LedgerEntry, error) {
+	return newLedgerEntry(order.UserID, WITHDRAWAL, UserAccount(order.UserID), WithdrawalAccount, withdrawal.Sum, withdrawal.OrderID, withdrawal.ProcessedAt)
+}
+
+// NewOpeningEntry records the balance user had when they were created, nil
+// is returned for users starting from zero
+func NewOpeningEntry(user *User, createdAt time.Time) (*LedgerEntry, error) {
+	switch user.Balance.Sign() {
+	case 1:
+		return newLedgerEntry(user.ID, OPENING, AdjustmentAccount, UserAccount(user.ID), user.Balance, "", createdAt)
+	case -1:
+		return newLedgerEntry(user.ID, OPENING, UserAccount(user.ID), AdjustmentAccount, user.Balance.Neg(), "", createdAt)
+	default:
+		return nil, nil
+	}
+}
+
+// NewAdjustmentEntry credits user with amount, or debits them if it is
+// negative, on behalf of operator
+func NewAdjustmentEntry(user *User, amount decimal.Decimal, reason AdjustmentReason, note string, operator *User, createdAt time.Time) (*LedgerEntry, error) {
+	valid := false
+	for _, known := range AdjustmentReasons {
+		if reason == known {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, &ErrInvalidAdjustment{fmt.Sprintf("unknown reason %s, should be one of %s", reason, strings.Join(AdjustmentReasons, ", "))}
+	}
+	if len(note) > MaxAdjustmentNote {
+		return nil, &ErrInvalidAdjustment{fmt.Sprintf("note should be at most %d bytes long", MaxAdjustmentNote)}
+	}
+
+	var entry *LedgerEntry
+	var err error
+	switch amount.Sign() {
+	case 1:
+		entry, err = newLedgerEntry(user.ID, ADJUSTMENT, AdjustmentAccount, UserAccount(user.ID), amount, "", createdAt)
+	case -1:
+		entry, err = newLedgerEntry(user.ID, ADJUSTMENT, UserAccount(user.ID), AdjustmentAccount, amount.Neg(), "", createdAt)
+	default:
+		return nil, &ErrInvalidAdjustment{"amount should not be zero"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Reason = reason
+	entry.Note = note
+	entry.OperatorID = operator.ID
+	return entry, nil
+}
+
+// Delta returns the change entry makes to account's balance
+func (entry *LedgerEntry) Delta(account string) decimal.Decimal {
+	switch account {
+	case entry.Credit:
+		return entry.Amount
+	case entry.Debit:
+		return entry.Amount.Neg()
+	default:
+		return decimal.Zero
+	}
+}
+
+type BalanceMismatch struct {
+	UserID uuid.UUID
+	Cached decimal.Decimal
+	Ledger decimal.Decimal
+}
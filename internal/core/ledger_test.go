@@ -0,0 +1,86 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger(t *testing.T) {
+	t.Parallel()
+	user, err := NewUser("Alice", "sikret")
+	if err != nil {
+		assert.FailNow(t, "Unable to instantiate user")
+	}
+	account := UserAccount(user.ID)
+
+	t.Run("Opening entry is not created for zero balance", func(t *testing.T) {
+		entry, err := NewOpeningEntry(user, time.Now())
+		assert.NoError(t, err)
+		assert.Nil(t, entry)
+	})
+
+	t.Run("Accrual and withdrawal change balance in opposite directions", func(t *testing.T) {
+		order, err := NewOrder("4561261212345467", user, time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		accrual, err := NewAccrualEntry(order, decimal.New(42, 0), time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, decimal.New(42, 0).Equal(accrual.Delta(account)))
+		assert.True(t, decimal.New(-42, 0).Equal(accrual.Delta(AccrualAccount)))
+
+		withdrawal, err := NewWithdrawal(order, decimal.New(13, 0), time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		entry, err := NewWithdrawalEntry(withdrawal, order)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, decimal.New(-13, 0).Equal(entry.Delta(account)))
+		assert.True(t, decimal.Zero.Equal(entry.Delta(AccrualAccount)))
+	})
+
+	t.Run("Entries with non-positive amount are rejected", func(t *testing.T) {
+		order, err := NewOrder("4561261212345467", user, time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = NewAccrualEntry(order, decimal.Zero, time.Now())
+		assert.Error(t, err)
+	})
+
+	t.Run("Adjustments credit or debit the user", func(t *testing.T) {
+		operator, err := NewUser("Bob", "sikret")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		credit, err := NewAdjustmentEntry(user, decimal.New(5, 0), GOODWILL, "sorry for the delay", operator, time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, ADJUSTMENT, credit.Type)
+		assert.True(t, decimal.New(5, 0).Equal(credit.Delta(account)))
+		assert.Equal(t, operator.ID, credit.OperatorID)
+		assert.Equal(t, GOODWILL, credit.Reason)
+
+		debit, err := NewAdjustmentEntry(user, decimal.New(-3, 0), ACCRUAL_CORRECTION, "", operator, time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, decimal.New(3, 0).Equal(debit.Amount))
+		assert.True(t, decimal.New(-3, 0).Equal(debit.Delta(account)))
+
+		_, err = NewAdjustmentEntry(user, decimal.Zero, GOODWILL, "", operator, time.Now())
+		assert.IsType(t, &ErrInvalidAdjustment{}, err)
+		_, err = NewAdjustmentEntry(user, decimal.New(5, 0), "BECAUSE", "", operator, time.Now())
+		assert.IsType(t, &ErrInvalidAdjustment{}, err)
+	})
+}
@@ -69,3 +69,11 @@ func NewOrder(id string, user *User, uploadedAt time.Time) (*Order, error) {
 		nil,
 	}, nil
 }
+
+// OrderDetails is an order along with the job polling the accrual system for
+// it and the withdrawal made against it, either of which may be nil
+type OrderDetails struct {
+	Order      *Order
+	Job        *AccrualJob
+	Withdrawal *Withdrawal
+}
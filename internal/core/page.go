@@ -0,0 +1,59 @@
+package core
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type ErrInvalidCursor struct {
+	cursor string
+}
+
+func (err *ErrInvalidCursor) Error() string {
+	return fmt.Sprintf("invalid page cursor: %s", err.cursor)
+}
+
+// Cursor points at the last record of a page of records ordered by time and
+// then by id, the next page starts right after it. Clients get it encoded
+// and should treat it as opaque.
+type Cursor struct {
+	At time.Time
+	ID string
+}
+
+func (cursor Cursor) Encode() string {
+	raw := cursor.At.UTC().Format(time.RFC3339Nano) + "|" + cursor.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func ParseCursor(encoded string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, &ErrInvalidCursor{encoded}
+	}
+
+	parts := strings.SplitN(string(raw), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, &ErrInvalidCursor{encoded}
+	}
+	at, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, &ErrInvalidCursor{encoded}
+	}
+
+	return &Cursor{at, parts[1]}, nil
+}
+
+// Follows tells whether a record at the given time with the given id comes
+// after the cursor, in descending order if descending is set
+func (cursor *Cursor) Follows(at time.Time, id string, descending bool) bool {
+	if !at.Equal(cursor.At) {
+		return at.After(cursor.At) != descending
+	}
+	if id == cursor.ID {
+		return false
+	}
+	return (id > cursor.ID) != descending
+}
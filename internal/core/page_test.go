@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	t.Parallel()
+
+	at := time.Date(2022, 8, 8, 21, 40, 0, 123456789, time.FixedZone("MSK", 3*60*60))
+
+	t.Run("Encoded cursor is parsed back", func(t *testing.T) {
+		cursor := Cursor{at, "12345678903"}
+		parsed, err := ParseCursor(cursor.Encode())
+		if assert.NoError(t, err) {
+			assert.True(t, at.Equal(parsed.At))
+			assert.Equal(t, "12345678903", parsed.ID)
+		}
+	})
+
+	t.Run("Malformed cursors are rejected", func(t *testing.T) {
+		for _, encoded := range []string{"", "not base64!", Cursor{at, ""}.Encode(), "bm90IGEgY3Vyc29y"} {
+			_, err := ParseCursor(encoded)
+			assert.IsType(t, &ErrInvalidCursor{}, err, encoded)
+		}
+	})
+
+	t.Run("Records are ordered by time and then by id", func(t *testing.T) {
+		cursor := Cursor{at, "5"}
+
+		assert.True(t, cursor.Follows(at.Add(time.Second), "1", false))
+		assert.False(t, cursor.Follows(at.Add(-time.Second), "9", false))
+		assert.True(t, cursor.Follows(at, "6", false))
+		assert.False(t, cursor.Follows(at, "4", false))
+		assert.False(t, cursor.Follows(at, "5", false))
+
+		assert.False(t, cursor.Follows(at.Add(time.Second), "1", true))
+		assert.True(t, cursor.Follows(at.Add(-time.Second), "9", true))
+		assert.True(t, cursor.Follows(at, "4", true))
+		assert.False(t, cursor.Follows(at, "6", true))
+		assert.False(t, cursor.Follows(at, "5", true))
+	})
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/utils"
+	"github.com/google/uuid"
+)
+
+const PasswordResetTokenLength = 32
+const PasswordResetPeriod = time.Duration(time.Hour)
+
+// PasswordResetToken lets its holder set a new password once. As with
+// refresh tokens, only its hash is stored.
+type PasswordResetToken struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	Hash      []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func HashPasswordResetToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// NewPasswordResetToken returns the token to be sent to the user along with
+// its record to be stored
+func NewPasswordResetToken(user *User, createdAt time.Time) (string, *PasswordResetToken, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := utils.GenerateRandomBytes(PasswordResetTokenLength)
+	if err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, &PasswordResetToken{
+		id,
+		user.ID,
+		HashPasswordResetToken(token),
+		createdAt,
+		createdAt.Add(PasswordResetPeriod),
+		nil,
+	}, nil
+}
+
+func (token *PasswordResetToken) Expired() bool {
+	return token.ExpiresAt.Before(time.Now())
+}
+
+func (token *PasswordResetToken) Used() bool {
+	return token.UsedAt != nil
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordResetToken(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	user, err := NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+
+	token, record, err := NewPasswordResetToken(user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	other, _, err := NewPasswordResetToken(user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NotEqual(token, other)
+	assert.Equal(user.ID, record.UserID)
+	assert.Equal(HashPasswordResetToken(token), record.Hash)
+	assert.NotContains(string(record.Hash), token)
+	assert.False(record.Expired())
+	assert.False(record.Used())
+
+	_, expired, err := NewPasswordResetToken(user, time.Now().Add(-PasswordResetPeriod-time.Second))
+	if assert.NoError(err) {
+		assert.True(expired.Expired())
+	}
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/utils"
+	"github.com/google/uuid"
+)
+
+const RefreshTokenLength = 32
+const RefreshTokenPeriod = time.Duration(30 * 24 * time.Hour)
+
+// Session is the family of refresh tokens issued one after another since a
+// single login. Revoking the session revokes all of them, as well as access
+// tokens issued for it.
+type Session struct {
+	ID        uuid.UUID
+	UserID    uuid.UUID
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+func NewSession(user *User, createdAt time.Time) (*Session, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		id,
+		user.ID,
+		createdAt,
+		nil,
+	}, nil
+}
+
+func (session *Session) Revoked() bool {
+	return session.RevokedAt != nil
+}
+
+// RefreshToken is kept only as a hash, the token itself is handed to the
+// client once. Every token may be exchanged for a new one only once, so
+// a used token showing up again means it has leaked.
+type RefreshToken struct {
+	ID        uuid.UUID
+	SessionID uuid.UUID
+	Hash      []byte
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+func HashRefreshToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// NewRefreshToken returns the token to be handed to the client along with
+// its record to be stored
+func NewRefreshToken(session *Session, createdAt time.Time) (string, *RefreshToken, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := utils.GenerateRandomBytes(RefreshTokenLength)
+	if err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, &RefreshToken{
+		id,
+		session.ID,
+		HashRefreshToken(token),
+		createdAt,
+		createdAt.Add(RefreshTokenPeriod),
+		nil,
+	}, nil
+}
+
+func (token *RefreshToken) Expired() bool {
+	return token.ExpiresAt.Before(time.Now())
+}
+
+func (token *RefreshToken) Used() bool {
+	return token.UsedAt != nil
+}
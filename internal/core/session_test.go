@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	user, err := NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+	session, err := NewSession(user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	assert.False(session.Revoked())
+
+	first, firstRecord, err := NewRefreshToken(session, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	second, secondRecord, err := NewRefreshToken(session, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.NotEqual(first, second)
+	assert.Equal(session.ID, firstRecord.SessionID)
+	assert.Equal(HashRefreshToken(first), firstRecord.Hash)
+	assert.Equal(HashRefreshToken(second), secondRecord.Hash)
+	assert.NotEqual(firstRecord.Hash, secondRecord.Hash)
+	assert.NotContains(string(firstRecord.Hash), first)
+	assert.False(firstRecord.Expired())
+	assert.False(firstRecord.Used())
+
+	_, expired, err := NewRefreshToken(session, time.Now().Add(-RefreshTokenPeriod-time.Second))
+	if assert.NoError(err) {
+		assert.True(expired.Expired())
+	}
+}
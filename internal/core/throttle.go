@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LoginAttempts counts failed logins under a single key, such as a login or
+// a client address. Failures older than the throttle window are forgotten.
+type LoginAttempts struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+}
+
+func LoginKey(login string) string {
+	return fmt.Sprintf("login:%s", login)
+}
+
+func AddressKey(ip string) string {
+	return fmt.Sprintf("ip:%s", ip)
+}
+
+func TwoFactorKey(userID uuid.UUID) string {
+	return fmt.Sprintf("2fa:%s", userID)
+}
+
+// ThrottlePolicy lets FreeAttempts failures go without delay, after them
+// every next attempt has to wait twice as long as the previous one, up to
+// MaxDelay. Once failures reach Lockout, attempts are rejected for
+// LockoutPeriod.
+type ThrottlePolicy struct {
+	FreeAttempts  int
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	Lockout       int
+	LockoutPeriod time.Duration
+	Window        time.Duration
+}
+
+var DefaultLoginThrottle = ThrottlePolicy{
+	FreeAttempts:  3,
+	BaseDelay:     time.Second,
+	MaxDelay:      time.Minute,
+	Lockout:       10,
+	LockoutPeriod: 15 * time.Minute,
+	Window:        time.Hour,
+}
+
+// many users may share an address, so it is given more room
+var DefaultAddressThrottle = ThrottlePolicy{
+	FreeAttempts:  20,
+	BaseDelay:     time.Second,
+	MaxDelay:      time.Minute,
+	Lockout:       100,
+	LockoutPeriod: 15 * time.Minute,
+	Window:        time.Hour,
+}
+
+func (policy ThrottlePolicy) Validate() error {
+	if policy.FreeAttempts < 0 || policy.Lockout <= policy.FreeAttempts {
+		return fmt.Errorf("lockout threshold %d should exceed %d free attempts", policy.Lockout, policy.FreeAttempts)
+	}
+	if policy.LockoutPeriod > policy.Window {
+		return fmt.Errorf("lockout period %s should not exceed window %s failures are counted in", policy.LockoutPeriod, policy.Window)
+	}
+	return nil
+}
+
+// Delay returns time to wait after the last of failures before trying again
+func (policy ThrottlePolicy) Delay(failures int) time.Duration {
+	if failures >= policy.Lockout {
+		return policy.LockoutPeriod
+	}
+	if failures <= policy.FreeAttempts {
+		return 0
+	}
+
+	delay := policy.BaseDelay
+	for i := policy.FreeAttempts + 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	return delay
+}
+
+// BlockedUntil returns the moment the next attempt is allowed at, it is in
+// the past if the attempt is allowed already
+func (policy ThrottlePolicy) BlockedUntil(attempts *LoginAttempts, now time.Time) time.Time {
+	if attempts.Failures == 0 || now.Sub(attempts.LastFailureAt) > policy.Window {
+		return now
+	}
+	return attempts.LastFailureAt.Add(policy.Delay(attempts.Failures))
+}
+
+// LocksOut tells whether the failure which brought the count to failures
+// has locked the key out. Attempts are rejected while the key is locked out,
+// so every failure past the threshold comes after the previous lockout has
+// passed and locks the key out again.
+func (policy ThrottlePolicy) LocksOut(failures int) bool {
+	return failures >= policy.Lockout
+}
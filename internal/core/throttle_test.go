@@ -0,0 +1,78 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottlePolicy(t *testing.T) {
+	t.Parallel()
+	policy := ThrottlePolicy{
+		FreeAttempts:  2,
+		BaseDelay:     time.Second,
+		MaxDelay:      10 * time.Second,
+		Lockout:       10,
+		LockoutPeriod: time.Minute,
+		Window:        time.Hour,
+	}
+
+	t.Run("Delay grows exponentially after free attempts", func(t *testing.T) {
+		testcases := []struct {
+			failures int
+			expected time.Duration
+		}{
+			{0, 0},
+			{2, 0},
+			{3, time.Second},
+			{4, 2 * time.Second},
+			{5, 4 * time.Second},
+			{9, 10 * time.Second},
+			{10, time.Minute},
+			{100, time.Minute},
+		}
+		for _, tCase := range testcases {
+			assert.Equal(t, tCase.expected, policy.Delay(tCase.failures), tCase.failures)
+		}
+	})
+
+	t.Run("Attempts are blocked until delay passes", func(t *testing.T) {
+		now := time.Now()
+		testcases := []struct {
+			name     string
+			attempts LoginAttempts
+			expected time.Time
+		}{
+			{"No failures", LoginAttempts{"login:alice", 0, time.Time{}}, now},
+			{"Free attempts", LoginAttempts{"login:alice", 2, now}, now},
+			{"Delayed", LoginAttempts{"login:alice", 4, now}, now.Add(2 * time.Second)},
+			{"Locked out", LoginAttempts{"login:alice", 10, now}, now.Add(time.Minute)},
+			{"Forgotten", LoginAttempts{"login:alice", 10, now.Add(-2 * time.Hour)}, now},
+		}
+		for _, tCase := range testcases {
+			assert.Equal(t, tCase.expected, policy.BlockedUntil(&tCase.attempts, now), tCase.name)
+		}
+	})
+
+	t.Run("Every failure past the threshold locks out again", func(t *testing.T) {
+		assert.False(t, policy.LocksOut(9))
+		assert.True(t, policy.LocksOut(10))
+		assert.True(t, policy.LocksOut(11))
+		assert.Equal(t, policy.LockoutPeriod, policy.Delay(11))
+	})
+
+	t.Run("Policies are validated", func(t *testing.T) {
+		assert.NoError(t, policy.Validate())
+		assert.NoError(t, DefaultLoginThrottle.Validate())
+		assert.NoError(t, DefaultAddressThrottle.Validate())
+
+		invalid := policy
+		invalid.Lockout = 2
+		assert.Error(t, invalid.Validate())
+
+		invalid = policy
+		invalid.LockoutPeriod = 2 * time.Hour
+		assert.Error(t, invalid.Validate())
+	})
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/utils"
+	"github.com/google/uuid"
+)
+
+// TOTP parameters as understood by common authenticator apps (RFC 6238)
+const (
+	TOTPSecretLength = 20
+	TOTPDigits       = 6
+	TOTPPeriod       = 30 * time.Second
+	// codes of adjacent periods are accepted as well, to tolerate clock drift
+	TOTPSkew = 1
+)
+
+const TOTPIssuer = "Gophermart"
+
+const RecoveryCodeLength = 10
+const RecoveryCodes = 10
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is TOTP enrollment of a user. It is pending until the user
+// proves their authenticator works by entering a code. LastCounter is the
+// time step of the last accepted code, codes are never accepted twice.
+type TwoFactor struct {
+	UserID      uuid.UUID
+	Secret      []byte
+	Enabled     bool
+	LastCounter int64
+	CreatedAt   time.Time
+	EnabledAt   *time.Time
+}
+
+func NewTwoFactor(user *User, createdAt time.Time) (*TwoFactor, error) {
+	secret, err := utils.GenerateRandomBytes(TOTPSecretLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TwoFactor{
+		UserID:    user.ID,
+		Secret:    secret,
+		CreatedAt: createdAt,
+	}, nil
+}
+
+// EncodedSecret is the secret in the form authenticator apps accept
+func (twoFactor *TwoFactor) EncodedSecret() string {
+	return totpEncoding.EncodeToString(twoFactor.Secret)
+}
+
+// ProvisioningURI is the otpauth URI usually shown to users as a QR code
+func (twoFactor *TwoFactor) ProvisioningURI(account string) string {
+	query := url.Values{}
+	query.Set("secret", twoFactor.EncodedSecret())
+	query.Set("issuer", TOTPIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTPDigits))
+	query.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + TOTPIssuer + ":" + account,
+		RawQuery: query.Encode(),
+	}
+	return uri.String()
+}
+
+func totpCounter(at time.Time) int64 {
+	return at.Unix() / int64(TOTPPeriod/time.Second)
+}
+
+// hotp computes the code for counter as described by RFC 4226
+func hotp(secret []byte, counter int64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, truncated%modulo)
+}
+
+// Code returns the code valid at the given moment
+func (twoFactor *TwoFactor) Code(at time.Time) string {
+	return hotp(twoFactor.Secret, totpCounter(at))
+}
+
+// Validate returns the time step code was valid at, codes of steps up to
+// LastCounter are rejected as replayed
+func (twoFactor *TwoFactor) Validate(code string, at time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	current := totpCounter(at)
+
+	for counter := current - TOTPSkew; counter <= current+TOTPSkew; counter++ {
+		if counter <= twoFactor.LastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(twoFactor.Secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns codes to be handed to the user along with their
+// hashes to be stored. Every code may replace a TOTP code once.
+func NewRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, 0, RecoveryCodes)
+	hashes := make([][]byte, 0, RecoveryCodes)
+
+	for i := 0; i < RecoveryCodes; i++ {
+		raw, err := utils.GenerateRandomBytes(RecoveryCodeLength)
+		if err != nil {
+			return nil, nil, err
+		}
+		encoded := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code := encoded[:8] + "-" + encoded[8:16]
+
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode ignores case and separators users may type the code with
+func HashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(code)
+	normalized = strings.NewReplacer("-", "", " ", "").Replace(normalized)
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
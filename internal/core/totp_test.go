@@ -0,0 +1,92 @@
+package core
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTP(t *testing.T) {
+	t.Parallel()
+
+	// test vectors of RFC 6238 for SHA1, truncated to six digits
+	twoFactor := TwoFactor{Secret: []byte("12345678901234567890")}
+
+	t.Run("Codes match test vectors", func(t *testing.T) {
+		testCases := []struct {
+			unix     int64
+			expected string
+		}{
+			{59, "287082"},
+			{1111111109, "081804"},
+			{1111111111, "050471"},
+			{1234567890, "005924"},
+			{2000000000, "279037"},
+			{20000000000, "353130"},
+		}
+		for _, tCase := range testCases {
+			assert.Equal(t, tCase.expected, twoFactor.Code(time.Unix(tCase.unix, 0)), tCase.unix)
+		}
+	})
+
+	t.Run("Codes of adjacent periods are accepted once", func(t *testing.T) {
+		now := time.Unix(1234567890, 0)
+		twoFactor := twoFactor
+
+		counter, valid := twoFactor.Validate(twoFactor.Code(now.Add(-TOTPPeriod)), now)
+		assert.True(t, valid)
+		assert.Equal(t, totpCounter(now)-1, counter)
+
+		_, valid = twoFactor.Validate(twoFactor.Code(now.Add(-2*TOTPPeriod)), now)
+		assert.False(t, valid)
+		_, valid = twoFactor.Validate("000000", now)
+		assert.False(t, valid)
+
+		twoFactor.LastCounter = totpCounter(now)
+		_, valid = twoFactor.Validate(twoFactor.Code(now), now)
+		assert.False(t, valid)
+		_, valid = twoFactor.Validate(twoFactor.Code(now.Add(TOTPPeriod)), now)
+		assert.True(t, valid)
+	})
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	user, err := NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+	twoFactor, err := NewTwoFactor(user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	assert.False(twoFactor.Enabled)
+	assert.Len(twoFactor.Secret, TOTPSecretLength)
+
+	uri, err := url.Parse(twoFactor.ProvisioningURI("alice"))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("otpauth", uri.Scheme)
+	assert.Equal("totp", uri.Host)
+	assert.Equal("/Gophermart:alice", uri.Path)
+	assert.Equal(twoFactor.EncodedSecret(), uri.Query().Get("secret"))
+	assert.Equal("Gophermart", uri.Query().Get("issuer"))
+
+	codes, hashes, err := NewRecoveryCodes()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(codes, RecoveryCodes)
+	assert.Len(hashes, RecoveryCodes)
+	assert.Equal(hashes[0], HashRecoveryCode(codes[0]))
+	assert.NotEqual(hashes[0], hashes[1])
+
+	// users may type codes in any case and without the dash
+	assert.Len(codes[0], 17)
+	assert.Equal(hashes[0], HashRecoveryCode(" "+codes[0][:8]+codes[0][9:]))
+}
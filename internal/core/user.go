@@ -18,14 +18,57 @@ var (
 	ErrIncompatibleArgonVersion = errors.New("incompatible argon version")
 )
 
+type Role = string
+
+// roles are ordered, every role is granted whatever roles before it are
+const (
+	ROLE_USER    = "user"
+	ROLE_SUPPORT = "support"
+	ROLE_ADMIN   = "admin"
+)
+
+var Roles = []Role{ROLE_USER, ROLE_SUPPORT, ROLE_ADMIN}
+
+type ErrInvalidRole struct {
+	role string
+}
+
+func (err *ErrInvalidRole) Error() string {
+	return fmt.Sprintf("unknown role %s, should be one of %s", err.role, strings.Join(Roles, ", "))
+}
+
+func roleRank(role Role) int {
+	for rank, known := range Roles {
+		if role == known {
+			return rank
+		}
+	}
+	return -1
+}
+
+func ValidateRole(role Role) error {
+	if roleRank(role) < 0 {
+		return &ErrInvalidRole{role}
+	}
+	return nil
+}
+
+// User may not log in once Disabled, their sessions and API keys are
+// rejected as well
 type User struct {
 	ID           uuid.UUID
 	Login        string
 	PasswordHash string
 	Balance      decimal.Decimal
+	Role         Role
+	Disabled     bool
 }
 
 func NewUser(login, password string) (*User, error) {
+	return NewUserWithParams(login, password, DefaultPasswordParams)
+}
+
+func NewUserWithParams(login, password string, params PasswordParams) (*User, error) {
 	user := new(User)
 	id, err := uuid.NewRandom()
 	if err != nil {
@@ -33,7 +76,8 @@ func NewUser(login, password string) (*User, error) {
 	}
 	user.ID = id
 	user.Balance = decimal.Zero
-	passwordHash, err := generatePasswordHash(password)
+	user.Role = ROLE_USER
+	passwordHash, err := generatePasswordHash(password, params)
 	if err != nil {
 		return nil, err
 	}
@@ -42,13 +86,41 @@ func NewUser(login, password string) (*User, error) {
 	return user, nil
 }
 
+// HasRole tells whether the user is granted role, either directly or
+// through a higher one
+func (user *User) HasRole(role Role) bool {
+	rank := roleRank(role)
+	return rank >= 0 && roleRank(user.Role) >= rank
+}
+
+// SetPassword replaces the password hash, the change should be persisted
+// with UpdatePasswordHash
+func (user *User) SetPassword(password string, params PasswordParams) error {
+	passwordHash, err := generatePasswordHash(password, params)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = passwordHash
+	return nil
+}
+
+// NeedsRehash tells whether the password hash was produced with parameters
+// weaker than params, so that it should be replaced on the next login
+func (user *User) NeedsRehash(params PasswordParams) (bool, error) {
+	decodedHash, err := decodeHash(user.PasswordHash)
+	if err != nil {
+		return false, err
+	}
+	return decodedHash.WeakerThan(params), nil
+}
+
 func (user *User) ValidatePassword(password string) (bool, error) {
 	decodedHash, err := decodeHash(user.PasswordHash)
 	if err != nil {
 		return false, err
 	}
 
-	hash := argon2.IDKey([]byte(password), decodedHash.salt, decodedHash.iterations, decodedHash.memory, decodedHash.parallelism, decodedHash.keyLength)
+	hash := argon2.IDKey([]byte(password), decodedHash.salt, decodedHash.Iterations, decodedHash.Memory, decodedHash.Parallelism, decodedHash.KeyLength)
 
 	if subtle.ConstantTimeCompare(decodedHash.hash, hash) == 1 {
 		return true, nil
@@ -57,40 +129,68 @@ func (user *User) ValidatePassword(password string) (bool, error) {
 	return false, nil
 }
 
-type passwordGenerationParams struct {
-	memory      uint32
-	iterations  uint32
-	parallelism uint8
-	saltLenghth uint32
-	keyLength   uint32
+// PasswordParams are argon2id parameters passwords are hashed with, every
+// hash keeps the parameters it was produced with
+type PasswordParams struct {
+	// in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultPasswordParams = PasswordParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func (params PasswordParams) Validate() error {
+	if params.Iterations < 1 {
+		return fmt.Errorf("at least one iteration is required, got %d", params.Iterations)
+	}
+	if params.Parallelism < 1 {
+		return fmt.Errorf("parallelism should be at least 1, got %d", params.Parallelism)
+	}
+	if params.Memory < 8*uint32(params.Parallelism) {
+		return fmt.Errorf("memory should be at least %d KiB for parallelism %d, got %d KiB", 8*uint32(params.Parallelism), params.Parallelism, params.Memory)
+	}
+	if params.SaltLength < 8 || params.KeyLength < 16 {
+		return fmt.Errorf("salt should be at least 8 bytes and key at least 16 bytes long, got %d and %d", params.SaltLength, params.KeyLength)
+	}
+	return nil
+}
+
+// WeakerThan tells whether hashes produced with params are cheaper to brute
+// force than ones produced with other
+func (params PasswordParams) WeakerThan(other PasswordParams) bool {
+	return params.Memory < other.Memory ||
+		params.Iterations < other.Iterations ||
+		params.SaltLength < other.SaltLength ||
+		params.KeyLength < other.KeyLength
 }
 
 type passwordHash struct {
-	passwordGenerationParams
+	PasswordParams
 	salt []byte
 	hash []byte
 }
 
-func generatePasswordHash(pasword string) (string, error) {
-	p := &passwordGenerationParams{
-		64 * 1024,
-		3,
-		2,
-		16,
-		32,
-	}
-
-	salt, err := utils.GenerateRandomBytes(p.saltLenghth)
+func generatePasswordHash(pasword string, p PasswordParams) (string, error) {
+	salt, err := utils.GenerateRandomBytes(p.SaltLength)
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
-	hash := argon2.IDKey([]byte(pasword), salt, p.iterations, p.memory, p.parallelism, p.keyLength)
+	hash := argon2.IDKey([]byte(pasword), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
 
 	encodedSalt := base64.RawStdEncoding.EncodeToString(salt)
 	encodedHash := base64.RawStdEncoding.EncodeToString(hash)
 
-	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.iterations, p.parallelism, encodedSalt, encodedHash)
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism, encodedSalt, encodedHash)
 
 	return encoded, nil
 }
@@ -111,9 +211,9 @@ func decodeHash(encoded string) (*passwordHash, error) {
 		return nil, ErrIncompatibleArgonVersion
 	}
 
-	params := passwordGenerationParams{}
+	params := PasswordParams{}
 
-	_, err = fmt.Sscanf(vals[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	_, err = fmt.Sscanf(vals[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
 	if err != nil {
 		return nil, err
 	}
@@ -122,13 +222,13 @@ func decodeHash(encoded string) (*passwordHash, error) {
 	if err != nil {
 		return nil, err
 	}
-	params.saltLenghth = uint32(len(salt))
+	params.SaltLength = uint32(len(salt))
 
 	hash, err := base64.RawStdEncoding.Strict().DecodeString(vals[5])
 	if err != nil {
 		return nil, err
 	}
-	params.keyLength = uint32(len(hash))
+	params.KeyLength = uint32(len(hash))
 
 	return &passwordHash{params, salt, hash}, nil
 }
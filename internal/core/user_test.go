@@ -27,4 +27,100 @@ func TestUser(t *testing.T) {
 		}
 		assert.False(t, valid)
 	})
+
+	t.Run("change password of a user", func(t *testing.T) {
+		user, err := NewUser("alice", "sikret")
+		if err != nil {
+			assert.FailNow(t, "could not create a user")
+		}
+
+		err = user.SetPassword("correct-horse", DefaultPasswordParams)
+		if err != nil {
+			assert.FailNow(t, "could not set password")
+		}
+
+		valid, err := user.ValidatePassword("correct-horse")
+		if err != nil {
+			assert.FailNow(t, "could not validate password")
+		}
+		assert.True(t, valid)
+
+		valid, err = user.ValidatePassword("sikret")
+		if err != nil {
+			assert.FailNow(t, "could not validate password")
+		}
+		assert.False(t, valid)
+	})
+	t.Run("rehash passwords hashed with weaker parameters", func(t *testing.T) {
+		weak := PasswordParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+		assert.NoError(t, weak.Validate())
+		assert.True(t, weak.WeakerThan(DefaultPasswordParams))
+		assert.False(t, DefaultPasswordParams.WeakerThan(weak))
+
+		user, err := NewUserWithParams("alice", "sikret", weak)
+		if err != nil {
+			assert.FailNow(t, "could not create a user")
+		}
+
+		valid, err := user.ValidatePassword("sikret")
+		if err != nil {
+			assert.FailNow(t, "could not validate password")
+		}
+		assert.True(t, valid)
+
+		rehash, err := user.NeedsRehash(weak)
+		if assert.NoError(t, err) {
+			assert.False(t, rehash)
+		}
+		rehash, err = user.NeedsRehash(DefaultPasswordParams)
+		if assert.NoError(t, err) {
+			assert.True(t, rehash)
+		}
+
+		// parallelism does not make hashes weaker
+		parallel := weak
+		parallel.Parallelism = 4
+		rehash, err = user.NeedsRehash(parallel)
+		if assert.NoError(t, err) {
+			assert.False(t, rehash)
+		}
+	})
+
+	t.Run("validate password parameters", func(t *testing.T) {
+		assert.NoError(t, DefaultPasswordParams.Validate())
+
+		invalid := DefaultPasswordParams
+		invalid.Iterations = 0
+		assert.Error(t, invalid.Validate())
+
+		invalid = DefaultPasswordParams
+		invalid.Memory = 8
+		assert.Error(t, invalid.Validate())
+
+		invalid = DefaultPasswordParams
+		invalid.SaltLength = 4
+		assert.Error(t, invalid.Validate())
+	})
+
+	t.Run("check roles", func(t *testing.T) {
+		user, err := NewUser("alice", "sikret")
+		if err != nil {
+			assert.FailNow(t, "could not create a user")
+		}
+		assert.Equal(t, ROLE_USER, user.Role)
+		assert.True(t, user.HasRole(ROLE_USER))
+		assert.False(t, user.HasRole(ROLE_SUPPORT))
+
+		user.Role = ROLE_SUPPORT
+		assert.True(t, user.HasRole(ROLE_USER))
+		assert.True(t, user.HasRole(ROLE_SUPPORT))
+		assert.False(t, user.HasRole(ROLE_ADMIN))
+
+		user.Role = ROLE_ADMIN
+		assert.True(t, user.HasRole(ROLE_SUPPORT))
+		assert.False(t, user.HasRole("root"))
+
+		assert.NoError(t, ValidateRole(ROLE_ADMIN))
+		assert.Error(t, ValidateRole("root"))
+	})
 }
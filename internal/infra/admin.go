@@ -0,0 +1,382 @@
+package infra
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// requireRole lets only users granted role through to h. The role is checked
+// on the user authenticated with, so with the user cache enabled role changes
+// take effect once the cached entry expires.
+func (app *App) requireRole(role core.Role, h Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user := auth(w, r)
+		if user == nil {
+			return nil
+		}
+		if !user.HasRole(role) {
+			metrics.Add("admin_forbidden_total", 1)
+			return newProblem(http.StatusForbidden, FORBIDDEN, fmt.Sprintf("%s role is required", role))
+		}
+		return h(w, r)
+	}
+}
+
+// auditAction records an operator acting upon subject, which is nil if the
+// action is not about a single user. Views fail if they cannot be audited,
+// so that no data is shown off the record.
+func (app *App) auditAction(r *http.Request, eventType core.AuditEventType, subject *core.User, details map[string]string) error {
+	metrics.Add("admin_actions_total", 1)
+	return app.auditLog.Record(r.Context(), eventType, subject, details)
+}
+
+// auditCommittedAction is auditAction for actions which have been committed
+// already, failing to record them is only logged, otherwise operators would
+// retry actions which took effect
+func (app *App) auditCommittedAction(r *http.Request, eventType core.AuditEventType, subject *core.User, details map[string]string) {
+	metrics.Add("admin_actions_total", 1)
+	recordAudit(r.Context(), app.auditLog, eventType, subject, details)
+}
+
+// subject returns the user the admin request is about, failing with 404 if
+// there is none
+func (app *App) subject(w http.ResponseWriter, r *http.Request) (*core.User, error) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, newProblem(http.StatusNotFound, NOT_FOUND, "")
+	}
+
+	user, err := app.store.WithContext(r.Context()).ExtractUserByID(id)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrUserNotFoundByID:
+		return nil, newProblem(http.StatusNotFound, NOT_FOUND, "")
+	default:
+		return nil, err
+	}
+	return user, nil
+}
+
+type adminUserResponse struct {
+	ID       uuid.UUID `json:"id"`
+	Login    string    `json:"login"`
+	Role     core.Role `json:"role"`
+	Disabled bool      `json:"disabled"`
+}
+
+func writeAdminUser(w http.ResponseWriter, user *core.User) error {
+	body, err := json.Marshal(adminUserResponse{user.ID, user.Login, user.Role, user.Disabled})
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) adminFindUser(w http.ResponseWriter, r *http.Request) error {
+	login := r.URL.Query().Get("login")
+	if login == "" {
+		return newProblem(http.StatusBadRequest, INVALID_QUERY, "login is required")
+	}
+
+	user, err := app.store.WithContext(r.Context()).ExtractUser(login)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrUserNotFound:
+		return newProblem(http.StatusNotFound, NOT_FOUND, "")
+	default:
+		return err
+	}
+
+	err = app.auditAction(r, core.USER_VIEWED, user, nil)
+	if err != nil {
+		return err
+	}
+	return writeAdminUser(w, user)
+}
+
+func (app *App) adminGetUser(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.subject(w, r)
+	if user == nil {
+		return err
+	}
+
+	err = app.auditAction(r, core.USER_VIEWED, user, nil)
+	if err != nil {
+		return err
+	}
+	return writeAdminUser(w, user)
+}
+
+func (app *App) adminListOrders(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.subject(w, r)
+	if user == nil {
+		return err
+	}
+
+	orders, err := app.store.WithContext(r.Context()).ExtractOrdersByUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = app.auditAction(r, core.ORDERS_VIEWED, user, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(orders) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	body, err := json.Marshal(orders)
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) adminListWithdrawals(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.subject(w, r)
+	if user == nil {
+		return err
+	}
+
+	withdrawals, err := app.store.WithContext(r.Context()).ExtractWithdrawalsByUser(user)
+	if err != nil {
+		return err
+	}
+
+	err = app.auditAction(r, core.WITHDRAWALS_VIEWED, user, nil)
+	if err != nil {
+		return err
+	}
+
+	if len(withdrawals) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	body, err := json.Marshal(withdrawals)
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) adminGetBalance(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.subject(w, r)
+	if user == nil {
+		return err
+	}
+
+	withdrawn, err := app.store.WithContext(r.Context()).TotalWithdrawnSum(user)
+	if err != nil {
+		return err
+	}
+
+	err = app.auditAction(r, core.BALANCE_VIEWED, user, nil)
+	if err != nil {
+		return err
+	}
+
+	type balanceResponse struct {
+		Current   decimal.Decimal `json:"current"`
+		Withdrawn decimal.Decimal `json:"withdrawn"`
+	}
+
+	body, err := json.Marshal(balanceResponse{user.Balance, withdrawn})
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+// adminAdjustBalance credits or debits the user, the adjustment shows up in
+// their balance history along with its reason and note
+func (app *App) adminAdjustBalance(w http.ResponseWriter, r *http.Request) error {
+	user, err := app.subject(w, r)
+	if user == nil {
+		return err
+	}
+
+	var data adjustmentRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+
+	entry, err := core.NewAdjustmentEntry(user, data.Amount, data.Reason, data.Note, currentUser(r), time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = app.store.WithContext(r.Context()).AdjustBalance(entry)
+	if err != nil {
+		return err
+	}
+	metrics.Add("balance_adjustments_total", 1)
+
+	app.auditCommittedAction(r, core.BALANCE_ADJUSTED, user, map[string]string{
+		"entry":  entry.ID.String(),
+		"amount": data.Amount.String(),
+		"reason": entry.Reason,
+	})
+
+	body, err = json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusCreated)
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) adminRequeueAccrual(w http.ResponseWriter, r *http.Request) error {
+	number := chi.URLParam(r, "number")
+
+	err := app.store.WithContext(r.Context()).RequeueJob(number)
+	if err != nil {
+		return err
+	}
+
+	app.auditCommittedAction(r, core.ACCRUAL_REQUEUED, nil, map[string]string{"order": number})
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// parseAuditFilter reads the audit query: user and actor ids, types either
+// repeated or comma separated, and the RFC 3339 time range [from, to)
+func parseAuditFilter(r *http.Request) (storage.AuditFilter, error) {
+	var filter storage.AuditFilter
+	var err error
+	query := r.URL.Query()
+
+	filter.Limit, filter.Offset, err = parsePagination(r, DefaultHistoryLimit, MaxHistoryLimit)
+	if err != nil {
+		return filter, err
+	}
+	if raw := query.Get("user"); raw != "" {
+		filter.UserID, err = uuid.Parse(raw)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if raw := query.Get("actor"); raw != "" {
+		filter.ActorID, err = uuid.Parse(raw)
+		if err != nil {
+			return filter, err
+		}
+	}
+	for _, raw := range query["type"] {
+		for _, eventType := range strings.Split(raw, ",") {
+			if eventType != "" {
+				filter.Types = append(filter.Types, strings.ToUpper(eventType))
+			}
+		}
+	}
+	if raw := query.Get("from"); raw != "" {
+		filter.From, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		filter.To, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+func (app *App) adminListAuditEvents(w http.ResponseWriter, r *http.Request) error {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, INVALID_QUERY, err.Error())
+	}
+
+	events, err := app.auditLog.Events(r.Context(), filter)
+	if err != nil {
+		return err
+	}
+
+	err = app.auditAction(r, core.AUDIT_VIEWED, nil, map[string]string{"query": r.URL.RawQuery})
+	if err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+// adminDisableUser locks the user out, their sessions are revoked and their
+// API keys are rejected until the account is enabled again
+func (app *App) adminDisableUser(w http.ResponseWriter, r *http.Request) error {
+	return app.setDisabled(w, r, true)
+}
+
+func (app *App) adminEnableUser(w http.ResponseWriter, r *http.Request) error {
+	return app.setDisabled(w, r, false)
+}
+
+func (app *App) setDisabled(w http.ResponseWriter, r *http.Request, disabled bool) error {
+	user, err := app.subject(w, r)
+	if user == nil {
+		return err
+	}
+
+	// otherwise the last admin could lock everybody out of the admin API
+	if user.ID == currentUser(r).ID {
+		return newProblem(http.StatusConflict, CANNOT_DISABLE_SELF, "")
+	}
+
+	store := app.store.WithContext(r.Context())
+	err = store.SetUserDisabled(user.ID, disabled)
+	if err != nil {
+		return err
+	}
+	app.users.Invalidate(user.ID)
+
+	eventType := core.USER_ENABLED
+	if disabled {
+		eventType = core.USER_DISABLED
+
+		revoked, err := store.RevokeUserSessions(user.ID, uuid.Nil)
+		if err != nil {
+			return err
+		}
+		for _, id := range revoked {
+			app.sessions.Invalidate(id)
+		}
+	}
+
+	app.auditCommittedAction(r, eventType, user, nil)
+
+	user.Disabled = disabled
+	return writeAdminUser(w, user)
+}
@@ -0,0 +1,115 @@
+package infra
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type BreakerState = string
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+type ErrCircuitOpen struct {
+	retryAt time.Time
+}
+
+func (err *ErrCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit breaker is open until %s", err.retryAt)
+}
+
+// CircuitBreaker stops calls to the accrual system after threshold
+// consecutive failures. Once openTimeout passes, a single probe call is let
+// through: its success closes the circuit, its failure opens it again.
+type CircuitBreaker struct {
+	sync.Mutex
+	state       BreakerState
+	failures    int
+	threshold   int
+	openTimeout time.Duration
+	openedAt    time.Time
+	probing     bool
+}
+
+func NewCircuitBreaker(threshold int, openTimeout time.Duration) *CircuitBreaker {
+	breaker := new(CircuitBreaker)
+	breaker.threshold = threshold
+	breaker.openTimeout = openTimeout
+	breaker.setState(BreakerClosed)
+	return breaker
+}
+
+func (breaker *CircuitBreaker) setState(state BreakerState) {
+	if state == BreakerOpen && breaker.state != BreakerOpen {
+		metrics.Add("accrual_circuit_opened_total", 1)
+	}
+	breaker.state = state
+	s := new(expvar.String)
+	s.Set(state)
+	metrics.Set("accrual_circuit_state", s)
+}
+
+func (breaker *CircuitBreaker) open() {
+	breaker.setState(BreakerOpen)
+	breaker.openedAt = time.Now()
+	breaker.probing = false
+}
+
+// Allow returns ErrCircuitOpen if the call should not be made. Every
+// allowed call must be followed by OnSuccess or OnFailure.
+func (breaker *CircuitBreaker) Allow() error {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	switch breaker.state {
+	case BreakerOpen:
+		retryAt := breaker.openedAt.Add(breaker.openTimeout)
+		if time.Now().Before(retryAt) {
+			return &ErrCircuitOpen{retryAt}
+		}
+		breaker.setState(BreakerHalfOpen)
+		breaker.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if breaker.probing {
+			return &ErrCircuitOpen{time.Now().Add(breaker.openTimeout)}
+		}
+		breaker.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+func (breaker *CircuitBreaker) OnSuccess() {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	breaker.failures = 0
+	breaker.probing = false
+	if breaker.state != BreakerClosed {
+		breaker.setState(BreakerClosed)
+	}
+}
+
+func (breaker *CircuitBreaker) OnFailure() {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	breaker.failures++
+	if breaker.state == BreakerHalfOpen || breaker.failures >= breaker.threshold {
+		breaker.open()
+	}
+}
+
+func (breaker *CircuitBreaker) State() BreakerState {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	return breaker.state
+}
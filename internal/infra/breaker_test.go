@@ -0,0 +1,51 @@
+package infra
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Breaker opens after threshold failures", func(t *testing.T) {
+		breaker := NewCircuitBreaker(2, time.Minute)
+		assert.NoError(t, breaker.Allow())
+		breaker.OnFailure()
+		assert.Equal(t, BreakerClosed, breaker.State())
+		assert.NoError(t, breaker.Allow())
+		breaker.OnFailure()
+		assert.Equal(t, BreakerOpen, breaker.State())
+		assert.IsType(t, &ErrCircuitOpen{}, breaker.Allow())
+	})
+
+	t.Run("Success resets failures", func(t *testing.T) {
+		breaker := NewCircuitBreaker(2, time.Minute)
+		breaker.OnFailure()
+		breaker.OnSuccess()
+		breaker.OnFailure()
+		assert.Equal(t, BreakerClosed, breaker.State())
+	})
+
+	t.Run("Half-open breaker lets a single probe through", func(t *testing.T) {
+		breaker := NewCircuitBreaker(1, 10*time.Millisecond)
+		breaker.OnFailure()
+		assert.Error(t, breaker.Allow())
+
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, breaker.Allow())
+		assert.Equal(t, BreakerHalfOpen, breaker.State())
+		assert.Error(t, breaker.Allow())
+
+		breaker.OnFailure()
+		assert.Equal(t, BreakerOpen, breaker.State())
+
+		time.Sleep(20 * time.Millisecond)
+		assert.NoError(t, breaker.Allow())
+		breaker.OnSuccess()
+		assert.Equal(t, BreakerClosed, breaker.State())
+		assert.NoError(t, breaker.Allow())
+	})
+}
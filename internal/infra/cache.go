@@ -0,0 +1,149 @@
+package infra
+
+import (
+	"sync"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
+)
+
+// keys are reloaded on tokens signed with unknown keys no more often than
+// that, so forged key ids can not flood the database
+const KeyCacheMissInterval = time.Second
+
+// caches are swept of expired entries once they grow that large
+const MaxCacheEntries = 10000
+
+// keyCache holds verification keys, so that tokens are verified without
+// a database round trip. It is refreshed by the key rotation loop, keys
+// created by other replicas in between are loaded on the first token signed
+// with them.
+type keyCache struct {
+	sync.RWMutex
+	store    storage.Storage
+	keys     map[uuid.UUID]core.SigningKey
+	missedAt time.Time
+}
+
+func newKeyCache(store storage.Storage) *keyCache {
+	cache := new(keyCache)
+	cache.store = store
+	return cache
+}
+
+func (cache *keyCache) Keys() (map[uuid.UUID]core.SigningKey, error) {
+	cache.RLock()
+	keys := cache.keys
+	cache.RUnlock()
+
+	if keys != nil {
+		metrics.Add("auth_key_cache_hits", 1)
+		return keys, nil
+	}
+	metrics.Add("auth_key_cache_misses", 1)
+	return cache.Refresh()
+}
+
+func (cache *keyCache) Refresh() (map[uuid.UUID]core.SigningKey, error) {
+	keys, err := cache.store.ExtractAllKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.keys = keys
+	return keys, nil
+}
+
+// Miss reloads the keys after a token signed with an unknown key was seen,
+// nil is returned if they have been reloaded on a miss just before
+func (cache *keyCache) Miss() (map[uuid.UUID]core.SigningKey, error) {
+	now := time.Now()
+
+	cache.Lock()
+	recent := now.Sub(cache.missedAt) < KeyCacheMissInterval
+	if !recent {
+		cache.missedAt = now
+	}
+	cache.Unlock()
+
+	if recent {
+		return nil, nil
+	}
+	metrics.Add("auth_key_cache_misses", 1)
+	return cache.Refresh()
+}
+
+type ttlEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// ttlCache keeps values loaded from the storage for a short time. Entries
+// are invalidated on changes made by this process, changes made by other
+// replicas are seen once entries expire.
+type ttlCache[V any] struct {
+	sync.Mutex
+	name    string
+	ttl     time.Duration
+	entries map[uuid.UUID]ttlEntry[V]
+}
+
+// newTTLCache returns a cache reporting its hits and misses to metrics under
+// name, zero ttl disables caching
+func newTTLCache[V any](name string, ttl time.Duration) *ttlCache[V] {
+	cache := new(ttlCache[V])
+	cache.name = name
+	cache.ttl = ttl
+	cache.entries = make(map[uuid.UUID]ttlEntry[V])
+	return cache
+}
+
+func (cache *ttlCache[V]) Get(id uuid.UUID, load func() (V, error)) (V, error) {
+	if cache.ttl <= 0 {
+		return load()
+	}
+
+	now := time.Now()
+
+	cache.Lock()
+	entry, found := cache.entries[id]
+	cache.Unlock()
+
+	if found && now.Before(entry.expiresAt) {
+		metrics.Add(cache.name+"_cache_hits", 1)
+		return entry.value, nil
+	}
+	metrics.Add(cache.name+"_cache_misses", 1)
+
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if len(cache.entries) >= MaxCacheEntries {
+		for key, entry := range cache.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	if len(cache.entries) < MaxCacheEntries {
+		cache.entries[id] = ttlEntry[V]{value, now.Add(cache.ttl)}
+	}
+	return value, nil
+}
+
+func (cache *ttlCache[V]) Invalidate(id uuid.UUID) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	delete(cache.entries, id)
+}
@@ -0,0 +1,205 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyCache(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := storage.NewMemStorage()
+	cache := newKeyCache(store)
+
+	first, err := core.NewKey(core.EdDSA, core.DefaultKeyPolicy)
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateKey(first)
+	if !assert.NoError(err) {
+		return
+	}
+
+	keys, err := cache.Keys()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(keys, 1)
+	assert.Contains(keys, first.ID)
+
+	// key created elsewhere is not seen until the cache is reloaded
+	second, err := core.NewKey(core.EdDSA, core.DefaultKeyPolicy)
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateKey(second)
+	if !assert.NoError(err) {
+		return
+	}
+
+	keys, err = cache.Keys()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NotContains(keys, second.ID)
+
+	keys, err = cache.Miss()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Contains(keys, second.ID)
+
+	// repeated misses do not reach the storage
+	keys, err = cache.Miss()
+	if assert.NoError(err) {
+		assert.Nil(keys)
+	}
+
+	keys, err = cache.Keys()
+	if assert.NoError(err) {
+		assert.Len(keys, 2)
+	}
+}
+
+func TestTTLCache(t *testing.T) {
+	t.Parallel()
+
+	id := uuid.New()
+
+	type testCase struct {
+		name          string
+		ttl           time.Duration
+		invalidate    bool
+		wait          time.Duration
+		expectedLoads int
+	}
+
+	var testCases = []testCase{
+		{
+			"Disabled cache",
+			0,
+			false,
+			0,
+			2,
+		},
+		{
+			"Cached value",
+			time.Minute,
+			false,
+			0,
+			1,
+		},
+		{
+			"Invalidated value",
+			time.Minute,
+			true,
+			0,
+			2,
+		},
+		{
+			"Expired value",
+			10 * time.Millisecond,
+			false,
+			20 * time.Millisecond,
+			2,
+		},
+	}
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			t.Parallel()
+			assert := assert.New(t)
+
+			cache := newTTLCache[int]("test", tCase.ttl)
+			loads := 0
+			load := func() (int, error) {
+				loads++
+				return loads, nil
+			}
+
+			value, err := cache.Get(id, load)
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(1, value)
+
+			if tCase.invalidate {
+				cache.Invalidate(id)
+			}
+			time.Sleep(tCase.wait)
+
+			value, err = cache.Get(id, load)
+			if assert.NoError(err) {
+				assert.Equal(tCase.expectedLoads, value)
+			}
+			assert.Equal(tCase.expectedLoads, loads)
+		})
+	}
+
+	t.Run("Failed load", func(t *testing.T) {
+		t.Parallel()
+		assert := assert.New(t)
+
+		cache := newTTLCache[int]("test", time.Minute)
+
+		_, err := cache.Get(id, func() (int, error) {
+			return 0, errors.New("unavailable")
+		})
+		assert.Error(err)
+
+		value, err := cache.Get(id, func() (int, error) {
+			return 42, nil
+		})
+		if assert.NoError(err) {
+			assert.Equal(42, value)
+		}
+	})
+}
+
+func TestUserCache(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app := NewApp(storage.NewMemStorage(), WithUserCache(time.Minute))
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+
+	_, authorization := alice(t, app)
+
+	request := func(method string, path string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, path), nil)
+		if !assert.NoError(err) {
+			return 0
+		}
+		req.Header.Set("Authorization", authorization)
+
+		res, err := server.Client().Do(req)
+		if !assert.NoError(err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(http.StatusOK, request(http.MethodGet, "/api/user/balance"))
+	assert.Equal(http.StatusOK, request(http.MethodGet, "/api/user/balance"))
+
+	// session revoked by this process is dropped from the cache right away
+	assert.Equal(http.StatusOK, request(http.MethodPost, "/api/user/logout"))
+	assert.Equal(http.StatusUnauthorized, request(http.MethodGet, "/api/user/balance"))
+}
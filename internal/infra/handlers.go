@@ -2,12 +2,20 @@ package infra
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/devsagul/gophemart/internal/accrual"
 	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/notify"
 	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 )
 
@@ -19,79 +27,722 @@ func (app *App) registerUser(w http.ResponseWriter, r *http.Request) error {
 	}
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+	if data.Login == "" || data.Password == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "login and password are required")
+	}
+
+	var user *core.User
+	err = app.hash(r.Context(), func() error {
+		user, err = core.NewUserWithParams(data.Login, data.Password, app.passwordParams)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = app.store.WithContext(r.Context()).CreateUser(user)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(r.Context(), app.auditLog, core.USER_REGISTERED, user, nil)
+
+	return app.login(r.Context(), user, w)
+}
+
+func (app *App) loginUser(w http.ResponseWriter, r *http.Request) error {
+	var data userLoginRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+	if data.Login == "" || data.Password == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "login and password are required")
+	}
+
+	store := app.store.WithContext(r.Context())
+	ip := clientIP(r)
+	now := time.Now()
+
+	// throttled attempts are rejected before any password is hashed
+	keys := app.loginKeys(data.Login, ip)
+	until, err := app.blockedUntil(store, keys, now)
+	if err != nil {
+		return err
+	}
+	if until.After(now) {
+		metrics.Add("login_throttled_total", 1)
+		return retryLater(http.StatusTooManyRequests, TOO_MANY_ATTEMPTS, until.Sub(now))
+	}
+
+	user, err := store.ExtractUser(data.Login)
+
+	switch err.(type) {
+	case nil:
+	case *storage.ErrUserNotFound:
+		err = app.attemptFailed(r.Context(), store, keys, core.LOGIN_LOCKED, nil, data.Login, now)
+		if err != nil {
+			return err
+		}
+		return newProblem(http.StatusUnauthorized, INVALID_CREDENTIALS, "")
+	default:
+		return err
+	}
+
+	var passwordIsValid, rehashed bool
+	err = app.hash(r.Context(), func() error {
+		passwordIsValid, err = user.ValidatePassword(data.Password)
+		if err != nil || !passwordIsValid {
+			return err
+		}
+
+		// the password is at hand only now, so a hash produced with weaker
+		// parameters is replaced right away
+		rehash, err := user.NeedsRehash(app.passwordParams)
+		if err != nil || !rehash {
+			return err
+		}
+		rehashed = true
+		return user.SetPassword(data.Password, app.passwordParams)
+	})
+	if err != nil {
+		return err
+	}
+
+	if rehashed {
+		err = store.UpdatePasswordHash(user)
+		if err != nil {
+			return err
+		}
+		app.users.Invalidate(user.ID)
+		metrics.Add("password_rehashed_total", 1)
+	}
+
+	if !passwordIsValid {
+		err = app.attemptFailed(r.Context(), store, keys, core.LOGIN_LOCKED, user, data.Login, now)
+		if err != nil {
+			return err
+		}
+		return newProblem(http.StatusUnauthorized, INVALID_CREDENTIALS, "")
+	}
+
+	err = app.attemptSucceeded(store, keys)
+	if err != nil {
+		return err
+	}
+	if user.Disabled {
+		return newProblem(http.StatusForbidden, ACCOUNT_DISABLED, "")
+	}
+
+	twoFactor, err := store.ExtractTwoFactor(user.ID)
+	switch err.(type) {
+	case nil:
+		if twoFactor.Enabled {
+			return app.challenge(r.Context(), user, w)
+		}
+	case *storage.ErrTwoFactorNotFound:
+	default:
+		return err
+	}
+
+	recordAudit(r.Context(), app.auditLog, core.LOGIN_SUCCEEDED, user, nil)
+
+	return app.login(r.Context(), user, w)
+}
+
+func (app *App) loginSecondFactor(w http.ResponseWriter, r *http.Request) error {
+	var data twoFactorLoginRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.ChallengeToken == "" || (data.Code == "" && data.RecoveryCode == "") {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "challenge_token and either code or recovery_code are required")
+	}
+
+	claims, err := app.parseToken(data.ChallengeToken)
+	if err != nil {
+		return err
+	}
+	if claims == nil || claims.Purpose != core.TwoFactorChallenge {
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	}
+
+	store := app.store.WithContext(r.Context())
+
+	user, err := store.ExtractUserByID(claims.UserID)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrUserNotFoundByID:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+	if user.Disabled {
+		return newProblem(http.StatusForbidden, ACCOUNT_DISABLED, "")
+	}
+
+	ip := clientIP(r)
+	now := time.Now()
+
+	// a challenge token may be used for guessing codes until it expires
+	keys := app.twoFactorKeys(user, ip)
+	until, err := app.blockedUntil(store, keys, now)
+	if err != nil {
+		return err
+	}
+	if until.After(now) {
+		metrics.Add("login_throttled_total", 1)
+		return retryLater(http.StatusTooManyRequests, TOO_MANY_ATTEMPTS, until.Sub(now))
+	}
+
+	twoFactor, err := store.ExtractTwoFactor(user.ID)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrTwoFactorNotFound:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+	if !twoFactor.Enabled {
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	}
+
+	valid, err := app.verifySecondFactor(store, twoFactor, data.Code, data.RecoveryCode, now)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		err = app.attemptFailed(r.Context(), store, keys, core.TWO_FACTOR_LOCKED, user, user.Login, now)
+		if err != nil {
+			return err
+		}
+		return newProblem(http.StatusUnauthorized, INVALID_SECOND_FACTOR, "")
+	}
+
+	err = app.attemptSucceeded(store, keys)
+	if err != nil {
+		return err
+	}
+
+	recordAudit(r.Context(), app.auditLog, core.LOGIN_SUCCEEDED, user, map[string]string{"second_factor": "true"})
+
+	return app.login(r.Context(), user, w)
+}
+
+func (app *App) enrollTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	twoFactor, err := core.NewTwoFactor(user, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// enrolling again replaces the pending secret
+	err = app.store.WithContext(r.Context()).CreateTwoFactor(twoFactor)
+	if err != nil {
+		return err
+	}
+
+	type enrollResponse struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+
+	body, err := json.Marshal(enrollResponse{twoFactor.EncodedSecret(), twoFactor.ProvisioningURI(user.Login)})
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) enableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	var data twoFactorEnableRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.Code == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "code is required")
+	}
+
+	store := app.store.WithContext(r.Context())
+	now := time.Now()
+
+	twoFactor, err := store.ExtractTwoFactor(user.ID)
+	if err != nil {
+		return err
+	}
+	if twoFactor.Enabled {
+		return newProblem(http.StatusConflict, TWO_FACTOR_ENABLED, "")
+	}
+
+	// the code proves the authenticator has got the secret right
+	counter, valid := twoFactor.Validate(data.Code, now)
+	if !valid {
+		return newProblem(http.StatusForbidden, INVALID_SECOND_FACTOR, "")
+	}
+
+	codes, hashes, err := core.NewRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	err = store.EnableTwoFactor(user.ID, counter, hashes)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrTOTPCodeReused:
+		return newProblem(http.StatusForbidden, INVALID_SECOND_FACTOR, "the code has been used already")
+	default:
+		return err
+	}
+
+	recordAudit(r.Context(), app.auditLog, core.TWO_FACTOR_ENABLED, user, nil)
+
+	type enableResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	body, err = json.Marshal(enableResponse{codes})
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) disableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	var data twoFactorDisableRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.Password == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "password is required")
+	}
+
+	store := app.store.WithContext(r.Context())
+	ip := clientIP(r)
+	now := time.Now()
+
+	twoFactor, err := store.ExtractTwoFactor(user.ID)
+	if err != nil {
+		return err
+	}
+
+	// a stolen access token alone is not enough to turn the second factor off
+	user, err = store.ExtractUserByID(user.ID)
+	if err != nil {
+		return err
+	}
+	var passwordIsValid bool
+	err = app.hash(r.Context(), func() error {
+		passwordIsValid, err = user.ValidatePassword(data.Password)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !passwordIsValid {
+		return newProblem(http.StatusForbidden, INVALID_CREDENTIALS, "")
+	}
+
+	if twoFactor.Enabled {
+		keys := app.twoFactorKeys(user, ip)
+		until, err := app.blockedUntil(store, keys, now)
+		if err != nil {
+			return err
+		}
+		if until.After(now) {
+			return retryLater(http.StatusTooManyRequests, TOO_MANY_ATTEMPTS, until.Sub(now))
+		}
+
+		valid, err := app.verifySecondFactor(store, twoFactor, data.Code, data.RecoveryCode, now)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			err = app.attemptFailed(r.Context(), store, keys, core.TWO_FACTOR_LOCKED, user, user.Login, now)
+			if err != nil {
+				return err
+			}
+			return newProblem(http.StatusForbidden, INVALID_SECOND_FACTOR, "")
+		}
+	}
+
+	err = store.DisableTwoFactor(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if twoFactor.Enabled {
+		recordAudit(r.Context(), app.auditLog, core.TWO_FACTOR_DISABLED, user, nil)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (app *App) refreshToken(w http.ResponseWriter, r *http.Request) error {
+	var data refreshTokenRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.RefreshToken == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "refresh_token is required")
+	}
+
+	store := app.store.WithContext(r.Context())
+
+	used, err := store.ExtractRefreshToken(core.HashRefreshToken(data.RefreshToken))
+	switch err.(type) {
+	case nil:
+	case *storage.ErrRefreshTokenNotFound:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+
+	session, err := store.ExtractSession(used.SessionID)
+	if err != nil {
+		return err
+	}
+	if session.Revoked() || used.Expired() {
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	}
+
+	user, err := store.ExtractUserByID(session.UserID)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrUserNotFoundByID:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+	if user.Disabled {
+		return newProblem(http.StatusUnauthorized, ACCOUNT_DISABLED, "")
+	}
+
+	token, next, err := core.NewRefreshToken(session, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = store.RotateRefreshToken(used, next)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrRefreshTokenReused:
+		// somebody else holds a copy of the token, neither of the copies
+		// can be trusted anymore
+		log.Printf("Refresh token reuse detected, revoking session %s of user %s", session.ID, user.ID)
+		err = app.revokeSession(r.Context(), session.ID)
+		if err != nil {
+			return err
+		}
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+
+	return app.issueTokens(r.Context(), user, session, token, next, w)
+}
+
+func (app *App) logoutUser(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	sessionID := session(r)
+	if sessionID != uuid.Nil {
+		err := app.revokeSession(r.Context(), sessionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	recordAudit(r.Context(), app.auditLog, core.LOGGED_OUT, user, nil)
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (app *App) changePassword(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
 		return nil
 	}
-	if data.Login == "" || data.Password == "" {
-		w.WriteHeader(http.StatusBadRequest)
+
+	var data passwordChangeRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.OldPassword == "" || data.NewPassword == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "old_password and new_password are required")
+	}
+
+	// the user authenticated with may come from the cache, the password hash
+	// should not
+	user, err = app.store.WithContext(r.Context()).ExtractUserByID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	var passwordIsValid bool
+	err = app.hash(r.Context(), func() error {
+		passwordIsValid, err = user.ValidatePassword(data.OldPassword)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if !passwordIsValid {
+		return newProblem(http.StatusForbidden, INVALID_CREDENTIALS, "")
+	}
+
+	// whoever else is logged in as the user has to log in again
+	err = app.setPassword(r.Context(), user, data.NewPassword, session(r))
+	if err != nil {
+		return err
+	}
+
+	recordAudit(r.Context(), app.auditLog, core.PASSWORD_CHANGED, user, nil)
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (app *App) requestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	var data passwordResetRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.Login == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "login is required")
+	}
+
+	store := app.store.WithContext(r.Context())
+
+	// the response is the same whether the user exists or not, so that
+	// logins can not be enumerated
+	user, err := store.ExtractUser(data.Login)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrUserNotFound:
+		w.WriteHeader(http.StatusAccepted)
 		return nil
+	default:
+		return err
+	}
+
+	token, reset, err := core.NewPasswordResetToken(user, time.Now())
+	if err != nil {
+		return err
 	}
 
-	user, err := core.NewUser(data.Login, data.Password)
+	err = store.CreatePasswordResetToken(reset)
+	if err != nil {
+		return err
+	}
 
+	err = app.notifier.Notify(r.Context(), notify.Message{
+		Kind:      notify.PasswordReset,
+		Recipient: user.Login,
+		Params: map[string]string{
+			"token":      token,
+			"expires_at": reset.ExpiresAt.Format(time.RFC3339),
+		},
+	})
 	if err != nil {
 		return err
 	}
+	metrics.Add("password_resets_requested_total", 1)
 
-	err = app.store.WithContext(r.Context()).CreateUser(user)
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func (app *App) confirmPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	var data passwordResetConfirmRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, &data)
+	if err != nil || data.Token == "" || data.NewPassword == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "token and new_password are required")
+	}
+
+	store := app.store.WithContext(r.Context())
+
+	reset, err := store.ExtractPasswordResetToken(core.HashPasswordResetToken(data.Token))
+	switch err.(type) {
+	case nil:
+	case *storage.ErrPasswordResetTokenNotFound:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+	if reset.Used() || reset.Expired() {
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	}
+
+	user, err := store.ExtractUserByID(reset.UserID)
 	switch err.(type) {
-	case *storage.ErrConflictingUserLogin:
-		w.WriteHeader(http.StatusConflict)
 	case nil:
+	case *storage.ErrUserNotFoundByID:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
 	default:
 		return err
 	}
 
-	err = app.login(user, w)
+	// the token is spent only once the password is hashed, so that the user
+	// may retry if hashing fails
+	err = app.hashPassword(r.Context(), user, data.NewPassword)
 	if err != nil {
 		return err
 	}
+
+	err = store.ResetPassword(reset, user)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrPasswordResetTokenUsed:
+		return newProblem(http.StatusUnauthorized, INVALID_TOKEN, "")
+	default:
+		return err
+	}
+
+	// the account may have been taken over, so nobody stays logged in
+	err = app.passwordChanged(r.Context(), user, uuid.Nil)
+	if err != nil {
+		return err
+	}
+	metrics.Add("password_resets_completed_total", 1)
+
+	recordAudit(r.Context(), app.auditLog, core.PASSWORD_RESET, user, nil)
+
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
 
-func (app *App) loginUser(w http.ResponseWriter, r *http.Request) error {
-	var data userLoginRequest
+func (app *App) createAPIKey(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	var data apiKeyRequest
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return err
 	}
-
 	err = json.Unmarshal(body, &data)
+	if err != nil || data.Name == "" || len(data.Name) > core.MaxAPIKeyName || len(data.Scopes) == 0 {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, fmt.Sprintf("name of at most %d characters and scopes are required", core.MaxAPIKeyName))
+	}
+
+	token, key, err := core.NewAPIKey(user, data.Name, data.Scopes, time.Now())
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+		return err
 	}
-	if data.Login == "" || data.Password == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+
+	err = app.store.WithContext(r.Context()).CreateAPIKey(key)
+	if err != nil {
+		return err
 	}
 
-	user, err := app.store.WithContext(r.Context()).ExtractUser(data.Login)
+	recordAudit(r.Context(), app.auditLog, core.API_KEY_CREATED, user, map[string]string{
+		"api_key": key.ID.String(),
+		"name":    key.Name,
+		"scopes":  strings.Join(key.Scopes, " "),
+	})
 
-	switch err.(type) {
-	case nil:
-	case *storage.ErrUserNotFound:
-		w.WriteHeader(http.StatusUnauthorized)
-		return nil
-	default:
+	// the key itself is shown only once, only its hash is kept
+	type apiKeyResponse struct {
+		*core.APIKey
+		Key string `json:"key"`
+	}
+
+	body, err = json.Marshal(apiKeyResponse{key, token})
+	if err != nil {
 		return err
 	}
+	w.WriteHeader(http.StatusCreated)
+	wrapWrite(w, body)
+	return nil
+}
+
+func (app *App) listAPIKeys(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
 
-	passwordIsValid, err := user.ValidatePassword(data.Password)
+	keys, err := app.store.WithContext(r.Context()).ExtractAPIKeysByUser(user.ID)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	body, err := json.Marshal(keys)
 	if err != nil {
 		return err
 	}
+	w.WriteHeader(http.StatusOK)
+	wrapWrite(w, body)
+	return nil
+}
 
-	if !passwordIsValid {
-		w.WriteHeader(http.StatusUnauthorized)
+func (app *App) revokeAPIKey(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
 		return nil
 	}
 
-	err = app.login(user, w)
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		return newProblem(http.StatusNotFound, NOT_FOUND, "")
+	}
+
+	err = app.store.WithContext(r.Context()).RevokeAPIKey(user.ID, id)
 	if err != nil {
 		return err
 	}
+
+	recordAudit(r.Context(), app.auditLog, core.API_KEY_REVOKED, user, map[string]string{"api_key": id.String()})
+
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
@@ -107,39 +758,33 @@ func (app *App) createOrder(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	if len(body) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "order number is required")
 	}
 
 	orderID := string(body)
 
 	order, err := core.NewOrder(orderID, user, time.Now())
-	switch err.(type) {
-	case *core.ErrInvalidOrder:
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return nil
-	case nil:
-	default:
+	if err != nil {
 		return err
 	}
 
-	err = app.store.WithContext(r.Context()).CreateOrder(order)
+	firstAttemptAt := order.UploadedAt
+	if app.callbackSecret != nil {
+		// give the accrual system a chance to push the status before polling
+		firstAttemptAt = firstAttemptAt.Add(app.callbackWindow)
+	}
+
+	err = app.store.WithContext(r.Context()).CreateOrder(order, firstAttemptAt)
 	switch err.(type) {
 	case *storage.ErrOrderExists:
 		w.WriteHeader(http.StatusOK)
 		return nil
-	case *storage.ErrOrderIDCollission:
-		w.WriteHeader(http.StatusConflict)
-		return nil
 	case nil:
 	default:
 		return err
 	}
 
-	select {
-	case app.accrualStream <- order:
-	default:
-	}
+	recordAudit(r.Context(), app.auditLog, core.ORDER_UPLOADED, user, map[string]string{"order": order.ID})
 
 	w.WriteHeader(http.StatusAccepted)
 	return nil
@@ -151,8 +796,26 @@ func (app *App) listOrders(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	orders, err := app.store.WithContext(r.Context()).ExtractOrdersByUser(user)
+	page, err := parsePage(r, DefaultPageLimit, MaxPageLimit)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, INVALID_QUERY, err.Error())
+	}
+	filter := storage.OrdersPage{Page: page}
+	for _, raw := range r.URL.Query()["status"] {
+		for _, status := range strings.Split(raw, ",") {
+			status = strings.ToUpper(status)
+			switch status {
+			case core.NEW, core.PROCESSING, core.INVALID, core.PROCESSED:
+				filter.Statuses = append(filter.Statuses, status)
+			default:
+				return newProblem(http.StatusBadRequest, INVALID_QUERY, fmt.Sprintf("unknown order status %s", status))
+			}
+		}
+	}
 
+	// one more order tells whether there is the next page
+	filter.Limit++
+	orders, err := app.store.WithContext(r.Context()).ExtractOrdersPage(user, filter)
 	if err != nil {
 		return err
 	}
@@ -161,6 +824,11 @@ func (app *App) listOrders(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusNoContent)
 		return nil
 	}
+	if len(orders) > page.Limit {
+		orders = orders[:page.Limit]
+		last := orders[len(orders)-1]
+		nextCursor(w, core.Cursor{At: last.UploadedAt, ID: last.ID})
+	}
 	body, err := json.Marshal(orders)
 	if err != nil {
 		return err
@@ -169,13 +837,72 @@ func (app *App) listOrders(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// getOrder responds with 404 for orders of other users as well, so the
+// order numbers others uploaded are not disclosed
+func (app *App) getOrder(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	details, err := app.store.WithContext(r.Context()).ExtractOrder(chi.URLParam(r, "number"))
+	if err != nil {
+		return err
+	}
+	if details.Order.UserID != user.ID {
+		return newProblem(http.StatusNotFound, NOT_FOUND, "")
+	}
+
+	type processingResponse struct {
+		Status        core.JobStatus `json:"status"`
+		Attempts      int            `json:"attempts"`
+		Failures      int            `json:"failures"`
+		NextAttemptAt time.Time      `json:"next_attempt_at"`
+	}
+
+	type withdrawalResponse struct {
+		Sum         decimal.Decimal `json:"sum"`
+		ProcessedAt time.Time       `json:"processed_at"`
+	}
+
+	type orderResponse struct {
+		*core.Order
+		Processing *processingResponse `json:"processing,omitempty"`
+		Withdrawal *withdrawalResponse `json:"withdrawal,omitempty"`
+	}
+
+	data := orderResponse{Order: details.Order}
+	if job := details.Job; job != nil {
+		data.Processing = &processingResponse{job.Status, job.Attempts, job.Failures, job.NextAttemptAt}
+	}
+	if withdrawal := details.Withdrawal; withdrawal != nil {
+		data.Withdrawal = &withdrawalResponse{withdrawal.Sum, withdrawal.ProcessedAt}
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
 func (app *App) getBalance(w http.ResponseWriter, r *http.Request) error {
 	user := auth(w, r)
 	if user == nil {
 		return nil
 	}
 
-	witdrawn, err := app.store.WithContext(r.Context()).TotalWithdrawnSum(user)
+	store := app.store.WithContext(r.Context())
+
+	// the user authenticated with may come from the cache, the balance should
+	// not
+	user, err := store.ExtractUserByID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	witdrawn, err := store.TotalWithdrawnSum(user)
 	if err != nil {
 		return err
 	}
@@ -212,24 +939,17 @@ func (app *App) createWithdrawal(w http.ResponseWriter, r *http.Request) error {
 
 	err = json.Unmarshal(body, &data)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
 	}
 
 	if data.Order == "" || data.Sum.LessThanOrEqual(decimal.Zero) {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "order and a positive sum are required")
 	}
 
 	timestamp := time.Now()
 
 	order, err := core.NewOrder(data.Order, user, timestamp)
-	switch err.(type) {
-	case *core.ErrInvalidOrder:
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return nil
-	case nil:
-	default:
+	if err != nil {
 		return err
 	}
 	withdrawal, err := core.NewWithdrawal(order, data.Sum, timestamp)
@@ -242,18 +962,18 @@ func (app *App) createWithdrawal(w http.ResponseWriter, r *http.Request) error {
 	switch err.(type) {
 	case nil:
 	case *storage.ErrOrderExists:
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return nil
+		return newProblem(http.StatusUnprocessableEntity, ORDER_NUMBER_USED, "")
 	case *storage.ErrOrderIDCollission:
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return nil
-	case *storage.ErrBalanceExceeded:
-		w.WriteHeader(http.StatusPaymentRequired)
-		return nil
+		return newProblem(http.StatusUnprocessableEntity, ORDER_NUMBER_USED, "")
 	default:
 		return err
 	}
 
+	recordAudit(r.Context(), app.auditLog, core.WITHDRAWAL_CREATED, user, map[string]string{
+		"order": withdrawal.OrderID,
+		"sum":   withdrawal.Sum.String(),
+	})
+
 	w.WriteHeader(http.StatusOK)
 	return nil
 }
@@ -264,14 +984,36 @@ func (app *App) listWithdrawals(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	withdrawals, err := app.store.WithContext(r.Context()).ExtractWithdrawalsByUser(user)
+	page, err := parsePage(r, DefaultPageLimit, MaxPageLimit)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, INVALID_QUERY, err.Error())
+	}
+	// withdrawals are identified by uuids, the storage would choke on
+	// anything else
+	if page.After != nil {
+		_, err = uuid.Parse(page.After.ID)
+		if err != nil {
+			return newProblem(http.StatusBadRequest, INVALID_QUERY, "cursor does not point at a withdrawal")
+		}
+	}
+
+	// one more withdrawal tells whether there is the next page
+	query := page
+	query.Limit++
+	withdrawals, err := app.store.WithContext(r.Context()).ExtractWithdrawalsPage(user, query)
 	if err != nil {
 		return err
 	}
+
 	if len(withdrawals) == 0 {
 		w.WriteHeader(http.StatusNoContent)
 		return nil
 	}
+	if len(withdrawals) > page.Limit {
+		withdrawals = withdrawals[:page.Limit]
+		last := withdrawals[len(withdrawals)-1]
+		nextCursor(w, core.Cursor{At: last.ProcessedAt, ID: last.ID.String()})
+	}
 	body, err := json.Marshal(withdrawals)
 	if err != nil {
 		return err
@@ -280,3 +1022,166 @@ func (app *App) listWithdrawals(w http.ResponseWriter, r *http.Request) error {
 	wrapWrite(w, body)
 	return nil
 }
+
+func (app *App) getBalanceHistory(w http.ResponseWriter, r *http.Request) error {
+	user := auth(w, r)
+	if user == nil {
+		return nil
+	}
+
+	limit, offset, err := parsePagination(r, DefaultHistoryLimit, MaxHistoryLimit)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, INVALID_QUERY, err.Error())
+	}
+
+	entries, err := app.store.WithContext(r.Context()).ExtractLedgerEntries(user, limit, offset)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	wrapWrite(w, body)
+	return nil
+}
+
+// health is served without authentication, so that it keeps working while
+// the database is unavailable
+func (app *App) health(w http.ResponseWriter, r *http.Request) {
+	type healthResponse struct {
+		Status   string `json:"status"`
+		Database string `json:"database"`
+		Accrual  string `json:"accrual,omitempty"`
+	}
+
+	data := healthResponse{
+		Status:   "ok",
+		Database: "ok",
+	}
+	code := http.StatusOK
+
+	err := app.store.Ping(r.Context())
+	if err != nil {
+		log.Printf("Health check of the database failed: %v", err)
+		data.Status = "unavailable"
+		data.Database = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+
+	if app.breaker != nil {
+		data.Accrual = app.breaker.State()
+		if data.Accrual != BreakerClosed && code == http.StatusOK {
+			data.Status = "degraded"
+		}
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Could not marshal health response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(code)
+	wrapWrite(w, body)
+}
+
+func (app *App) accrualCallback(w http.ResponseWriter, r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	err = accrual.VerifySignature(
+		app.callbackSecret,
+		r.Header.Get(accrual.SignatureHeader),
+		r.Header.Get(accrual.TimestampHeader),
+		body,
+		time.Now(),
+	)
+	if err != nil {
+		log.Printf("Rejected accrual callback: %v", err)
+		return newProblem(http.StatusUnauthorized, INVALID_SIGNATURE, "")
+	}
+
+	var data accrual.Response
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+	switch data.Status {
+	case accrual.REGISTERED, accrual.PROCESSING, accrual.INVALID, accrual.PROCESSED:
+	default:
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, fmt.Sprintf("unknown order status %s", data.Status))
+	}
+	if data.Order == "" {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "order is required")
+	}
+	err = data.Validate()
+	if err != nil {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+
+	store := app.store.WithContext(r.Context())
+	terminal := data.Status == accrual.PROCESSED || data.Status == accrual.INVALID
+
+	err = store.ProcessAccrual(data.Order, data.Status, data.Accrual)
+	switch err.(type) {
+	case *storage.ErrOrderAlreadyProcessed:
+		// accrual system retries callbacks until it gets 200, so repeated
+		// and late ones are acknowledged without crediting anything
+		metrics.Add("accrual_callbacks_duplicate_total", 1)
+		terminal = true
+	case nil:
+		auditAccrual(r.Context(), app.auditLog, data.Order, &data, "callback")
+	default:
+		return err
+	}
+	metrics.Add("accrual_callbacks_total", 1)
+
+	if terminal {
+		err = store.SettleJob(data.Order)
+	} else {
+		err = store.DeferJob(data.Order, time.Now().Add(app.callbackWindow))
+	}
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// jwks publishes public keys tokens may be verified with, so that other
+// services do not need to share any secret with us
+func (app *App) jwks(w http.ResponseWriter, r *http.Request) {
+	keys, err := app.store.WithContext(r.Context()).ExtractAllKeys()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	data := core.JWKS{Keys: []core.JWK{}}
+	for _, key := range keys {
+		key := key
+		jwk := key.PublicJWK()
+		if jwk != nil {
+			data.Keys = append(data.Keys, *jwk)
+		}
+	}
+	sort.Slice(data.Keys, func(i, j int) bool {
+		return data.Keys[i].KeyID < data.Keys[j].KeyID
+	})
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	wrapWrite(w, body)
+}
@@ -2,170 +2,584 @@ package infra
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"runtime"
 	"strings"
 	"time"
 
+	"github.com/devsagul/gophemart/internal/audit"
 	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/notify"
 	"github.com/devsagul/gophemart/internal/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
-	"golang.org/x/sync/errgroup"
 )
 
 func init() {
 	decimal.MarshalJSONWithoutQuotes = true
 }
 
-const NumKeysHydrated = 3
+const DefaultHistoryLimit = 50
+const MaxHistoryLimit = 500
+
+const DefaultPageLimit = 100
+const MaxPageLimit = 1000
+
+// listings which have more records than fit the page point at the next one
+// with this header
+const NextCursorHeader = "X-Next-Cursor"
 
 type Handler func(http.ResponseWriter, *http.Request) error
 
 type App struct {
-	store         storage.Storage
-	Router        *chi.Mux
-	accrualStream chan<- *core.Order
+	store           storage.Storage
+	Router          *chi.Mux
+	breaker         *CircuitBreaker
+	callbackSecret  []byte
+	callbackWindow  time.Duration
+	algorithm       string
+	keyPolicy       core.KeyPolicy
+	rotator         *KeyRotator
+	keys            *keyCache
+	userCacheTTL    time.Duration
+	users           *ttlCache[*core.User]
+	sessions        *ttlCache[*core.Session]
+	notifier        notify.Notifier
+	loginThrottle   core.ThrottlePolicy
+	addressThrottle core.ThrottlePolicy
+	hashing         chan struct{}
+	hashTimeout     time.Duration
+	passwordParams  core.PasswordParams
+	auditLog        *audit.Log
+}
+
+type Option func(*App)
+
+func WithAccrualBreaker(breaker *CircuitBreaker) Option {
+	return func(app *App) {
+		app.breaker = breaker
+	}
+}
+
+// WithAccrualCallback enables the endpoint the accrual system pushes order
+// statuses to. Orders are polled only if nothing was pushed for them during
+// window.
+func WithAccrualCallback(secret string, window time.Duration) Option {
+	return func(app *App) {
+		app.callbackSecret = []byte(secret)
+		app.callbackWindow = window
+	}
+}
+
+// WithSigningAlgorithm sets the algorithm new tokens are signed with. Tokens
+// signed with keys of other algorithms are still accepted until they expire.
+func WithSigningAlgorithm(algorithm string) Option {
+	return func(app *App) {
+		app.algorithm = algorithm
+	}
+}
+
+func WithKeyPolicy(policy core.KeyPolicy) Option {
+	return func(app *App) {
+		app.keyPolicy = policy
+	}
+}
+
+// WithUserCache keeps users and sessions authenticated requests are made
+// with for ttl, so that most requests do not hit the database before the
+// handler runs. Changes made by other replicas, such as revoked sessions,
+// are seen only once the entries expire.
+func WithUserCache(ttl time.Duration) Option {
+	return func(app *App) {
+		app.userCacheTTL = ttl
+	}
+}
+
+// WithNotifier enables password reset, reset tokens are delivered to users
+// through notifier
+func WithNotifier(notifier notify.Notifier) Option {
+	return func(app *App) {
+		app.notifier = notifier
+	}
+}
+
+// WithLoginThrottle sets policies failed logins are throttled with, both per
+// login and per client address
+func WithLoginThrottle(login core.ThrottlePolicy, address core.ThrottlePolicy) Option {
+	return func(app *App) {
+		app.loginThrottle = login
+		app.addressThrottle = address
+	}
+}
+
+// WithHashConcurrency caps the number of password hashes computed at once,
+// requests waiting for their turn longer than timeout are rejected
+func WithHashConcurrency(n int, timeout time.Duration) Option {
+	return func(app *App) {
+		app.hashing = make(chan struct{}, n)
+		app.hashTimeout = timeout
+	}
+}
+
+// WithPasswordParams sets parameters new password hashes are produced with,
+// hashes produced with weaker ones are replaced as users log in
+func WithPasswordParams(params core.PasswordParams) Option {
+	return func(app *App) {
+		app.passwordParams = params
+	}
 }
 
 type userKey string
 
 const UserKey = userKey("user")
+const SessionKey = userKey("session")
+const APIKeyKey = userKey("api_key")
+
+// last use of API keys is recorded no more often than that, so that scripts
+// polling the API do not write to the database on every request
+const APIKeyTouchInterval = time.Minute
+
+// identity is who the request is made by, either a session or an API key
+type identity struct {
+	user      *core.User
+	sessionID uuid.UUID
+	apiKey    *core.APIKey
+}
 
+// newHandler wraps handlers of routes API keys are not accepted on
 func (app *App) newHandler(h Handler) http.HandlerFunc {
+	return app.newScopedHandler("", h)
+}
+
+// newScopedHandler wraps handlers of routes API keys granted scope are
+// accepted on, requests made with keys not granted it are forbidden
+func (app *App) newScopedHandler(scope core.Scope, h Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		errChan := make(chan error)
 		ctx := r.Context()
 
 		go func() {
-			user, err := app.authenticate(r)
+			ctx := audit.WithSource(ctx, audit.Source{
+				RequestID: middleware.GetReqID(ctx),
+				IP:        clientIP(r),
+			})
+			id, err := app.authenticate(r)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if id.apiKey != nil {
+				if scope == "" {
+					id = identity{}
+				} else if !id.apiKey.Allows(scope) {
+					errChan <- newProblem(http.StatusForbidden, INSUFFICIENT_SCOPE, fmt.Sprintf("the API key is not granted %s", scope))
+					return
+				}
+			}
+			if id.user != nil {
+				ctx = audit.WithActor(ctx, id.user.ID)
+			}
+			ctx = context.WithValue(ctx, UserKey, id.user)
+			ctx = context.WithValue(ctx, SessionKey, id.sessionID)
+			ctx = context.WithValue(ctx, APIKeyKey, id.apiKey)
+			r := r.WithContext(ctx)
+			err = app.validateRequest(r)
 			if err != nil {
 				errChan <- err
 				return
 			}
-			r := r.WithContext(context.WithValue(ctx, UserKey, user))
 			errChan <- h(w, r)
 		}()
 
 		select {
 		case err := <-errChan:
 			if err != nil {
-				log.Printf("Unhandled error: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				wrapWrite(w, []byte("{\"status\": \"error\", \"message\": \"Internal server error\"}"))
+				writeError(w, r, err)
 			}
 		case <-ctx.Done():
 		}
 	}
 }
 
-func (app *App) authenticate(r *http.Request) (*core.User, error) {
-	var user *core.User = nil
+func (app *App) authenticate(r *http.Request) (identity, error) {
 	header := r.Header.Get("Authorization")
 
 	var token string
 	_, err := fmt.Fscanf(strings.NewReader(header), "Bearer %s", &token)
 	if err != nil {
-		return nil, nil
+		return identity{}, nil
 	}
 
-	keys, err := app.store.ExtractAllKeys()
+	if core.IsAPIKey(token) {
+		return app.authenticateAPIKey(r.Context(), token)
+	}
 
+	claims, err := app.parseToken(token)
 	if err != nil {
-		return nil, err
+		return identity{}, err
 	}
+	// challenge tokens and such are never accepted in place of access tokens
+	if claims == nil || claims.Purpose != "" {
+		return identity{}, nil
+	}
+
+	if claims.SessionID != uuid.Nil {
+		session, err := app.sessions.Get(claims.SessionID, func() (*core.Session, error) {
+			return app.store.ExtractSession(claims.SessionID)
+		})
+		switch err.(type) {
+		case nil:
+		case *storage.ErrSessionNotFound:
+			return identity{}, nil
+		default:
+			return identity{}, err
+		}
+		if session.Revoked() {
+			return identity{}, nil
+		}
+	}
+
+	user, err := app.extractUser(claims.UserID)
+	if err != nil || user == nil {
+		return identity{}, err
+	}
+
+	return identity{user: user, sessionID: claims.SessionID}, nil
+}
 
-	userID, err := core.ParseToken(token, keys)
+// authenticateAPIKey looks the key up by its hash, keys are not cached so
+// that revoked ones are rejected right away by every replica
+func (app *App) authenticateAPIKey(ctx context.Context, token string) (identity, error) {
+	store := app.store.WithContext(ctx)
 
+	key, err := store.ExtractAPIKey(core.HashAPIKey(token))
 	switch err.(type) {
 	case nil:
-	case *jwt.ValidationError:
-		return nil, nil
-	case *core.ErrExpiredToken:
+	case *storage.ErrAPIKeyNotFound:
+		return identity{}, nil
+	default:
+		return identity{}, err
+	}
+
+	user, err := app.extractUser(key.UserID)
+	if err != nil || user == nil {
+		return identity{}, err
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= APIKeyTouchInterval {
+		err = store.TouchAPIKey(key.ID, now)
+		if err != nil {
+			return identity{}, err
+		}
+		key.LastUsedAt = &now
+	}
+	metrics.Add("api_key_requests_total", 1)
+
+	return identity{user: user, apiKey: key}, nil
+}
+
+// extractUser returns the user requests are authenticated as, nil if they
+// do not exist anymore or are disabled
+func (app *App) extractUser(id uuid.UUID) (*core.User, error) {
+	user, err := app.users.Get(id, func() (*core.User, error) {
+		return app.store.ExtractUserByID(id)
+	})
+
+	switch err.(type) {
+	case nil:
+	case *storage.ErrKeyNotFound:
 		return nil, nil
-	case *core.ErrUnexpectedSigningMethod:
+	case *storage.ErrUserNotFoundByID:
 		return nil, nil
 	default:
 		return nil, err
 	}
+	if user.Disabled {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// parseToken returns claims of a valid token, nil if the token is invalid
+func (app *App) parseToken(token string) (*core.JwtClaims, error) {
+	keys, err := app.keys.Keys()
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := core.ParseToken(token, keys)
 
-	user, err = app.store.ExtractUserByID(userID)
+	var unknown *core.ErrUnknownKey
+	if errors.As(err, &unknown) {
+		// the key may have been created by another replica since the last
+		// rotation
+		keys, err = app.keys.Miss()
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			return nil, nil
+		}
+		claims, err = core.ParseToken(token, keys)
+	}
 
 	switch err.(type) {
 	case nil:
-	case *storage.ErrKeyNotFound:
+	case *jwt.ValidationError:
 		return nil, nil
-	case *storage.ErrUserNotFoundByID:
+	case *core.ErrExpiredToken:
+		return nil, nil
+	case *core.ErrUnexpectedSigningMethod:
 		return nil, nil
 	default:
 		return nil, err
 	}
 
-	return user, nil
+	return claims, nil
 }
 
+// HydrateKeys makes sure there are keys to sign tokens with, it should be
+// called periodically to rotate them. Cached verification keys are replaced
+// with the rotated ones.
 func (app *App) HydrateKeys() error {
-	_, err := app.store.ExtractRandomKey()
-	switch err.(type) {
-	case *storage.ErrNoKeys:
-		eg := errgroup.Group{}
-
-		for i := 0; i <= NumKeysHydrated; i++ {
-			eg.Go(func() error {
-				key, err := core.NewKey()
-				if err != nil {
-					return err
-				}
-				return app.store.CreateKey(key)
-			})
+	err := app.rotator.Rotate()
+	if err != nil {
+		return err
+	}
+
+	_, err = app.keys.Refresh()
+	return err
+}
+
+// revokeSession revokes the session and drops it from the cache, so that
+// its access tokens are rejected right away
+func (app *App) revokeSession(ctx context.Context, id uuid.UUID) error {
+	err := app.store.WithContext(ctx).RevokeSession(id)
+	if err != nil {
+		return err
+	}
+
+	app.sessions.Invalidate(id)
+	return nil
+}
+
+// setPassword persists the new password of user and revokes all of their
+// sessions but the one to keep. If no session is kept, API keys of the user
+// are revoked too.
+func (app *App) setPassword(ctx context.Context, user *core.User, password string, keep uuid.UUID) error {
+	err := app.hashPassword(ctx, user, password)
+	if err != nil {
+		return err
+	}
+
+	err = app.store.WithContext(ctx).UpdatePasswordHash(user)
+	if err != nil {
+		return err
+	}
+	return app.passwordChanged(ctx, user, keep)
+}
+
+func (app *App) hashPassword(ctx context.Context, user *core.User, password string) error {
+	return app.hash(ctx, func() error {
+		return user.SetPassword(password, app.passwordParams)
+	})
+}
+
+// passwordChanged revokes credentials of user issued with the previous
+// password, which has been persisted already
+func (app *App) passwordChanged(ctx context.Context, user *core.User, keep uuid.UUID) error {
+	app.users.Invalidate(user.ID)
+
+	store := app.store.WithContext(ctx)
+	revoked, err := store.RevokeUserSessions(user.ID, keep)
+	if err != nil {
+		return err
+	}
+	for _, id := range revoked {
+		app.sessions.Invalidate(id)
+	}
+
+	if keep == uuid.Nil {
+		// keys are not cached, so they are rejected right away
+		_, err = store.RevokeUserAPIKeys(user.ID)
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		return eg.Wait()
-	default:
+// login starts a new session for user and responds with its tokens
+func (app *App) login(ctx context.Context, user *core.User, w http.ResponseWriter) error {
+	now := time.Now()
+	session, err := core.NewSession(user, now)
+	if err != nil {
+		return err
+	}
+
+	token, refreshToken, err := core.NewRefreshToken(session, now)
+	if err != nil {
+		return err
+	}
+
+	err = app.store.WithContext(ctx).CreateSession(session, refreshToken)
+	if err != nil {
 		return err
 	}
+
+	return app.issueTokens(ctx, user, session, token, refreshToken, w)
 }
 
-func (app *App) login(user *core.User, w http.ResponseWriter) error {
-	key, err := app.store.ExtractRandomKey()
+// challenge responds with a token to complete the login with by entering
+// the second factor, no access token is issued yet
+func (app *App) challenge(ctx context.Context, user *core.User, w http.ResponseWriter) error {
+	key, err := app.store.WithContext(ctx).ExtractRandomKey(app.algorithm)
 	if err != nil {
 		return err
 	}
 
-	token, err := core.GenerateToken(user, key)
+	expiresAt := time.Now().Add(core.ChallengePeriod)
+	token, err := core.GenerateChallengeToken(user, key, expiresAt)
 	if err != nil {
 		return err
 	}
 
-	header := fmt.Sprintf("Bearer %s", token)
+	type challengeResponse struct {
+		ChallengeToken string    `json:"challenge_token"`
+		ExpiresAt      time.Time `json:"expires_at"`
+	}
+
+	body, err := json.Marshal(challengeResponse{token, expiresAt})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	wrapWrite(w, body)
+	return nil
+}
+
+// issueTokens responds with a new access token for the session and the
+// refresh token to obtain the next one with
+func (app *App) issueTokens(ctx context.Context, user *core.User, session *core.Session, token string, refreshToken *core.RefreshToken, w http.ResponseWriter) error {
+	key, err := app.store.WithContext(ctx).ExtractRandomKey(app.algorithm)
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := core.GenerateToken(user, session, key)
+	if err != nil {
+		return err
+	}
+
+	type tokenResponse struct {
+		AccessToken           string    `json:"access_token"`
+		RefreshToken          string    `json:"refresh_token"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
+	}
+
+	body, err := json.Marshal(tokenResponse{accessToken, token, refreshToken.ExpiresAt})
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("Bearer %s", accessToken)
 	w.Header().Set("Authorization", header)
+	w.WriteHeader(http.StatusOK)
+	wrapWrite(w, body)
 	return nil
 }
 
-func NewApp(store storage.Storage, accrualStream chan<- *core.Order) *App {
+func NewApp(store storage.Storage, opts ...Option) *App {
 	app := new(App)
-	app.accrualStream = accrualStream
 	app.store = store
+	app.algorithm = core.EdDSA
+	app.keyPolicy = core.DefaultKeyPolicy
+	app.loginThrottle = core.DefaultLoginThrottle
+	app.addressThrottle = core.DefaultAddressThrottle
+	app.hashing = make(chan struct{}, runtime.NumCPU())
+	app.hashTimeout = DefaultHashQueueTimeout
+	app.passwordParams = core.DefaultPasswordParams
+	for _, opt := range opts {
+		opt(app)
+	}
+	app.rotator = NewKeyRotator(store, app.algorithm, app.keyPolicy)
+	app.keys = newKeyCache(store)
+	app.auditLog = audit.NewLog(store)
+	app.users = newTTLCache[*core.User]("auth_user", app.userCacheTTL)
+	app.sessions = newTTLCache[*core.Session]("auth_session", app.userCacheTTL)
 	r := chi.NewRouter()
 	app.Router = r
 
 	r.Use(middleware.Timeout(60 * time.Second))
 	r.Use(middleware.SetHeader("Content-Type", "application/json"))
 	r.Use(middleware.RequestID)
+	r.Use(countResponses)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Compress(5))
 
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, newProblem(http.StatusNotFound, NOT_FOUND, ""))
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, newProblem(http.StatusMethodNotAllowed, METHOD_NOT_ALLOWED, ""))
+	})
+
+	r.Get("/api/health", app.health)
+	r.Get("/api/metrics", serveMetrics)
+	r.Get("/api/openapi.json", serveOpenAPI)
+	r.Get("/.well-known/jwks.json", app.jwks)
+
 	r.Post("/api/user/register", app.newHandler(app.registerUser))
 	r.Post("/api/user/login", app.newHandler(app.loginUser))
-	r.Post("/api/user/orders", app.newHandler(app.createOrder))
-	r.Get("/api/user/orders", app.newHandler(app.listOrders))
-	r.Get("/api/user/balance", app.newHandler(app.getBalance))
-	r.Post("/api/user/balance/withdraw", app.newHandler(app.createWithdrawal))
-	r.Get("/api/user/withdrawals", app.newHandler(app.listWithdrawals))
+	r.Post("/api/user/token/refresh", app.newHandler(app.refreshToken))
+	r.Post("/api/user/logout", app.newHandler(app.logoutUser))
+	r.Post("/api/user/login/2fa", app.newHandler(app.loginSecondFactor))
+	r.Post("/api/user/password", app.newHandler(app.changePassword))
+	r.Post("/api/user/2fa/enroll", app.newHandler(app.enrollTwoFactor))
+	r.Post("/api/user/2fa/enable", app.newHandler(app.enableTwoFactor))
+	r.Post("/api/user/2fa/disable", app.newHandler(app.disableTwoFactor))
+	r.Post("/api/user/api-keys", app.newHandler(app.createAPIKey))
+	r.Get("/api/user/api-keys", app.newHandler(app.listAPIKeys))
+	r.Delete("/api/user/api-keys/{id}", app.newHandler(app.revokeAPIKey))
+	r.Post("/api/user/orders", app.newScopedHandler(core.ORDERS_WRITE, app.idempotent(app.createOrder)))
+	r.Get("/api/user/orders", app.newScopedHandler(core.ORDERS_READ, app.listOrders))
+	r.Get("/api/user/orders/{number}", app.newScopedHandler(core.ORDERS_READ, app.getOrder))
+	r.Get("/api/user/balance", app.newScopedHandler(core.BALANCE_READ, app.getBalance))
+	r.Post("/api/user/balance/withdraw", app.newScopedHandler(core.WITHDRAWALS_WRITE, app.idempotent(app.createWithdrawal)))
+	r.Get("/api/user/balance/withdrawals", app.newScopedHandler(core.WITHDRAWALS_READ, app.listWithdrawals))
+	// deprecated, the route the specification documents is the one above
+	r.Get("/api/user/withdrawals", app.newScopedHandler(core.WITHDRAWALS_READ, app.listWithdrawals))
+	r.Get("/api/user/balance/history", app.newScopedHandler(core.BALANCE_READ, app.getBalanceHistory))
+
+	r.Get("/api/admin/users", app.newHandler(app.requireRole(core.ROLE_SUPPORT, app.adminFindUser)))
+	r.Get("/api/admin/users/{id}", app.newHandler(app.requireRole(core.ROLE_SUPPORT, app.adminGetUser)))
+	r.Get("/api/admin/users/{id}/orders", app.newHandler(app.requireRole(core.ROLE_SUPPORT, app.adminListOrders)))
+	r.Get("/api/admin/users/{id}/withdrawals", app.newHandler(app.requireRole(core.ROLE_SUPPORT, app.adminListWithdrawals)))
+	r.Get("/api/admin/users/{id}/balance", app.newHandler(app.requireRole(core.ROLE_SUPPORT, app.adminGetBalance)))
+	r.Post("/api/admin/users/{id}/adjustments", app.newHandler(app.requireRole(core.ROLE_ADMIN, app.adminAdjustBalance)))
+	r.Post("/api/admin/users/{id}/disable", app.newHandler(app.requireRole(core.ROLE_ADMIN, app.adminDisableUser)))
+	r.Post("/api/admin/users/{id}/enable", app.newHandler(app.requireRole(core.ROLE_ADMIN, app.adminEnableUser)))
+	r.Get("/api/admin/audit", app.newHandler(app.requireRole(core.ROLE_ADMIN, app.adminListAuditEvents)))
+	r.Post("/api/admin/orders/{number}/requeue", app.newHandler(app.requireRole(core.ROLE_ADMIN, app.adminRequeueAccrual)))
+
+	if app.notifier != nil {
+		r.Post("/api/user/password/reset", app.newHandler(app.requestPasswordReset))
+		r.Post("/api/user/password/reset/confirm", app.newHandler(app.confirmPasswordReset))
+	}
+
+	if app.callbackSecret != nil {
+		r.Post("/internal/accrual/callback", app.newHandler(app.accrualCallback))
+	}
 
 	return app
 }
@@ -1,17 +1,27 @@
 package infra
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/devsagul/gophemart/internal/accrual"
 	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/notify"
 	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
@@ -23,7 +33,7 @@ func app(t *testing.T) (*App, *httptest.Server) {
 
 	store := storage.NewMemStorage()
 
-	app := NewApp(store, make(chan<- *core.Order, 255))
+	app := NewApp(store)
 
 	server := httptest.NewServer(app.Router)
 	err := app.HydrateKeys()
@@ -33,31 +43,49 @@ func app(t *testing.T) (*App, *httptest.Server) {
 	return app, server
 }
 
-func alice(t *testing.T, app *App) (*core.User, string) {
+func authorize(t *testing.T, app *App, user *core.User) string {
 	assert := assert.New(t)
 
-	alice, err := core.NewUser("alice", "correct-horse")
+	session, err := core.NewSession(user, time.Now())
 	if !assert.NoError(err) {
-		assert.FailNow("could not create alice")
+		assert.FailNow("could not create session")
 	}
-	alice.Balance = decimal.New(1337, -2)
-	err = app.store.CreateUser(alice)
+	_, refreshToken, err := core.NewRefreshToken(session, time.Now())
 	if !assert.NoError(err) {
-		assert.FailNow("could not persist alice")
+		assert.FailNow("could not create refresh token")
+	}
+	err = app.store.CreateSession(session, refreshToken)
+	if !assert.NoError(err) {
+		assert.FailNow("could not persist session")
 	}
 
-	key, err := app.store.ExtractRandomKey()
+	key, err := app.store.ExtractRandomKey(app.algorithm)
 	if !assert.NoError(err) {
 		assert.FailNow("could not extract hmac key")
 	}
 
-	tokenAlice, err := core.GenerateToken(alice, key)
+	token, err := core.GenerateToken(user, session, key)
+	if !assert.NoError(err) {
+		assert.FailNow("could not generate token")
+	}
+
+	return fmt.Sprintf("Bearer %s", token)
+}
+
+func alice(t *testing.T, app *App) (*core.User, string) {
+	assert := assert.New(t)
+
+	alice, err := core.NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		assert.FailNow("could not create alice")
+	}
+	alice.Balance = decimal.New(1337, -2)
+	err = app.store.CreateUser(alice)
 	if !assert.NoError(err) {
-		assert.FailNow("could not generate token for alice")
+		assert.FailNow("could not persist alice")
 	}
 
-	authorizationHeaderAlice := fmt.Sprintf("Bearer %s", tokenAlice)
-	return alice, authorizationHeaderAlice
+	return alice, authorize(t, app, alice)
 }
 
 func bob(t *testing.T, app *App) (*core.User, string) {
@@ -73,18 +101,7 @@ func bob(t *testing.T, app *App) (*core.User, string) {
 		assert.FailNow("could not persist bob")
 	}
 
-	key, err := app.store.ExtractRandomKey()
-	if !assert.NoError(err) {
-		assert.FailNow("could not extract hmac key")
-	}
-
-	tokenBob, err := core.GenerateToken(bob, key)
-	if !assert.NoError(err) {
-		assert.FailNow("could not generate token for bob")
-	}
-
-	authorizationHeaderBob := fmt.Sprintf("Bearer %s", tokenBob)
-	return bob, authorizationHeaderBob
+	return bob, authorize(t, app, bob)
 }
 
 // tests
@@ -452,7 +469,7 @@ func TestListOrders(t *testing.T) {
 		return
 	}
 
-	err = app.store.CreateOrder(order)
+	err = app.store.CreateOrder(order, order.UploadedAt)
 
 	if !assert.NoError(t, err) {
 		return
@@ -475,7 +492,7 @@ func TestListOrders(t *testing.T) {
 		return
 	}
 
-	err = app.store.CreateOrder(order)
+	err = app.store.CreateOrder(order, order.UploadedAt)
 	if !assert.NoError(t, err) {
 		return
 	}
@@ -544,6 +561,154 @@ func TestListOrders(t *testing.T) {
 
 }
 
+func TestGetOrder(t *testing.T) {
+	t.Parallel()
+
+	app, server := app(t)
+
+	defer server.Close()
+
+	_, authorizationHeaderAlice := alice(t, app)
+	bob, authorizationHeaderBob := bob(t, app)
+
+	secondsEastOfUTC := int((3 * time.Hour).Seconds())
+	moscow := time.FixedZone("Moscow Time", secondsEastOfUTC)
+
+	createdAt := time.Date(
+		2022,
+		time.August,
+		8,
+		21,
+		40,
+		0,
+		0,
+		moscow,
+	)
+
+	order, err := core.NewOrder("12345678903", bob, createdAt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = app.store.CreateOrder(order, order.UploadedAt)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	order, err = core.NewOrder("4561261212345467", bob, createdAt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = app.store.CreateOrder(order, order.UploadedAt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	accrual := decimal.New(500, 0)
+	err = app.store.ProcessAccrual(order.ID, core.PROCESSED, &accrual)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = app.store.SettleJob(order.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	order, err = core.NewOrder("79927398713", bob, createdAt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	withdrawal, err := core.NewWithdrawal(order, decimal.New(42, 0), createdAt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = app.store.CreateWithdrawal(withdrawal, order)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	client := http.Client{}
+
+	type testCase struct {
+		name         string
+		number       string
+		auth         string
+		expectedCode int
+		expectedBody string
+	}
+
+	var testCases = []testCase{
+		{
+			"Get order unauthorized",
+			"12345678903",
+			"",
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Get order being processed",
+			"12345678903",
+			authorizationHeaderBob,
+			http.StatusOK,
+			"{\"number\": \"12345678903\", \"status\": \"NEW\", \"uploaded_at\": \"2022-08-08T21:40:00+03:00\", \"processing\": {\"status\": \"PENDING\", \"attempts\": 0, \"failures\": 0, \"next_attempt_at\": \"2022-08-08T21:40:00+03:00\"}}",
+		},
+		{
+			"Get processed order",
+			"4561261212345467",
+			authorizationHeaderBob,
+			http.StatusOK,
+			"{\"number\": \"4561261212345467\", \"status\": \"PROCESSED\", \"uploaded_at\": \"2022-08-08T21:40:00+03:00\", \"accrual\": 500}",
+		},
+		{
+			"Get order withdrawn against",
+			"79927398713",
+			authorizationHeaderBob,
+			http.StatusOK,
+			"{\"number\": \"79927398713\", \"status\": \"NEW\", \"uploaded_at\": \"2022-08-08T21:40:00+03:00\", \"withdrawal\": {\"sum\": 42, \"processed_at\": \"2022-08-08T21:40:00+03:00\"}}",
+		},
+		{
+			"Get order of another user",
+			"12345678903",
+			authorizationHeaderAlice,
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"Get unknown order",
+			"49927398716",
+			authorizationHeaderBob,
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/orders/%s", server.URL, tCase.number), nil)
+			if !assert.NoError(err) {
+				return
+			}
+
+			req.Header.Set("Authorization", tCase.auth)
+
+			res, err := client.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(tCase.expectedCode, res.StatusCode)
+			if tCase.expectedBody != "" {
+				bodyJSON, err := ioutil.ReadAll(res.Body)
+				if !assert.NoError(err) {
+					return
+				}
+				assert.JSONEq(tCase.expectedBody, string(bodyJSON))
+			}
+		})
+	}
+}
+
 func TestGetBalance(t *testing.T) {
 	t.Parallel()
 
@@ -1009,3 +1174,2272 @@ func TestListWithdrawal(t *testing.T) {
 		})
 	}
 }
+
+func TestBalanceHistory(t *testing.T) {
+	t.Parallel()
+
+	const endpoint = "/api/user/balance/history"
+	const method = http.MethodGet
+
+	app, server := app(t)
+
+	defer server.Close()
+	url := fmt.Sprintf("%s%s", server.URL, endpoint)
+
+	alice, authorizationHeaderAlice := alice(t, app)
+	bob, authorizationHeaderBob := bob(t, app)
+
+	order, err := core.NewOrder("4561261212345467", bob, time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	withdrawal, err := core.NewWithdrawal(order, decimal.New(25, -1), time.Now())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	err = app.store.CreateWithdrawal(withdrawal, order)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	client := http.Client{}
+
+	type entry struct {
+		Type   string          `json:"type"`
+		Debit  string          `json:"debit"`
+		Credit string          `json:"credit"`
+		Amount decimal.Decimal `json:"amount"`
+		Order  string          `json:"order"`
+	}
+
+	type testCase struct {
+		name            string
+		auth            string
+		query           string
+		expectedCode    int
+		expectedEntries []entry
+	}
+
+	var testCases = []testCase{
+		{
+			"Get history unauthorized",
+			"",
+			"",
+			http.StatusUnauthorized,
+			nil,
+		},
+		{
+			"Get history with invalid limit",
+			authorizationHeaderAlice,
+			"?limit=-1",
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"Get history with opening balance",
+			authorizationHeaderAlice,
+			"",
+			http.StatusOK,
+			[]entry{
+				{core.OPENING, core.AdjustmentAccount, core.UserAccount(alice.ID), decimal.New(1337, -2), ""},
+			},
+		},
+		{
+			"Get history with withdrawals",
+			authorizationHeaderBob,
+			"",
+			http.StatusOK,
+			[]entry{
+				{core.WITHDRAWAL, core.UserAccount(bob.ID), core.WithdrawalAccount, decimal.New(25, -1), "4561261212345467"},
+				{core.OPENING, core.AdjustmentAccount, core.UserAccount(bob.ID), decimal.New(420, 0), ""},
+			},
+		},
+		{
+			"Get second page of history",
+			authorizationHeaderBob,
+			"?limit=1&offset=1",
+			http.StatusOK,
+			[]entry{
+				{core.OPENING, core.AdjustmentAccount, core.UserAccount(bob.ID), decimal.New(420, 0), ""},
+			},
+		},
+		{
+			"Get history past the last page",
+			authorizationHeaderBob,
+			"?offset=2",
+			http.StatusNoContent,
+			nil,
+		},
+	}
+
+	for _, tCase := range testCases {
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, err := http.NewRequest(method, url+tCase.query, nil)
+			if !assert.NoError(err) {
+				return
+			}
+
+			req.Header.Set("Authorization", tCase.auth)
+
+			res, err := client.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(tCase.expectedCode, res.StatusCode)
+			if tCase.expectedEntries != nil {
+				var entries []entry
+				err = json.NewDecoder(res.Body).Decode(&entries)
+				if !assert.NoError(err) {
+					return
+				}
+				if !assert.Len(entries, len(tCase.expectedEntries)) {
+					return
+				}
+				for i, expected := range tCase.expectedEntries {
+					actual := entries[i]
+					assert.Equal(expected.Type, actual.Type)
+					assert.Equal(expected.Debit, actual.Debit)
+					assert.Equal(expected.Credit, actual.Credit)
+					assert.True(expected.Amount.Equal(actual.Amount))
+					assert.Equal(expected.Order, actual.Order)
+				}
+			}
+		})
+	}
+
+	mismatches, err := app.store.ExtractBalanceMismatches()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	store := storage.NewMemStorage()
+	breaker := NewCircuitBreaker(1, time.Minute)
+	app := NewApp(store, WithAccrualBreaker(breaker))
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+
+	url := fmt.Sprintf("%s%s", server.URL, "/api/health")
+
+	type testCase struct {
+		name         string
+		prepare      func()
+		expectedBody string
+	}
+
+	var testCases = []testCase{
+		{
+			"Healthy application",
+			func() {},
+			"{\"status\": \"ok\", \"database\": \"ok\", \"accrual\": \"closed\"}",
+		},
+		{
+			"Accrual system is down",
+			breaker.OnFailure,
+			"{\"status\": \"degraded\", \"database\": \"ok\", \"accrual\": \"open\"}",
+		},
+	}
+
+	for _, tCase := range testCases {
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			tCase.prepare()
+
+			res, err := http.Get(url)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(http.StatusOK, res.StatusCode)
+			body, err := ioutil.ReadAll(res.Body)
+			if !assert.NoError(err) {
+				return
+			}
+			assert.JSONEq(tCase.expectedBody, string(body))
+		})
+	}
+}
+
+func TestAccrualCallback(t *testing.T) {
+	t.Parallel()
+
+	const endpoint = "/internal/accrual/callback"
+	const method = http.MethodPost
+	const secret = "sikret"
+
+	store := storage.NewMemStorage()
+	app := NewApp(store, WithAccrualCallback(secret, time.Hour))
+	err := app.HydrateKeys()
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	url := fmt.Sprintf("%s%s", server.URL, endpoint)
+
+	alice, authorizationAlice := alice(t, app)
+
+	for _, orderID := range []string{"4561261212345467", "79927398713"} {
+		order, err := core.NewOrder(orderID, alice, time.Now())
+		if !assert.NoError(t, err) {
+			return
+		}
+		err = store.CreateOrder(order, order.UploadedAt)
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	client := http.Client{}
+
+	type testCase struct {
+		name            string
+		body            string
+		secret          string
+		expectedCode    int
+		expectedBalance decimal.Decimal
+	}
+
+	var testCases = []testCase{
+		{
+			"Push status with wrong signature",
+			"{\"order\": \"4561261212345467\", \"status\": \"PROCESSED\", \"accrual\": 500}",
+			"other",
+			http.StatusUnauthorized,
+			decimal.New(1337, -2),
+		},
+		{
+			"Push invalid status",
+			"{\"order\": \"4561261212345467\", \"status\": \"DONE\"}",
+			secret,
+			http.StatusBadRequest,
+			decimal.New(1337, -2),
+		},
+		{
+			"Push negative accrual",
+			"{\"order\": \"79927398713\", \"status\": \"PROCESSED\", \"accrual\": -500}",
+			secret,
+			http.StatusBadRequest,
+			decimal.New(1337, -2),
+		},
+		{
+			"Push status of unknown order",
+			"{\"order\": \"12345678903\", \"status\": \"PROCESSED\", \"accrual\": 500}",
+			secret,
+			http.StatusNotFound,
+			decimal.New(1337, -2),
+		},
+		{
+			"Push intermediate status",
+			"{\"order\": \"4561261212345467\", \"status\": \"PROCESSING\"}",
+			secret,
+			http.StatusOK,
+			decimal.New(1337, -2),
+		},
+		{
+			"Push final status",
+			"{\"order\": \"4561261212345467\", \"status\": \"PROCESSED\", \"accrual\": 500}",
+			secret,
+			http.StatusOK,
+			decimal.New(51337, -2),
+		},
+		{
+			"Push final status again",
+			"{\"order\": \"4561261212345467\", \"status\": \"PROCESSED\", \"accrual\": 500}",
+			secret,
+			http.StatusOK,
+			decimal.New(51337, -2),
+		},
+		{
+			"Push intermediate status after final one",
+			"{\"order\": \"4561261212345467\", \"status\": \"PROCESSING\"}",
+			secret,
+			http.StatusOK,
+			decimal.New(51337, -2),
+		},
+	}
+
+	for _, tCase := range testCases {
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			body := []byte(tCase.body)
+			req, err := http.NewRequest(method, url, strings.NewReader(tCase.body))
+			if !assert.NoError(err) {
+				return
+			}
+			accrual.SignRequest(req, []byte(tCase.secret), time.Now(), body)
+
+			res, err := client.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(tCase.expectedCode, res.StatusCode)
+
+			user, err := store.ExtractUserByID(alice.ID)
+			if assert.NoError(err) {
+				assert.True(tCase.expectedBalance.Equal(user.Balance), "balance is %s", user.Balance)
+			}
+		})
+	}
+
+	// the processed order is settled, the other one is still polled
+	jobs, err := store.LeaseJobs("test-worker", 10, JobLeasePeriod)
+	assert.NoError(t, err)
+	if assert.Len(t, jobs, 1) {
+		assert.Equal(t, "79927398713", jobs[0].OrderID)
+	}
+	assert.IsType(t, &storage.ErrJobNotFound{}, store.RequeueJob("4561261212345467"))
+
+	// uploaded orders are not polled before the accrual system had a chance
+	// to push their statuses
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/user/orders", server.URL), strings.NewReader("2377225624"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Set("Authorization", authorizationAlice)
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+	details, err := store.ExtractOrder("2377225624")
+	if assert.NoError(t, err) && assert.NotNil(t, details.Job) {
+		assert.True(t, details.Job.NextAttemptAt.After(time.Now().Add(59*time.Minute)))
+	}
+
+	mismatches, err := store.ExtractBalanceMismatches()
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	_, server := app(t)
+	defer server.Close()
+
+	client := http.Client{}
+
+	type tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	post := func(endpoint string, authorization string, body string) (int, string, tokenResponse) {
+		var tokens tokenResponse
+
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusOK && endpoint != "/api/user/logout" {
+			err = json.NewDecoder(res.Body).Decode(&tokens)
+			assert.NoError(err)
+		}
+		return res.StatusCode, res.Header.Get("Authorization"), tokens
+	}
+
+	authorized := func(authorization string) bool {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/balance", server.URL), nil)
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}
+
+	refresh := func(token string) string {
+		return fmt.Sprintf("{\"refresh_token\": \"%s\"}", token)
+	}
+
+	code, authorization, first := post("/api/user/register", "", "{\"login\": \"alice\", \"password\": \"sikret\"}")
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	assert.Equal(fmt.Sprintf("Bearer %s", first.AccessToken), authorization)
+	assert.NotEmpty(first.RefreshToken)
+	assert.True(authorized(authorization))
+
+	code, _, _ = post("/api/user/token/refresh", "", "{}")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _, _ = post("/api/user/token/refresh", "", refresh("forged"))
+	assert.Equal(http.StatusUnauthorized, code)
+
+	code, authorization, second := post("/api/user/token/refresh", "", refresh(first.RefreshToken))
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	assert.NotEqual(first.RefreshToken, second.RefreshToken)
+	assert.True(authorized(authorization))
+
+	// replaying the used token revokes the whole family
+	code, _, _ = post("/api/user/token/refresh", "", refresh(first.RefreshToken))
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _, _ = post("/api/user/token/refresh", "", refresh(second.RefreshToken))
+	assert.Equal(http.StatusUnauthorized, code)
+	assert.False(authorized(authorization))
+
+	code, authorization, third := post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"sikret\"}")
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	assert.True(authorized(authorization))
+
+	code, _, _ = post("/api/user/logout", "", "")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _, _ = post("/api/user/logout", authorization, "")
+	assert.Equal(http.StatusOK, code)
+	assert.False(authorized(authorization))
+	code, _, _ = post("/api/user/token/refresh", "", refresh(third.RefreshToken))
+	assert.Equal(http.StatusUnauthorized, code)
+}
+
+func TestJWKS(t *testing.T) {
+	t.Parallel()
+
+	const endpoint = "/.well-known/jwks.json"
+
+	type testCase struct {
+		name         string
+		algorithm    string
+		expectedKeys int
+	}
+
+	var testCases = []testCase{
+		{
+			"Publish ed25519 keys",
+			core.EdDSA,
+			core.DefaultKeyPolicy.Keys,
+		},
+		{
+			"Keep HMAC keys secret",
+			core.HS256,
+			0,
+		},
+	}
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			app := NewApp(storage.NewMemStorage(), WithSigningAlgorithm(tCase.algorithm))
+			err := app.HydrateKeys()
+			if !assert.NoError(err) {
+				return
+			}
+			server := httptest.NewServer(app.Router)
+			defer server.Close()
+
+			alice, err := core.NewUser("alice", "correct-horse")
+			if !assert.NoError(err) {
+				return
+			}
+			err = app.store.CreateUser(alice)
+			if !assert.NoError(err) {
+				return
+			}
+			authorization := authorize(t, app, alice)
+
+			res, err := http.Get(fmt.Sprintf("%s%s", server.URL, endpoint))
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+			if !assert.Equal(http.StatusOK, res.StatusCode) {
+				return
+			}
+
+			var jwks core.JWKS
+			err = json.NewDecoder(res.Body).Decode(&jwks)
+			if !assert.NoError(err) {
+				return
+			}
+			if !assert.Len(jwks.Keys, tCase.expectedKeys) || tCase.expectedKeys == 0 {
+				return
+			}
+
+			// a partner service verifies the token with published keys only
+			token := strings.TrimPrefix(authorization, "Bearer ")
+			_, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+				for _, jwk := range jwks.Keys {
+					if jwk.KeyID == token.Header["kid"] {
+						x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+						return ed25519.PublicKey(x), err
+					}
+				}
+				return nil, fmt.Errorf("unknown key")
+			})
+			assert.NoError(err)
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, authorization := alice(t, app)
+	other := authorize(t, app, alice)
+
+	client := http.Client{}
+
+	post := func(endpoint string, authorization string, body string) int {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	type testCase struct {
+		name          string
+		authorization string
+		body          string
+		expectedCode  int
+	}
+
+	var testCases = []testCase{
+		{
+			"Unauthorized",
+			"",
+			"{\"old_password\": \"correct-horse\", \"new_password\": \"battery-staple\"}",
+			http.StatusUnauthorized,
+		},
+		{
+			"Malformed request",
+			authorization,
+			"{\"old_password\": \"correct-horse\"}",
+			http.StatusBadRequest,
+		},
+		{
+			"Wrong old password",
+			authorization,
+			"{\"old_password\": \"wrong-horse\", \"new_password\": \"battery-staple\"}",
+			http.StatusForbidden,
+		},
+		{
+			"Password changed",
+			authorization,
+			"{\"old_password\": \"correct-horse\", \"new_password\": \"battery-staple\"}",
+			http.StatusOK,
+		},
+	}
+
+	for _, tCase := range testCases {
+		assert.Equal(tCase.expectedCode, post("/api/user/password", tCase.authorization, tCase.body), tCase.name)
+	}
+
+	// other sessions are revoked, the current one is kept
+	assert.Equal(http.StatusOK, post("/api/user/logout", authorization, ""))
+	assert.Equal(http.StatusUnauthorized, post("/api/user/logout", other, ""))
+
+	assert.Equal(http.StatusUnauthorized, post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"correct-horse\"}"))
+	assert.Equal(http.StatusOK, post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"battery-staple\"}"))
+}
+
+func TestPasswordReset(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	// reset is not available without a notifier
+	_, plain := app(t)
+	defer plain.Close()
+	res, err := http.Post(fmt.Sprintf("%s/api/user/password/reset", plain.URL), "application/json", strings.NewReader("{\"login\": \"alice\"}"))
+	if assert.NoError(err) {
+		res.Body.Close()
+		assert.Equal(http.StatusNotFound, res.StatusCode)
+	}
+
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+	app := NewApp(storage.NewMemStorage(), WithNotifier(notify.NewFileNotifier(path)), WithHashConcurrency(1, 10*time.Millisecond))
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	err = app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	user, authorization := alice(t, app)
+	apiKey, key, err := core.NewAPIKey(user, "script", []core.Scope{core.WITHDRAWALS_WRITE}, time.Now())
+	if !assert.NoError(err) || !assert.NoError(app.store.CreateAPIKey(key)) {
+		return
+	}
+
+	client := http.Client{}
+
+	post := func(endpoint string, authorization string, body string) int {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	confirm := func(token string, password string) string {
+		return fmt.Sprintf("{\"token\": \"%s\", \"new_password\": \"%s\"}", token, password)
+	}
+
+	assert.Equal(http.StatusBadRequest, post("/api/user/password/reset", "", "{}"))
+	assert.Equal(http.StatusAccepted, post("/api/user/password/reset", "", "{\"login\": \"mallory\"}"))
+	assert.Equal(http.StatusAccepted, post("/api/user/password/reset", "", "{\"login\": \"alice\"}"))
+
+	// nothing is sent for unknown users
+	messages, err := notify.ReadFile(path)
+	if !assert.NoError(err) || !assert.Len(messages, 1) {
+		return
+	}
+	assert.Equal(notify.PasswordReset, messages[0].Kind)
+	assert.Equal("alice", messages[0].Recipient)
+	token := messages[0].Params["token"]
+	assert.NotEmpty(token)
+
+	assert.Equal(http.StatusBadRequest, post("/api/user/password/reset/confirm", "", confirm(token, "")))
+	assert.Equal(http.StatusUnauthorized, post("/api/user/password/reset/confirm", "", confirm("forged", "battery-staple")))
+
+	// the token is kept while the new password cannot be hashed
+	app.hashing <- struct{}{}
+	assert.Equal(http.StatusServiceUnavailable, post("/api/user/password/reset/confirm", "", confirm(token, "battery-staple")))
+	<-app.hashing
+
+	assert.Equal(http.StatusOK, post("/api/user/password/reset/confirm", "", confirm(token, "battery-staple")))
+
+	// token is single use and every session is revoked
+	assert.Equal(http.StatusUnauthorized, post("/api/user/password/reset/confirm", "", confirm(token, "another-staple")))
+	assert.Equal(http.StatusUnauthorized, post("/api/user/logout", authorization, ""))
+	// and so is every API key
+	assert.Equal(http.StatusUnauthorized, post("/api/user/balance/withdraw", "Bearer "+apiKey, "{\"order\": \"2377225624\", \"sum\": 1}"))
+	keys, err := app.store.ExtractAPIKeysByUser(user.ID)
+	if assert.NoError(err) {
+		assert.Empty(keys)
+	}
+
+	assert.Equal(http.StatusUnauthorized, post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"correct-horse\"}"))
+	assert.Equal(http.StatusOK, post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"battery-staple\"}"))
+
+	// expired tokens are rejected
+	user, err = app.store.ExtractUser("alice")
+	if !assert.NoError(err) {
+		return
+	}
+	expired, reset, err := core.NewPasswordResetToken(user, time.Now().Add(-core.PasswordResetPeriod-time.Second))
+	if !assert.NoError(err) {
+		return
+	}
+	err = app.store.CreatePasswordResetToken(reset)
+	if assert.NoError(err) {
+		assert.Equal(http.StatusUnauthorized, post("/api/user/password/reset/confirm", "", confirm(expired, "another-staple")))
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	login := core.ThrottlePolicy{
+		FreeAttempts:  1,
+		BaseDelay:     time.Minute,
+		MaxDelay:      time.Minute,
+		Lockout:       3,
+		LockoutPeriod: time.Hour,
+		Window:        time.Hour,
+	}
+	address := login
+	address.FreeAttempts = 5
+	address.Lockout = 6
+
+	app := NewApp(storage.NewMemStorage(), WithLoginThrottle(login, address))
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	alice(t, app)
+	bob(t, app)
+
+	client := http.Client{}
+
+	post := func(login string, password string) (int, string) {
+		body := fmt.Sprintf("{\"login\": \"%s\", \"password\": \"%s\"}", login, password)
+		res, err := client.Post(fmt.Sprintf("%s/api/user/login", server.URL), "application/json", strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res.StatusCode, res.Header.Get("Retry-After")
+	}
+
+	// free attempt, then attempts are delayed even with the right password
+	code, _ := post("alice", "wrong-horse")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = post("alice", "wrong-horse")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, retryAfter := post("alice", "correct-horse")
+	assert.Equal(http.StatusTooManyRequests, code)
+	assert.Equal("60", retryAfter)
+
+	// successful login forgets failures of the user
+	code, _ = post("bob", "wrong-horse")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = post("bob", "sikret")
+	assert.Equal(http.StatusOK, code)
+	attempts, err := app.store.ExtractLoginAttempts(core.LoginKey("bob"))
+	if assert.NoError(err) {
+		assert.Equal(0, attempts.Failures)
+	}
+
+	// unknown users count as well, the sixth failure from the address locks
+	// it out for everybody
+	for _, login := range []string{"mallory", "eve", "trent"} {
+		code, _ = post(login, "guess")
+		assert.Equal(http.StatusUnauthorized, code)
+	}
+	code, retryAfter = post("bob", "sikret")
+	assert.Equal(http.StatusTooManyRequests, code)
+	assert.Equal("3600", retryAfter)
+}
+
+func TestRepeatedLockout(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	login := core.ThrottlePolicy{
+		FreeAttempts:  1,
+		BaseDelay:     time.Minute,
+		MaxDelay:      time.Minute,
+		Lockout:       3,
+		LockoutPeriod: time.Hour,
+		Window:        2 * time.Hour,
+	}
+	address := login
+	address.FreeAttempts = 50
+	address.Lockout = 100
+
+	app := NewApp(storage.NewMemStorage(), WithLoginThrottle(login, address))
+	keys := app.loginKeys("mallory", "127.0.0.1")
+	now := time.Now()
+
+	for i := 0; i < login.Lockout; i++ {
+		err := app.attemptFailed(context.Background(), app.store, keys, core.LOGIN_LOCKED, nil, "mallory", now)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	// the first lockout has passed, the next failure locks the login out again
+	err := app.attemptFailed(context.Background(), app.store, keys, core.LOGIN_LOCKED, nil, "mallory", now.Add(login.LockoutPeriod+time.Minute))
+	if !assert.NoError(err) {
+		return
+	}
+
+	events, err := app.store.ExtractAuditEvents(storage.AuditFilter{Types: []core.AuditEventType{core.LOGIN_LOCKED}})
+	if assert.NoError(err) {
+		assert.Len(events, 2)
+	}
+}
+
+func TestLoginThrottleWithoutAudit(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	login := core.ThrottlePolicy{
+		FreeAttempts:  1,
+		BaseDelay:     time.Nanosecond,
+		MaxDelay:      time.Nanosecond,
+		Lockout:       3,
+		LockoutPeriod: time.Hour,
+		Window:        time.Hour,
+	}
+	address := login
+	address.FreeAttempts = 50
+	address.Lockout = 100
+
+	app := NewApp(&auditlessStore{storage.NewMemStorage()}, WithLoginThrottle(login, address))
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	alice(t, app)
+
+	post := func(password string) int {
+		body := fmt.Sprintf("{\"login\": \"alice\", \"password\": \"%s\"}", password)
+		res, err := http.Post(fmt.Sprintf("%s/api/user/login", server.URL), "application/json", strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// failures are counted under every key although none of them is audited
+	for i := 0; i < login.Lockout; i++ {
+		assert.Equal(http.StatusUnauthorized, post("wrong-horse"))
+	}
+	assert.Equal(http.StatusTooManyRequests, post("correct-horse"))
+
+	attempts, err := app.store.ExtractLoginAttempts(core.AddressKey("127.0.0.1"))
+	if assert.NoError(err) {
+		assert.Equal(login.Lockout, attempts.Failures)
+	}
+}
+
+func TestHashConcurrency(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app := NewApp(storage.NewMemStorage(), WithHashConcurrency(1, 10*time.Millisecond))
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	alice(t, app)
+
+	login := func() int {
+		body := "{\"login\": \"alice\", \"password\": \"correct-horse\"}"
+		res, err := http.Post(fmt.Sprintf("%s/api/user/login", server.URL), "application/json", strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// the only slot is taken
+	app.hashing <- struct{}{}
+	assert.Equal(http.StatusServiceUnavailable, login())
+
+	<-app.hashing
+	assert.Equal(http.StatusOK, login())
+}
+
+func TestPasswordRehash(t *testing.T) {
+	t.Parallel()
+
+	weak := core.PasswordParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	strong := core.PasswordParams{Memory: 128, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+	type testCase struct {
+		name       string
+		hashed     core.PasswordParams
+		configured core.PasswordParams
+		rehashed   bool
+	}
+
+	var testCases = []testCase{
+		{
+			"Hash produced with weaker parameters",
+			weak,
+			strong,
+			true,
+		},
+		{
+			"Hash produced with stronger parameters",
+			strong,
+			weak,
+			false,
+		},
+		{
+			"Hash produced with the same parameters",
+			strong,
+			strong,
+			false,
+		},
+	}
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			t.Parallel()
+			assert := assert.New(t)
+
+			app := NewApp(storage.NewMemStorage(), WithPasswordParams(tCase.configured))
+			server := httptest.NewServer(app.Router)
+			defer server.Close()
+			err := app.HydrateKeys()
+			if !assert.NoError(err) {
+				return
+			}
+
+			user, err := core.NewUserWithParams("alice", "correct-horse", tCase.hashed)
+			if !assert.NoError(err) {
+				return
+			}
+			err = app.store.CreateUser(user)
+			if !assert.NoError(err) {
+				return
+			}
+
+			login := func() int {
+				body := "{\"login\": \"alice\", \"password\": \"correct-horse\"}"
+				res, err := http.Post(fmt.Sprintf("%s/api/user/login", server.URL), "application/json", strings.NewReader(body))
+				if !assert.NoError(err) {
+					assert.FailNow("could not send request")
+				}
+				res.Body.Close()
+				return res.StatusCode
+			}
+
+			assert.Equal(http.StatusOK, login())
+
+			stored, err := app.store.ExtractUser("alice")
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(tCase.rehashed, stored.PasswordHash != user.PasswordHash)
+			rehash, err := stored.NeedsRehash(tCase.configured)
+			if assert.NoError(err) {
+				assert.False(rehash)
+			}
+
+			// the new hash is accepted as well
+			assert.Equal(http.StatusOK, login())
+		})
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, authorization := alice(t, app)
+
+	client := http.Client{}
+
+	post := func(endpoint string, authorization string, body string, data interface{}) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+
+		if data != nil && res.StatusCode < http.StatusMultipleChoices {
+			err = json.NewDecoder(res.Body).Decode(data)
+			assert.NoError(err)
+		}
+		return res.StatusCode, res.Header.Get("Authorization")
+	}
+
+	type challengeResponse struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+
+	login := func() string {
+		var challenge challengeResponse
+		code, authorization := post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"correct-horse\"}", &challenge)
+		assert.Equal(http.StatusAccepted, code)
+		assert.Empty(authorization)
+		assert.NotEmpty(challenge.ChallengeToken)
+		return challenge.ChallengeToken
+	}
+
+	secondFactor := func(token string, field string, value string) string {
+		return fmt.Sprintf("{\"challenge_token\": \"%s\", \"%s\": \"%s\"}", token, field, value)
+	}
+
+	// enrollment
+	var enrollment struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	code, _ := post("/api/user/2fa/enroll", "", "", nil)
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = post("/api/user/2fa/enable", authorization, "{\"code\": \"123456\"}", nil)
+	assert.Equal(http.StatusNotFound, code)
+	code, _ = post("/api/user/2fa/enroll", authorization, "", &enrollment)
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	assert.NotEmpty(enrollment.Secret)
+	assert.Contains(enrollment.ProvisioningURI, enrollment.Secret)
+
+	twoFactor, err := app.store.ExtractTwoFactor(alice.ID)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(enrollment.Secret, twoFactor.EncodedSecret())
+
+	// password alone is enough until the enrollment is confirmed
+	code, _ = post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"correct-horse\"}", nil)
+	assert.Equal(http.StatusOK, code)
+
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	now := time.Now()
+	code, _ = post("/api/user/2fa/enable", authorization, "{\"code\": \"000000\"}", nil)
+	if twoFactor.Code(now) != "000000" {
+		assert.Equal(http.StatusForbidden, code)
+	}
+	code, _ = post("/api/user/2fa/enable", authorization, fmt.Sprintf("{\"code\": \"%s\"}", twoFactor.Code(now)), &enabled)
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	assert.Len(enabled.RecoveryCodes, core.RecoveryCodes)
+	code, _ = post("/api/user/2fa/enroll", authorization, "", nil)
+	assert.Equal(http.StatusConflict, code)
+
+	// login takes two steps now
+	challenge := login()
+	code, _ = post("/api/user/2fa/enroll", fmt.Sprintf("Bearer %s", challenge), "", nil)
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = post("/api/user/login/2fa", "", secondFactor("forged", "code", twoFactor.Code(now)), nil)
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = post("/api/user/login/2fa", "", secondFactor(challenge, "code", twoFactor.Code(now)), nil)
+	assert.Equal(http.StatusUnauthorized, code, "code used to enable is not accepted again")
+
+	code, access := post("/api/user/login/2fa", "", secondFactor(challenge, "code", twoFactor.Code(now.Add(core.TOTPPeriod))), nil)
+	assert.Equal(http.StatusOK, code)
+	assert.NotEmpty(access)
+
+	// recovery codes are single use
+	code, access = post("/api/user/login/2fa", "", secondFactor(login(), "recovery_code", strings.ToUpper(enabled.RecoveryCodes[0])), nil)
+	assert.Equal(http.StatusOK, code)
+	assert.NotEmpty(access)
+	code, _ = post("/api/user/login/2fa", "", secondFactor(login(), "recovery_code", enabled.RecoveryCodes[0]), nil)
+	assert.Equal(http.StatusUnauthorized, code)
+
+	// disabling takes the password and the second factor
+	code, _ = post("/api/user/2fa/disable", access, "{\"password\": \"wrong-horse\", \"recovery_code\": \""+enabled.RecoveryCodes[1]+"\"}", nil)
+	assert.Equal(http.StatusForbidden, code)
+	code, _ = post("/api/user/2fa/disable", access, "{\"password\": \"correct-horse\"}", nil)
+	assert.Equal(http.StatusForbidden, code)
+	code, _ = post("/api/user/2fa/disable", access, "{\"password\": \"correct-horse\", \"recovery_code\": \""+enabled.RecoveryCodes[1]+"\"}", nil)
+	assert.Equal(http.StatusOK, code)
+
+	code, _ = post("/api/user/login", "", "{\"login\": \"alice\", \"password\": \"correct-horse\"}", nil)
+	assert.Equal(http.StatusOK, code)
+	code, _ = post("/api/user/2fa/disable", access, "{\"password\": \"correct-horse\"}", nil)
+	assert.Equal(http.StatusNotFound, code)
+}
+
+func TestAPIKeys(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	_, authorization := alice(t, app)
+	_, other := bob(t, app)
+
+	client := http.Client{}
+
+	request := func(method string, endpoint string, authorization string, body string) (int, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return res.StatusCode, data
+	}
+
+	type testCase struct {
+		name          string
+		authorization string
+		body          string
+		expectedCode  int
+	}
+
+	var testCases = []testCase{
+		{
+			"Unauthorized",
+			"",
+			"{\"name\": \"shop\", \"scopes\": [\"orders:write\"]}",
+			http.StatusUnauthorized,
+		},
+		{
+			"No name",
+			authorization,
+			"{\"scopes\": [\"orders:write\"]}",
+			http.StatusBadRequest,
+		},
+		{
+			"No scopes",
+			authorization,
+			"{\"name\": \"shop\"}",
+			http.StatusBadRequest,
+		},
+		{
+			"Unknown scope",
+			authorization,
+			"{\"name\": \"shop\", \"scopes\": [\"admin\"]}",
+			http.StatusBadRequest,
+		},
+	}
+
+	for _, tCase := range testCases {
+		code, _ := request(http.MethodPost, "/api/user/api-keys", tCase.authorization, tCase.body)
+		assert.Equal(tCase.expectedCode, code, tCase.name)
+	}
+
+	code, _ := request(http.MethodGet, "/api/user/api-keys", authorization, "")
+	assert.Equal(http.StatusNoContent, code)
+
+	code, body := request(http.MethodPost, "/api/user/api-keys", authorization, "{\"name\": \"shop\", \"scopes\": [\"orders:write\", \"orders:read\"]}")
+	if !assert.Equal(http.StatusCreated, code) {
+		return
+	}
+	var created struct {
+		ID     uuid.UUID `json:"id"`
+		Key    string    `json:"key"`
+		Hint   string    `json:"hint"`
+		Scopes []string  `json:"scopes"`
+	}
+	err := json.Unmarshal(body, &created)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(strings.HasPrefix(created.Key, core.APIKeyPrefix))
+	assert.ElementsMatch([]string{core.ORDERS_WRITE, core.ORDERS_READ}, created.Scopes)
+	key := fmt.Sprintf("Bearer %s", created.Key)
+
+	// the key works on routes within its scopes only
+	code, _ = request(http.MethodPost, "/api/user/orders", key, "12345678903")
+	assert.Equal(http.StatusAccepted, code)
+	code, _ = request(http.MethodGet, "/api/user/orders", key, "")
+	assert.Equal(http.StatusOK, code)
+	code, _ = request(http.MethodGet, "/api/user/balance", key, "")
+	assert.Equal(http.StatusForbidden, code)
+	code, _ = request(http.MethodGet, "/api/user/api-keys", key, "")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = request(http.MethodPost, "/api/user/password", key, "{\"old_password\": \"correct-horse\", \"new_password\": \"battery-staple\"}")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = request(http.MethodGet, "/api/user/orders", "Bearer gm_forged", "")
+	assert.Equal(http.StatusUnauthorized, code)
+
+	// keys are listed with their hints and last use, never the key itself
+	code, body = request(http.MethodGet, "/api/user/api-keys", authorization, "")
+	if assert.Equal(http.StatusOK, code) {
+		var keys []map[string]interface{}
+		err = json.Unmarshal(body, &keys)
+		if assert.NoError(err) && assert.Len(keys, 1) {
+			assert.Equal(created.Hint, keys[0]["hint"])
+			assert.NotNil(keys[0]["last_used_at"])
+			assert.NotContains(keys[0], "key")
+			assert.NotContains(keys[0], "hash")
+		}
+	}
+	assert.NotContains(string(body), created.Key)
+
+	// keys of other users can not be revoked
+	endpoint := fmt.Sprintf("/api/user/api-keys/%s", created.ID)
+	code, _ = request(http.MethodDelete, endpoint, other, "")
+	assert.Equal(http.StatusNotFound, code)
+	code, _ = request(http.MethodDelete, "/api/user/api-keys/not-an-id", authorization, "")
+	assert.Equal(http.StatusNotFound, code)
+
+	code, _ = request(http.MethodDelete, endpoint, authorization, "")
+	assert.Equal(http.StatusOK, code)
+	code, _ = request(http.MethodDelete, endpoint, authorization, "")
+	assert.Equal(http.StatusNotFound, code)
+	code, _ = request(http.MethodGet, "/api/user/orders", key, "")
+	assert.Equal(http.StatusUnauthorized, code)
+}
+
+func TestAdmin(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, admin := alice(t, app)
+	bob, user := bob(t, app)
+
+	carol, err := core.NewUser("carol", "hunter2")
+	if !assert.NoError(err) {
+		return
+	}
+	err = app.store.CreateUser(carol)
+	if !assert.NoError(err) {
+		return
+	}
+	support := authorize(t, app, carol)
+
+	assert.NoError(app.store.UpdateUserRole(alice.ID, core.ROLE_ADMIN))
+	assert.NoError(app.store.UpdateUserRole(carol.ID, core.ROLE_SUPPORT))
+
+	client := http.Client{}
+
+	request := func(method string, endpoint string, authorization string, body string) (int, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return res.StatusCode, data
+	}
+
+	// a worker is processing this one
+	code, _ := request(http.MethodPost, "/api/user/orders", user, "2377225624")
+	assert.Equal(http.StatusAccepted, code)
+	jobs, err := app.store.LeaseJobs("test-worker", 10, JobLeasePeriod)
+	if !assert.NoError(err) || !assert.Len(jobs, 1) {
+		return
+	}
+
+	code, _ = request(http.MethodPost, "/api/user/orders", user, "12345678903")
+	assert.Equal(http.StatusAccepted, code)
+
+	type testCase struct {
+		name          string
+		method        string
+		endpoint      string
+		authorization string
+		expectedCode  int
+		expectedBody  string
+	}
+
+	var testCases = []testCase{
+		{
+			"Unauthorized",
+			http.MethodGet,
+			"/api/admin/users?login=bob",
+			"",
+			http.StatusUnauthorized,
+			"",
+		},
+		{
+			"Not an operator",
+			http.MethodGet,
+			"/api/admin/users?login=bob",
+			user,
+			http.StatusForbidden,
+			"",
+		},
+		{
+			"Find user",
+			http.MethodGet,
+			"/api/admin/users?login=bob",
+			support,
+			http.StatusOK,
+			fmt.Sprintf("{\"id\": \"%s\", \"login\": \"bob\", \"role\": \"user\", \"disabled\": false}", bob.ID),
+		},
+		{
+			"Find unknown user",
+			http.MethodGet,
+			"/api/admin/users?login=dave",
+			support,
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"Get user",
+			http.MethodGet,
+			fmt.Sprintf("/api/admin/users/%s", carol.ID),
+			support,
+			http.StatusOK,
+			fmt.Sprintf("{\"id\": \"%s\", \"login\": \"carol\", \"role\": \"support\", \"disabled\": false}", carol.ID),
+		},
+		{
+			"Get unknown user",
+			http.MethodGet,
+			fmt.Sprintf("/api/admin/users/%s", uuid.New()),
+			support,
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"Get malformed user id",
+			http.MethodGet,
+			"/api/admin/users/bob",
+			support,
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"List orders of user",
+			http.MethodGet,
+			fmt.Sprintf("/api/admin/users/%s/orders", bob.ID),
+			support,
+			http.StatusOK,
+			"",
+		},
+		{
+			"List withdrawals of user",
+			http.MethodGet,
+			fmt.Sprintf("/api/admin/users/%s/withdrawals", bob.ID),
+			support,
+			http.StatusNoContent,
+			"",
+		},
+		{
+			"Get balance of user",
+			http.MethodGet,
+			fmt.Sprintf("/api/admin/users/%s/balance", bob.ID),
+			support,
+			http.StatusOK,
+			"{\"current\": 420, \"withdrawn\": 0}",
+		},
+		{
+			"Support may not requeue",
+			http.MethodPost,
+			"/api/admin/orders/12345678903/requeue",
+			support,
+			http.StatusForbidden,
+			"",
+		},
+		{
+			"Requeue accrual",
+			http.MethodPost,
+			"/api/admin/orders/12345678903/requeue",
+			admin,
+			http.StatusAccepted,
+			"",
+		},
+		{
+			"Requeue order being processed",
+			http.MethodPost,
+			"/api/admin/orders/2377225624/requeue",
+			admin,
+			http.StatusConflict,
+			"",
+		},
+		{
+			"Requeue unknown order",
+			http.MethodPost,
+			"/api/admin/orders/4561261212345467/requeue",
+			admin,
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"Support may not disable",
+			http.MethodPost,
+			fmt.Sprintf("/api/admin/users/%s/disable", bob.ID),
+			support,
+			http.StatusForbidden,
+			"",
+		},
+		{
+			"Admin may not disable themselves",
+			http.MethodPost,
+			fmt.Sprintf("/api/admin/users/%s/disable", alice.ID),
+			admin,
+			http.StatusConflict,
+			"",
+		},
+	}
+
+	for _, tCase := range testCases {
+		code, body := request(tCase.method, tCase.endpoint, tCase.authorization, "")
+		assert.Equal(tCase.expectedCode, code, tCase.name)
+		if tCase.expectedBody != "" {
+			assert.JSONEq(tCase.expectedBody, string(body), tCase.name)
+		}
+	}
+
+	// disabled users are logged out and may not log in again
+	code, _ = request(http.MethodPost, fmt.Sprintf("/api/admin/users/%s/disable", bob.ID), admin, "")
+	assert.Equal(http.StatusOK, code)
+	code, _ = request(http.MethodGet, "/api/user/balance", user, "")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = request(http.MethodPost, "/api/user/login", "", "{\"login\": \"bob\", \"password\": \"sikret\"}")
+	assert.Equal(http.StatusForbidden, code)
+
+	code, _ = request(http.MethodPost, fmt.Sprintf("/api/admin/users/%s/enable", bob.ID), admin, "")
+	assert.Equal(http.StatusOK, code)
+	code, _ = request(http.MethodPost, "/api/user/login", "", "{\"login\": \"bob\", \"password\": \"sikret\"}")
+	assert.Equal(http.StatusOK, code)
+
+	// API keys never reach the admin API, whoever they belong to
+	_, body := request(http.MethodPost, "/api/user/api-keys", admin, "{\"name\": \"ops\", \"scopes\": [\"orders:read\"]}")
+	var created struct {
+		Key string `json:"key"`
+	}
+	if assert.NoError(json.Unmarshal(body, &created)) {
+		code, _ = request(http.MethodGet, "/api/admin/users?login=bob", fmt.Sprintf("Bearer %s", created.Key), "")
+		assert.Equal(http.StatusUnauthorized, code)
+	}
+}
+
+func TestBalanceAdjustment(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, admin := alice(t, app)
+	bob, user := bob(t, app)
+	assert.NoError(app.store.UpdateUserRole(alice.ID, core.ROLE_ADMIN))
+
+	client := http.Client{}
+	endpoint := fmt.Sprintf("/api/admin/users/%s/adjustments", bob.ID)
+
+	request := func(method string, endpoint string, authorization string, body string) (int, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return res.StatusCode, data
+	}
+
+	type testCase struct {
+		name          string
+		authorization string
+		body          string
+		expectedCode  int
+	}
+
+	var testCases = []testCase{
+		{
+			"Not an admin",
+			user,
+			"{\"amount\": 100, \"reason\": \"GOODWILL\"}",
+			http.StatusForbidden,
+		},
+		{
+			"Malformed request",
+			admin,
+			"{\"amount\": \"lots\"}",
+			http.StatusBadRequest,
+		},
+		{
+			"No reason",
+			admin,
+			"{\"amount\": 100}",
+			http.StatusBadRequest,
+		},
+		{
+			"Unknown reason",
+			admin,
+			"{\"amount\": 100, \"reason\": \"BECAUSE\"}",
+			http.StatusBadRequest,
+		},
+		{
+			"Zero amount",
+			admin,
+			"{\"amount\": 0, \"reason\": \"GOODWILL\"}",
+			http.StatusBadRequest,
+		},
+		{
+			"Debit exceeding balance",
+			admin,
+			"{\"amount\": -420.01, \"reason\": \"FRAUD_REVERSAL\"}",
+			http.StatusPaymentRequired,
+		},
+		{
+			"Credit",
+			admin,
+			"{\"amount\": 5, \"reason\": \"GOODWILL\", \"note\": \"sorry for the delay\"}",
+			http.StatusCreated,
+		},
+		{
+			"Debit",
+			admin,
+			"{\"amount\": -25, \"reason\": \"ACCRUAL_CORRECTION\"}",
+			http.StatusCreated,
+		},
+	}
+
+	for _, tCase := range testCases {
+		code, _ := request(http.MethodPost, endpoint, tCase.authorization, tCase.body)
+		assert.Equal(tCase.expectedCode, code, tCase.name)
+	}
+
+	code, body := request(http.MethodGet, "/api/user/balance", user, "")
+	if assert.Equal(http.StatusOK, code) {
+		assert.JSONEq("{\"current\": 400, \"withdrawn\": 0}", string(body))
+	}
+
+	// adjustments are never silent, the user sees them in their history
+	code, body = request(http.MethodGet, "/api/user/balance/history", user, "")
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	var entries []map[string]interface{}
+	err := json.Unmarshal(body, &entries)
+	if !assert.NoError(err) || !assert.Len(entries, 3) {
+		return
+	}
+	assert.Equal(core.ADJUSTMENT, entries[0]["type"])
+	assert.Equal(core.ACCRUAL_CORRECTION, entries[0]["reason"])
+	assert.Equal(core.UserAccount(bob.ID), entries[0]["debit"])
+	assert.Equal(core.ADJUSTMENT, entries[1]["type"])
+	assert.Equal(core.GOODWILL, entries[1]["reason"])
+	assert.Equal("sorry for the delay", entries[1]["note"])
+	assert.Equal(core.OPENING, entries[2]["type"])
+	assert.NotContains(string(body), alice.ID.String())
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, admin := alice(t, app)
+	_, user := bob(t, app)
+	assert.NoError(app.store.UpdateUserRole(alice.ID, core.ROLE_ADMIN))
+
+	client := http.Client{}
+
+	request := func(method string, endpoint string, authorization string, body string) (int, []byte, http.Header) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return res.StatusCode, data, res.Header
+	}
+
+	code, _, header := request(http.MethodPost, "/api/user/register", "", "{\"login\": \"carol\", \"password\": \"hunter2\"}")
+	if !assert.Equal(http.StatusOK, code) {
+		return
+	}
+	carol := header.Get("Authorization")
+	code, _, _ = request(http.MethodPost, "/api/user/login", "", "{\"login\": \"carol\", \"password\": \"hunter3\"}")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _, _ = request(http.MethodPost, "/api/user/orders", carol, "12345678903")
+	assert.Equal(http.StatusAccepted, code)
+
+	type auditEvent struct {
+		Type      string            `json:"type"`
+		UserID    uuid.UUID         `json:"user_id"`
+		ActorID   uuid.UUID         `json:"actor_id"`
+		RequestID string            `json:"request_id"`
+		Login     string            `json:"login"`
+		IP        string            `json:"ip"`
+		Details   map[string]string `json:"details"`
+	}
+
+	query := func(params string) []auditEvent {
+		code, body, _ := request(http.MethodGet, "/api/admin/audit?"+params, admin, "")
+		events := []auditEvent{}
+		if code == http.StatusNoContent {
+			return events
+		}
+		if assert.Equal(http.StatusOK, code, params) {
+			assert.NoError(json.Unmarshal(body, &events))
+		}
+		return events
+	}
+
+	registered := query("type=USER_REGISTERED")
+	if !assert.Len(registered, 1) {
+		return
+	}
+	carolID := registered[0].UserID
+	assert.Equal("carol", registered[0].Login)
+	assert.NotEmpty(registered[0].RequestID)
+	assert.NotEmpty(registered[0].IP)
+	assert.Equal(uuid.Nil, registered[0].ActorID)
+
+	events := query(fmt.Sprintf("user=%s", carolID))
+	types := []string{}
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	assert.Equal([]string{core.ORDER_UPLOADED, core.LOGIN_FAILED, core.USER_REGISTERED}, types)
+	if assert.Len(events, 3) {
+		assert.Equal(carolID, events[0].ActorID)
+		assert.Equal("12345678903", events[0].Details["order"])
+		assert.Equal("password", events[1].Details["step"])
+	}
+
+	assert.Len(query("type=login_failed,order_uploaded"), 2)
+	assert.Len(query(fmt.Sprintf("type=ORDER_UPLOADED&actor=%s", alice.ID)), 0)
+	assert.Len(query("to=2000-01-01T00:00:00Z"), 0)
+	assert.Len(query("limit=1"), 1)
+
+	// queries are audited as well
+	viewed := query(fmt.Sprintf("type=AUDIT_VIEWED&actor=%s", alice.ID))
+	assert.NotEmpty(viewed)
+
+	code, _, _ = request(http.MethodGet, "/api/admin/audit", user, "")
+	assert.Equal(http.StatusForbidden, code)
+	code, _, _ = request(http.MethodGet, "/api/admin/audit?from=yesterday", admin, "")
+	assert.Equal(http.StatusBadRequest, code)
+	code, _, _ = request(http.MethodGet, "/api/admin/audit?user=carol", admin, "")
+	assert.Equal(http.StatusBadRequest, code)
+}
+
+func TestPagination(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	bob, authorization := bob(t, app)
+
+	client := http.Client{}
+
+	request := func(endpoint string) (int, []byte, string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", server.URL, endpoint), nil)
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorization)
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return res.StatusCode, data, res.Header.Get(NextCursorHeader)
+	}
+
+	// walk follows cursors until the last page and returns the ids seen
+	walk := func(endpoint string, field string) []string {
+		ids := []string{}
+		separator := "?"
+		if strings.Contains(endpoint, "?") {
+			separator = "&"
+		}
+		next := endpoint
+		for pages := 0; pages < 10; pages++ {
+			code, body, cursor := request(next)
+			if code == http.StatusNoContent {
+				return ids
+			}
+			if !assert.Equal(http.StatusOK, code, next) {
+				return ids
+			}
+			var records []map[string]interface{}
+			if !assert.NoError(json.Unmarshal(body, &records)) {
+				return ids
+			}
+			for _, record := range records {
+				ids = append(ids, fmt.Sprint(record[field]))
+			}
+			if cursor == "" {
+				return ids
+			}
+			next = endpoint + separator + "cursor=" + cursor
+		}
+		assert.Fail("too many pages")
+		return ids
+	}
+
+	start := time.Date(2022, time.August, 8, 21, 40, 0, 0, time.UTC)
+	numbers := []string{"12345678903", "4561261212345467", "79927398713", "49927398716", "1234567812345670"}
+	statuses := []string{core.NEW, core.PROCESSED, core.NEW, core.INVALID, core.PROCESSING}
+	for i, number := range numbers {
+		order, err := core.NewOrder(number, bob, start.Add(time.Duration(i)*time.Hour))
+		if !assert.NoError(err) {
+			return
+		}
+		order.Status = statuses[i]
+		if !assert.NoError(app.store.CreateOrder(order, order.UploadedAt)) {
+			return
+		}
+	}
+	// orders uploaded at the same moment are told apart by their numbers
+	order, err := core.NewOrder("2377225624", bob, start.Add(4*time.Hour))
+	if !assert.NoError(err) || !assert.NoError(app.store.CreateOrder(order, order.UploadedAt)) {
+		return
+	}
+
+	assert.Equal([]string{"12345678903", "4561261212345467", "79927398713", "49927398716", "1234567812345670", "2377225624"}, walk("/api/user/orders?limit=2", "number"))
+	assert.Equal([]string{"2377225624", "1234567812345670", "49927398716", "79927398713", "4561261212345467", "12345678903"}, walk("/api/user/orders?limit=4&sort=desc", "number"))
+	assert.Equal([]string{"12345678903", "79927398713", "2377225624"}, walk("/api/user/orders?limit=1&status=new", "number"))
+	assert.Equal([]string{"4561261212345467", "49927398716"}, walk("/api/user/orders?status=PROCESSED,INVALID", "number"))
+	assert.Equal([]string{"4561261212345467", "79927398713"}, walk("/api/user/orders?from=2022-08-08T22:40:00Z&to=2022-08-09T00:40:00Z", "number"))
+	assert.Equal([]string{}, walk("/api/user/orders?from=2023-01-01T00:00:00Z", "number"))
+
+	code, _, cursor := request("/api/user/orders")
+	assert.Equal(http.StatusOK, code)
+	assert.Empty(cursor)
+
+	for _, query := range []string{"limit=0", "limit=1001", "cursor=garbage", "status=LOST", "sort=up", "from=yesterday"} {
+		code, _, _ := request("/api/user/orders?" + query)
+		assert.Equal(http.StatusBadRequest, code, query)
+	}
+
+	for i, number := range numbers[:3] {
+		order, err := core.NewOrder(number, bob, start)
+		if !assert.NoError(err) {
+			return
+		}
+		withdrawal, err := core.NewWithdrawal(order, decimal.New(int64(i+1), 0), start.Add(time.Duration(i)*time.Minute))
+		if !assert.NoError(err) {
+			return
+		}
+		// withdrawals are made against orders of their own
+		order.ID = number + "0"
+		withdrawal.OrderID = order.ID
+		if !assert.NoError(app.store.CreateWithdrawal(withdrawal, order)) {
+			return
+		}
+	}
+
+	assert.Equal([]string{"1", "2", "3"}, walk("/api/user/withdrawals?limit=1", "sum"))
+	assert.Equal([]string{"3", "2", "1"}, walk("/api/user/withdrawals?limit=2&sort=desc", "sum"))
+	assert.Equal([]string{"2"}, walk("/api/user/withdrawals?from=2022-08-08T21:41:00Z&to=2022-08-08T21:42:00Z", "sum"))
+
+	code, _, _ = request("/api/user/withdrawals?cursor=" + core.Cursor{At: start, ID: "12345678903"}.Encode())
+	assert.Equal(http.StatusBadRequest, code)
+}
+
+func TestIdempotency(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, authorizationAlice := alice(t, app)
+	bob, authorizationBob := bob(t, app)
+
+	client := http.Client{}
+
+	request := func(endpoint string, authorization string, key string, body string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorization)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return res, string(data)
+	}
+
+	balance := func(user *core.User) string {
+		user, err := app.store.ExtractUserByID(user.ID)
+		if !assert.NoError(err) {
+			assert.FailNow("could not extract user")
+		}
+		return user.Balance.String()
+	}
+
+	const withdraw = "/api/user/balance/withdraw"
+	const orders = "/api/user/orders"
+
+	res, first := request(withdraw, authorizationBob, "retry-1", `{"order": "2377225624", "sum": 100}`)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Empty(res.Header.Get(IdempotentReplayedHeader))
+	assert.Equal("320", balance(bob))
+
+	res, body := request(withdraw, authorizationBob, "retry-1", `{"order": "2377225624", "sum": 100}`)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+	assert.Equal(first, body)
+	assert.Equal("320", balance(bob))
+
+	res, _ = request(withdraw, authorizationBob, "retry-1", `{"order": "2377225624", "sum": 200}`)
+	assert.Equal(http.StatusUnprocessableEntity, res.StatusCode)
+	assert.Equal("320", balance(bob))
+
+	res, _ = request(orders, authorizationBob, "retry-1", "2377225624")
+	assert.Equal(http.StatusUnprocessableEntity, res.StatusCode)
+
+	// keys are per user
+	res, _ = request(withdraw, authorizationAlice, "retry-1", `{"order": "79927398713", "sum": 100}`)
+	assert.Equal(http.StatusPaymentRequired, res.StatusCode)
+	assert.Empty(res.Header.Get(IdempotentReplayedHeader))
+	res, _ = request(withdraw, authorizationAlice, "retry-1", `{"order": "79927398713", "sum": 100}`)
+	assert.Equal(http.StatusPaymentRequired, res.StatusCode)
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+	assert.Equal("13.37", balance(alice))
+
+	res, _ = request(orders, authorizationBob, "upload-1", "12345678903")
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+	res, _ = request(orders, authorizationBob, "upload-1", "12345678903")
+	assert.Equal(http.StatusAccepted, res.StatusCode)
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+	res, _ = request(orders, authorizationBob, "", "12345678903")
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	res, _ = request(orders, authorizationBob, strings.Repeat("k", core.MaxIdempotencyKeyLength+1), "4561261212345467")
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+
+	res, _ = request(orders, "", "upload-1", "12345678903")
+	assert.Equal(http.StatusUnauthorized, res.StatusCode)
+
+	// the first request with the key is still being processed
+	record, err := core.NewIdempotencyRecord(bob, "busy", core.HashIdempotentRequest(http.MethodPost, orders, []byte("4561261212345467")), time.Now())
+	if assert.NoError(err) && assert.NoError(app.store.CreateIdempotencyRecord(record)) {
+		res, _ = request(orders, authorizationBob, "busy", "4561261212345467")
+		assert.Equal(http.StatusConflict, res.StatusCode)
+	}
+
+	// expired keys may be used again
+	record, err = core.NewIdempotencyRecord(bob, "stale", core.HashIdempotentRequest(http.MethodPost, orders, []byte("12345678903")), time.Now().Add(-core.IdempotencyKeyPeriod-time.Minute))
+	if assert.NoError(err) && assert.NoError(app.store.CreateIdempotencyRecord(record)) {
+		record.Status = http.StatusAccepted
+		assert.NoError(app.store.CompleteIdempotencyRecord(record))
+
+		res, _ = request(orders, authorizationBob, "stale", "4561261212345467")
+		assert.Equal(http.StatusAccepted, res.StatusCode)
+		assert.Empty(res.Header.Get(IdempotentReplayedHeader))
+	}
+}
+
+func TestPurgeIdempotencyRecords(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	bob, _ := bob(t, app)
+
+	hash := core.HashIdempotentRequest(http.MethodPost, "/api/user/orders", []byte("12345678903"))
+	stale, err := core.NewIdempotencyRecord(bob, "stale", hash, time.Now().Add(-core.IdempotencyKeyPeriod-time.Minute))
+	if !assert.NoError(err) || !assert.NoError(app.store.CreateIdempotencyRecord(stale)) {
+		return
+	}
+	live, err := core.NewIdempotencyRecord(bob, "live", hash, time.Now())
+	if !assert.NoError(err) || !assert.NoError(app.store.CreateIdempotencyRecord(live)) {
+		return
+	}
+
+	assert.NoError(app.PurgeIdempotencyRecords())
+
+	purged, err := app.store.DeleteExpiredIdempotencyRecords()
+	assert.NoError(err)
+	assert.Equal(0, purged)
+	_, err = app.store.ExtractIdempotencyRecord(bob.ID, "live")
+	assert.NoError(err)
+}
+
+// auditlessStore fails to record any audit event
+type auditlessStore struct {
+	storage.Storage
+}
+
+func (store *auditlessStore) WithContext(ctx context.Context) storage.Storage {
+	return &auditlessStore{store.Storage.WithContext(ctx)}
+}
+
+func (store *auditlessStore) CreateAuditEvent(*core.AuditEvent) error {
+	return errors.New("audit log is unavailable")
+}
+
+func TestAuditFailure(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := &auditlessStore{storage.NewMemStorage()}
+	app := NewApp(store)
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	bob, authorizationBob := bob(t, app)
+
+	client := http.Client{}
+
+	post := func(endpoint string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorizationBob)
+		req.Header.Set(IdempotencyKeyHeader, "audit-"+endpoint)
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// actions which have been committed succeed, retries get the same answer
+	for i := 0; i < 2; i++ {
+		res := post("/api/user/balance/withdraw", `{"order": "2377225624", "sum": 100}`)
+		assert.Equal(http.StatusOK, res.StatusCode)
+		res = post("/api/user/orders", "12345678903")
+		assert.Equal(http.StatusAccepted, res.StatusCode)
+	}
+
+	user, err := store.ExtractUserByID(bob.ID)
+	if assert.NoError(err) {
+		assert.Equal("320", user.Balance.String())
+	}
+}
+
+func TestAdminAuditFailure(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := &auditlessStore{storage.NewMemStorage()}
+	app := NewApp(store)
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	alice, admin := alice(t, app)
+	bob, user := bob(t, app)
+	assert.NoError(app.store.UpdateUserRole(alice.ID, core.ROLE_ADMIN))
+
+	client := http.Client{}
+
+	request := func(method string, endpoint string, authorization string, body string) int {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+		res, err := client.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	code := request(http.MethodPost, "/api/user/orders", user, "12345678903")
+	assert.Equal(http.StatusAccepted, code)
+
+	// actions have been applied, answering 500 would make the operator apply
+	// them again
+	code = request(http.MethodPost, fmt.Sprintf("/api/admin/users/%s/adjustments", bob.ID), admin, `{"amount": 100, "reason": "GOODWILL"}`)
+	assert.Equal(http.StatusCreated, code)
+	code = request(http.MethodPost, "/api/admin/orders/12345678903/requeue", admin, "")
+	assert.Equal(http.StatusAccepted, code)
+	code = request(http.MethodPost, fmt.Sprintf("/api/admin/users/%s/disable", bob.ID), admin, "")
+	assert.Equal(http.StatusOK, code)
+
+	extracted, err := store.ExtractUserByID(bob.ID)
+	if assert.NoError(err) {
+		assert.Equal("520", extracted.Balance.String())
+		assert.True(extracted.Disabled)
+	}
+	code = request(http.MethodGet, "/api/user/balance", user, "")
+	assert.Equal(http.StatusUnauthorized, code)
+
+	// views are never shown off the record
+	code = request(http.MethodGet, fmt.Sprintf("/api/admin/users/%s", bob.ID), admin, "")
+	assert.Equal(http.StatusInternalServerError, code)
+}
+
+// contextlessStore fails calls made outside of any request, the way they
+// would outlive requests their clients gave up on
+type contextlessStore struct {
+	storage.Storage
+	ctx context.Context
+}
+
+func (store *contextlessStore) WithContext(ctx context.Context) storage.Storage {
+	return &contextlessStore{store.Storage.WithContext(ctx), ctx}
+}
+
+func (store *contextlessStore) CreateSession(session *core.Session, refreshToken *core.RefreshToken) error {
+	if store.ctx == nil {
+		return errors.New("session is created outside of the request")
+	}
+	return store.Storage.CreateSession(session, refreshToken)
+}
+
+func (store *contextlessStore) ExtractRandomKey(algorithm string) (*core.SigningKey, error) {
+	if store.ctx == nil {
+		return nil, errors.New("key is extracted outside of the request")
+	}
+	return store.Storage.ExtractRandomKey(algorithm)
+}
+
+func TestLoginContext(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app := NewApp(&contextlessStore{Storage: storage.NewMemStorage()})
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	user, err := core.NewUser("alice", "correct-horse")
+	if !assert.NoError(err) || !assert.NoError(app.store.CreateUser(user)) {
+		return
+	}
+
+	body := "{\"login\": \"alice\", \"password\": \"correct-horse\"}"
+	res, err := http.Post(fmt.Sprintf("%s/api/user/login", server.URL), "application/json", strings.NewReader(body))
+	if !assert.NoError(err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+}
+
+// cancellingStore fails writes made after the request context is cancelled,
+// the way the database does, and holds withdrawals until the client gives up
+type cancellingStore struct {
+	storage.Storage
+	ctx         context.Context
+	withdrawing chan struct{}
+}
+
+func (store *cancellingStore) WithContext(ctx context.Context) storage.Storage {
+	return &cancellingStore{store.Storage.WithContext(ctx), ctx, store.withdrawing}
+}
+
+func (store *cancellingStore) err() error {
+	if store.ctx == nil {
+		return nil
+	}
+	return store.ctx.Err()
+}
+
+func (store *cancellingStore) CreateWithdrawal(withdrawal *core.Withdrawal, order *core.Order) error {
+	if store.ctx != nil {
+		store.withdrawing <- struct{}{}
+		<-store.ctx.Done()
+	}
+	// committed just as the client gave up
+	return store.Storage.CreateWithdrawal(withdrawal, order)
+}
+
+func (store *cancellingStore) CompleteIdempotencyRecord(record *core.IdempotencyRecord) error {
+	if err := store.err(); err != nil {
+		return err
+	}
+	return store.Storage.CompleteIdempotencyRecord(record)
+}
+
+func (store *cancellingStore) DeleteIdempotencyRecord(userID uuid.UUID, key string) error {
+	if err := store.err(); err != nil {
+		return err
+	}
+	return store.Storage.DeleteIdempotencyRecord(userID, key)
+}
+
+func TestIdempotencyClientGaveUp(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := &cancellingStore{Storage: storage.NewMemStorage(), withdrawing: make(chan struct{}, 1)}
+	app := NewApp(store)
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+	bob, authorizationBob := bob(t, app)
+
+	request := func(ctx context.Context) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/api/user/balance/withdraw", server.URL), strings.NewReader(`{"order": "2377225624", "sum": 100}`))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		req.Header.Set("Authorization", authorizationBob)
+		req.Header.Set(IdempotencyKeyHeader, "timeout-1")
+		return http.DefaultClient.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-store.withdrawing
+		cancel()
+	}()
+	_, err = request(ctx)
+	assert.Error(err)
+
+	assert.Eventually(func() bool {
+		record, err := store.ExtractIdempotencyRecord(bob.ID, "timeout-1")
+		return err == nil && record.Completed()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	res, err := request(context.Background())
+	if !assert.NoError(err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("true", res.Header.Get(IdempotentReplayedHeader))
+
+	user, err := store.ExtractUserByID(bob.ID)
+	if assert.NoError(err) {
+		assert.Equal("320", user.Balance.String())
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	t.Parallel()
+
+	app, server := app(t)
+	defer server.Close()
+	_, authorizationAlice := alice(t, app)
+	_, authorizationBob := bob(t, app)
+
+	client := http.Client{}
+
+	type testCase struct {
+		name           string
+		method         string
+		endpoint       string
+		auth           string
+		body           string
+		expectedStatus int
+		expectedCode   ProblemCode
+	}
+
+	var testCases = []testCase{
+		{"Unauthorized", http.MethodGet, "/api/user/balance", "", "", http.StatusUnauthorized, UNAUTHORIZED},
+		{"Wrong password", http.MethodPost, "/api/user/login", "", `{"login": "alice", "password": "wrong"}`, http.StatusUnauthorized, INVALID_CREDENTIALS},
+		{"Malformed body", http.MethodPost, "/api/user/register", "", `{"login": `, http.StatusBadRequest, MALFORMED_REQUEST},
+		{"Login taken", http.MethodPost, "/api/user/register", "", `{"login": "alice", "password": "other"}`, http.StatusConflict, LOGIN_TAKEN},
+		{"Invalid order number", http.MethodPost, "/api/user/orders", authorizationAlice, "12345678902", http.StatusUnprocessableEntity, INVALID_ORDER_NUMBER},
+		{"Order of another user", http.MethodPost, "/api/user/orders", authorizationBob, "12345678903", http.StatusConflict, ORDER_UPLOADED_BY_ANOTHER_USER},
+		{"Balance exceeded", http.MethodPost, "/api/user/balance/withdraw", authorizationAlice, `{"order": "2377225624", "sum": 100}`, http.StatusPaymentRequired, BALANCE_EXCEEDED},
+		{"Invalid query", http.MethodGet, "/api/user/orders?sort=up", authorizationAlice, "", http.StatusBadRequest, INVALID_QUERY},
+		{"Admin only", http.MethodGet, "/api/admin/audit", authorizationAlice, "", http.StatusForbidden, FORBIDDEN},
+		{"Unknown order", http.MethodGet, "/api/user/orders/4561261212345467", authorizationAlice, "", http.StatusNotFound, NOT_FOUND},
+		{"Unknown route", http.MethodGet, "/api/user/nothing", authorizationAlice, "", http.StatusNotFound, NOT_FOUND},
+		{"Method not allowed", http.MethodDelete, "/api/user/orders", authorizationAlice, "", http.StatusMethodNotAllowed, METHOD_NOT_ALLOWED},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/user/orders", server.URL), strings.NewReader("12345678903"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Set("Authorization", authorizationAlice)
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, err := http.NewRequest(tCase.method, fmt.Sprintf("%s%s", server.URL, tCase.endpoint), strings.NewReader(tCase.body))
+			if !assert.NoError(err) {
+				return
+			}
+			req.Header.Set("Authorization", tCase.auth)
+
+			res, err := client.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(tCase.expectedStatus, res.StatusCode)
+			assert.Equal(ProblemContentType, res.Header.Get("Content-Type"))
+
+			var problem Problem
+			body, err := ioutil.ReadAll(res.Body)
+			if !assert.NoError(err) || !assert.NoError(json.Unmarshal(body, &problem)) {
+				return
+			}
+			assert.Equal(tCase.expectedStatus, problem.Status)
+			assert.Equal(tCase.expectedCode, problem.Code)
+			assert.NotEmpty(problem.Title)
+			assert.NotEmpty(problem.RequestID)
+			assert.Equal(strings.Split(tCase.endpoint, "?")[0], problem.Instance)
+		})
+	}
+}
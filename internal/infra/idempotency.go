@@ -0,0 +1,162 @@
+package infra
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// replayed responses are marked with this header, so clients can tell them
+// from the responses to requests processed just now
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// outcomes of requests are stored within this long after they are processed
+const IdempotencyStoreTimeout = 5 * time.Second
+
+// recordingWriter keeps a copy of the response written through it
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(body []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(body)
+	return w.ResponseWriter.Write(body)
+}
+
+// idempotent lets clients retry requests to h with the same Idempotency-Key
+// header safely: the response to the first request is stored for the user,
+// the same request made with the key again gets it back instead of being
+// processed twice. Another request made with the key is rejected with 422,
+// the one made while the first is still being processed with 409. Requests
+// which failed with 5xx may be retried with the key.
+func (app *App) idempotent(h Handler) Handler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return h(w, r)
+		}
+
+		user := auth(w, r)
+		if user == nil {
+			return nil
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		record, err := core.NewIdempotencyRecord(user, key, core.HashIdempotentRequest(r.Method, r.URL.Path, body), time.Now())
+		if err != nil {
+			return err
+		}
+
+		store := app.store.WithContext(r.Context())
+		err = store.CreateIdempotencyRecord(record)
+		switch err.(type) {
+		case nil:
+		case *storage.ErrIdempotencyKeyExists:
+			return replay(w, store, record)
+		default:
+			return err
+		}
+
+		// problems are responded with here, so that they are replayed too
+		recorder := &recordingWriter{ResponseWriter: w}
+		err = h(recorder, r)
+		if err != nil {
+			writeError(recorder, r, err)
+		}
+
+		// the request context is cancelled once the client gives up waiting,
+		// the outcome is stored anyway so that the retry learns it
+		ctx, cancel := context.WithTimeout(context.Background(), IdempotencyStoreTimeout)
+		defer cancel()
+		store = app.store.WithContext(ctx)
+
+		if recorder.status >= http.StatusInternalServerError {
+			err = store.DeleteIdempotencyRecord(user.ID, key)
+			if err != nil {
+				log.Printf("Error while releasing idempotency key: %v", err)
+			}
+			return nil
+		}
+
+		record.Status = recorder.status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.Body = recorder.body.Bytes()
+		// the response is sent already, the key stays reserved until it
+		// expires rather than letting the request be processed twice
+		err = store.CompleteIdempotencyRecord(record)
+		if err != nil {
+			log.Printf("Error while storing idempotent response: %v", err)
+		}
+		return nil
+	}
+}
+
+// PurgeIdempotencyRecords deletes stored responses of expired keys, it should
+// be called periodically
+func (app *App) PurgeIdempotencyRecords() error {
+	purged, err := app.store.DeleteExpiredIdempotencyRecords()
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		metrics.Add("idempotency_records_purged_total", int64(purged))
+		log.Printf("Purged %d expired idempotency record(s)", purged)
+	}
+	return nil
+}
+
+func replay(w http.ResponseWriter, store storage.Storage, record *core.IdempotencyRecord) error {
+	stored, err := store.ExtractIdempotencyRecord(record.UserID, record.Key)
+	switch err.(type) {
+	case nil:
+	case *storage.ErrIdempotencyRecordNotFound:
+		// released by the first request failing in the meantime
+		return newProblem(http.StatusConflict, IDEMPOTENCY_KEY_IN_USE, "")
+	default:
+		return err
+	}
+
+	if !bytes.Equal(stored.RequestHash, record.RequestHash) {
+		metrics.Add("idempotency_mismatches_total", 1)
+		return newProblem(http.StatusUnprocessableEntity, IDEMPOTENCY_KEY_REUSED, "")
+	}
+	if !stored.Completed() {
+		return newProblem(http.StatusConflict, IDEMPOTENCY_KEY_IN_USE, "")
+	}
+
+	metrics.Add("idempotent_replays_total", 1)
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	if stored.Status >= http.StatusBadRequest {
+		w.Header().Set("Content-Type", ProblemContentType)
+	}
+	w.WriteHeader(stored.Status)
+	wrapWrite(w, stored.Body)
+	return nil
+}
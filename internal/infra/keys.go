@@ -0,0 +1,104 @@
+package infra
+
+import (
+	"log"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+// KeyRotator keeps signing keys of a single algorithm in line with the key
+// policy. Rotations of concurrent replicas may overlap, which only results
+// in a few extra keys.
+type KeyRotator struct {
+	store     storage.Storage
+	algorithm string
+	policy    core.KeyPolicy
+}
+
+func NewKeyRotator(store storage.Storage, algorithm string, policy core.KeyPolicy) *KeyRotator {
+	rotator := new(KeyRotator)
+	rotator.store = store
+	rotator.algorithm = algorithm
+	rotator.policy = policy
+	return rotator
+}
+
+// create creates n keys and returns their ids
+func (rotator *KeyRotator) create(n int) ([]uuid.UUID, error) {
+	eg := errgroup.Group{}
+	ids := make([]uuid.UUID, n)
+
+	for i := 0; i < n; i++ {
+		i := i
+		eg.Go(func() error {
+			key, err := core.NewKey(rotator.algorithm, rotator.policy)
+			if err != nil {
+				return err
+			}
+			ids[i] = key.ID
+			return rotator.store.CreateKey(key)
+		})
+	}
+
+	err := eg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	metrics.Add("signing_keys_created_total", int64(n))
+	return ids, nil
+}
+
+// Rotate creates keys to replace the ones about to retire and purges
+// expired keys
+func (rotator *KeyRotator) Rotate() error {
+	keys, err := rotator.store.ExtractAllKeys()
+	if err != nil {
+		return err
+	}
+
+	missing := rotator.policy.Missing(keys, rotator.algorithm, time.Now())
+	if missing > 0 {
+		_, err = rotator.create(missing)
+		if err != nil {
+			return err
+		}
+		log.Printf("Created %d %s signing key(s)", missing, rotator.algorithm)
+	}
+
+	purged, err := rotator.store.DeleteExpiredKeys()
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		metrics.Add("signing_keys_purged_total", int64(purged))
+		log.Printf("Purged %d expired signing key(s)", purged)
+	}
+
+	return nil
+}
+
+// Revoke is the emergency rotation: every key is replaced and every session
+// is revoked, so no token issued so far is accepted anymore. Replacements
+// are created before the old keys are deleted, so that there are keys to
+// sign tokens with all along.
+func (rotator *KeyRotator) Revoke() (keys int, sessions int, err error) {
+	fresh, err := rotator.create(rotator.policy.Keys)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	keys, err = rotator.store.DeleteKeysExcept(fresh)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sessions, err = rotator.store.RevokeAllSessions()
+	if err != nil {
+		return keys, 0, err
+	}
+	return keys, sessions, nil
+}
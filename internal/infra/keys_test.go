@@ -0,0 +1,182 @@
+package infra
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRotator(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := storage.NewMemStorage()
+	policy := core.KeyPolicy{Lifetime: 30 * time.Hour, Retirement: 4 * time.Hour, Lookahead: time.Hour, Keys: 2}
+	rotator := NewKeyRotator(store, core.EdDSA, policy)
+
+	err := rotator.Rotate()
+	if !assert.NoError(err) {
+		return
+	}
+	keys, err := store.ExtractAllKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(keys, 2)
+
+	err = rotator.Rotate()
+	if !assert.NoError(err) {
+		return
+	}
+	keys, err = store.ExtractAllKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(keys, 2)
+
+	// one key has retired, another one has expired
+	var retired, expired uuid.UUID
+	for id, key := range keys {
+		if retired == uuid.Nil {
+			retired = id
+			key.RetiresAt = time.Now().Add(-time.Hour)
+			key.ExpiresAt = time.Now().Add(3 * time.Hour)
+		} else {
+			expired = id
+			key.RetiresAt = time.Now().Add(-5 * time.Hour)
+			key.ExpiresAt = time.Now().Add(-time.Hour)
+		}
+		key := key
+		err = store.CreateKey(&key)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	err = rotator.Rotate()
+	if !assert.NoError(err) {
+		return
+	}
+	keys, err = store.ExtractAllKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(keys, 3)
+	assert.Contains(keys, retired)
+	assert.NotContains(keys, expired)
+
+	// retired key still verifies tokens, but does not sign new ones
+	for i := 0; i < 10; i++ {
+		key, err := store.ExtractRandomKey(core.EdDSA)
+		if assert.NoError(err) {
+			assert.NotEqual(retired, key.ID)
+		}
+	}
+}
+
+func TestKeyRotatorRevoke(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	app, server := app(t)
+	defer server.Close()
+	alice, authorization := alice(t, app)
+
+	keys, err := app.store.ExtractAllKeys()
+	if !assert.NoError(err) {
+		return
+	}
+
+	revokedKeys, revokedSessions, err := app.rotator.Revoke()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(len(keys), revokedKeys)
+	assert.Equal(1, revokedSessions)
+
+	fresh, err := app.store.ExtractAllKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(fresh, core.DefaultKeyPolicy.Keys)
+	for id := range keys {
+		assert.NotContains(fresh, id)
+	}
+
+	// old token is rejected, newly issued ones are accepted
+	type testCase struct {
+		name          string
+		authorization string
+		expectedCode  int
+	}
+
+	var testCases = []testCase{
+		{
+			"Token issued before revocation",
+			authorization,
+			http.StatusUnauthorized,
+		},
+		{
+			"Token issued after revocation",
+			authorize(t, app, alice),
+			http.StatusOK,
+		},
+	}
+
+	for _, tCase := range testCases {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/balance", server.URL), nil)
+		if !assert.NoError(err) {
+			return
+		}
+		req.Header.Set("Authorization", tCase.authorization)
+
+		res, err := server.Client().Do(req)
+		if assert.NoError(err) {
+			res.Body.Close()
+			assert.Equal(tCase.expectedCode, res.StatusCode, tCase.name)
+		}
+	}
+}
+
+// keylessStore fails to create signing keys
+type keylessStore struct {
+	storage.Storage
+}
+
+func (store *keylessStore) CreateKey(*core.SigningKey) error {
+	return errors.New("database is read-only")
+}
+
+func TestKeyRotatorRevokeFailure(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := storage.NewMemStorage()
+	err := NewKeyRotator(store, core.EdDSA, core.DefaultKeyPolicy).Rotate()
+	if !assert.NoError(err) {
+		return
+	}
+	keys, err := store.ExtractAllKeys()
+	if !assert.NoError(err) {
+		return
+	}
+
+	// the old keys keep signing tokens if their replacements could not be
+	// created
+	_, _, err = NewKeyRotator(&keylessStore{store}, core.EdDSA, core.DefaultKeyPolicy).Revoke()
+	assert.Error(err)
+
+	left, err := store.ExtractAllKeys()
+	if assert.NoError(err) {
+		assert.Equal(len(keys), len(left))
+	}
+	_, err = store.ExtractRandomKey(core.EdDSA)
+	assert.NoError(err)
+}
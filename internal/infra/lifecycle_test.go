@@ -0,0 +1,156 @@
+package infra
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/accrual"
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOrderLifecycle runs the whole service against the in-process fake
+// accrual system: user registers, uploads orders, they get processed through
+// PROCESSING, throttling and INVALID answers, and accrued points are spent.
+func TestOrderLifecycle(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	store := storage.NewMemStorage()
+	app := NewApp(store)
+	err := app.HydrateKeys()
+	if !assert.NoError(err) {
+		return
+	}
+	server := httptest.NewServer(app.Router)
+	defer server.Close()
+
+	fake := accrual.NewFake()
+	fake.Script(
+		"4561261212345467",
+		accrual.Registered(),
+		accrual.TooManyRequests(10*time.Millisecond),
+		accrual.Processing(),
+		accrual.Processed(decimal.New(72995, -2)),
+	)
+	fake.Script("79927398713", accrual.Processing(), accrual.Invalid())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retry := core.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxFailures: 3}
+	pool, err := NewWorkerPool(store, fake, "test-worker", 2, NewRateLimiter(100, 1, 100, 1), retry, NewCircuitBreaker(5, time.Minute))
+	if !assert.NoError(err) {
+		return
+	}
+	go pool.Run(ctx)
+
+	do := func(method string, endpoint string, authorization string, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, fmt.Sprintf("%s%s", server.URL, endpoint), strings.NewReader(body))
+		if !assert.NoError(err) {
+			assert.FailNow("could not create request")
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if strings.HasPrefix(body, "{") {
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req.Header.Set("Content-Type", "text/plain")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			assert.FailNow("could not send request")
+		}
+		defer resp.Body.Close()
+		content, err := ioutil.ReadAll(resp.Body)
+		if !assert.NoError(err) {
+			assert.FailNow("could not read response")
+		}
+		return resp, content
+	}
+
+	resp, _ := do(http.MethodPost, "/api/user/register", "", "{\"login\": \"carol\", \"password\": \"hunter2\"}")
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+	authorization := resp.Header.Get("Authorization")
+	assert.NotEmpty(authorization)
+
+	resp, _ = do(http.MethodPost, "/api/user/orders", authorization, "4561261212345467")
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/api/user/orders", authorization, "79927398713")
+	assert.Equal(http.StatusAccepted, resp.StatusCode)
+
+	type orderResponse struct {
+		Number  string           `json:"number"`
+		Status  string           `json:"status"`
+		Accrual *decimal.Decimal `json:"accrual"`
+	}
+
+	// both orders reach terminal statuses only after the recheck interval,
+	// so nudge the jobs instead of waiting for it
+	statuses := make(map[string]orderResponse)
+	assert.Eventually(func() bool {
+		for _, orderID := range []string{"4561261212345467", "79927398713"} {
+			err := store.RequeueJob(orderID)
+			if err != nil {
+				switch err.(type) {
+				case *storage.ErrJobNotFound, *storage.ErrJobLeased:
+				default:
+					return false
+				}
+			}
+		}
+
+		resp, body := do(http.MethodGet, "/api/user/orders", authorization, "")
+		if resp.StatusCode != http.StatusOK {
+			return false
+		}
+		var orders []orderResponse
+		err := json.Unmarshal(body, &orders)
+		if err != nil {
+			return false
+		}
+		for _, order := range orders {
+			statuses[order.Number] = order
+		}
+		return statuses["4561261212345467"].Status == core.PROCESSED && statuses["79927398713"].Status == core.INVALID
+	}, 10*time.Second, 20*time.Millisecond)
+
+	processed := statuses["4561261212345467"]
+	if assert.NotNil(processed.Accrual) {
+		assert.True(processed.Accrual.Equal(decimal.New(72995, -2)))
+	}
+	assert.Nil(statuses["79927398713"].Accrual)
+	assert.GreaterOrEqual(fake.Calls("4561261212345467"), 4)
+
+	resp, _ = do(http.MethodPost, "/api/user/balance/withdraw", authorization, "{\"order\": \"2377225624\", \"sum\": 751}")
+	assert.Equal(http.StatusPaymentRequired, resp.StatusCode)
+	resp, _ = do(http.MethodPost, "/api/user/balance/withdraw", authorization, "{\"order\": \"2377225624\", \"sum\": 500}")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, body := do(http.MethodGet, "/api/user/balance", authorization, "")
+	if !assert.Equal(http.StatusOK, resp.StatusCode) {
+		return
+	}
+	var balance struct {
+		Current   decimal.Decimal `json:"current"`
+		Withdrawn decimal.Decimal `json:"withdrawn"`
+	}
+	err = json.Unmarshal(body, &balance)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(balance.Current.Equal(decimal.New(22995, -2)), "current balance is %s", balance.Current)
+	assert.True(balance.Withdrawn.Equal(decimal.New(500, 0)), "withdrawn sum is %s", balance.Withdrawn)
+}
@@ -0,0 +1,134 @@
+package infra
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"sync"
+	"time"
+)
+
+// share of current rate added after every successful request
+const rateIncreaseFactor = 0.01
+
+// RateLimiter is a token bucket shared by all accrual workers. Its rate
+// grows slowly while requests succeed and drops to the limit announced by
+// the accrual system (or by half, if none was announced) on every 429.
+type RateLimiter struct {
+	sync.Mutex
+	rate        float64
+	minRate     float64
+	maxRate     float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func NewRateLimiter(rate float64, minRate float64, maxRate float64, burst int) *RateLimiter {
+	limiter := new(RateLimiter)
+	limiter.minRate = minRate
+	limiter.maxRate = maxRate
+	limiter.setRate(rate)
+	limiter.burst = math.Max(float64(burst), 1)
+	limiter.tokens = limiter.burst
+	limiter.last = time.Now()
+	return limiter
+}
+
+func (limiter *RateLimiter) setRate(rate float64) {
+	limiter.rate = limiter.clamp(rate)
+	f := new(expvar.Float)
+	f.Set(limiter.rate)
+	metrics.Set("accrual_rate", f)
+}
+
+func (limiter *RateLimiter) clamp(rate float64) float64 {
+	return math.Min(math.Max(rate, limiter.minRate), limiter.maxRate)
+}
+
+func (limiter *RateLimiter) refill(now time.Time) {
+	if now.Before(limiter.last) {
+		return
+	}
+	elapsed := now.Sub(limiter.last).Seconds()
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+elapsed*limiter.rate)
+	limiter.last = now
+}
+
+// reserve takes a token if there is one, otherwise returns how long to
+// wait before trying again
+func (limiter *RateLimiter) reserve(now time.Time) time.Duration {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	if now.Before(limiter.pausedUntil) {
+		return limiter.pausedUntil.Sub(now)
+	}
+
+	limiter.refill(now)
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		return 0
+	}
+
+	return time.Duration((1 - limiter.tokens) / limiter.rate * float64(time.Second))
+}
+
+func (limiter *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		wait := limiter.reserve(time.Now())
+		if wait <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Refund gives back a token taken by Wait which was not spent on a request
+func (limiter *RateLimiter) Refund() {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.tokens = math.Min(limiter.burst, limiter.tokens+1)
+}
+
+func (limiter *RateLimiter) OnSuccess() {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	limiter.refill(time.Now())
+	limiter.setRate(limiter.rate * (1 + rateIncreaseFactor))
+}
+
+// OnThrottled pauses every worker for retryAfter and lowers the rate. limit
+// is the number of requests per second accrual system allows, 0 if unknown.
+func (limiter *RateLimiter) OnThrottled(retryAfter time.Duration, limit float64) {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	if limit > 0 {
+		limiter.setRate(limit)
+	} else {
+		limiter.setRate(limiter.rate / 2)
+	}
+
+	pausedUntil := time.Now().Add(retryAfter)
+	if pausedUntil.After(limiter.pausedUntil) {
+		limiter.pausedUntil = pausedUntil
+	}
+	limiter.tokens = 0
+	limiter.last = limiter.pausedUntil
+}
+
+func (limiter *RateLimiter) Rate() float64 {
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	return limiter.rate
+}
@@ -0,0 +1,56 @@
+package infra
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Rate grows on success up to the maximum", func(t *testing.T) {
+		limiter := NewRateLimiter(10, 1, 10.5, 1)
+		for i := 0; i < 10; i++ {
+			limiter.OnSuccess()
+		}
+		assert.Equal(t, 10.5, limiter.Rate())
+	})
+
+	t.Run("Rate drops to announced limit when throttled", func(t *testing.T) {
+		limiter := NewRateLimiter(10, 0.1, 100, 1)
+		limiter.OnThrottled(0, 0.5)
+		assert.Equal(t, 0.5, limiter.Rate())
+	})
+
+	t.Run("Rate is halved when throttled without a limit", func(t *testing.T) {
+		limiter := NewRateLimiter(10, 1, 100, 1)
+		limiter.OnThrottled(0, 0)
+		assert.Equal(t, 5.0, limiter.Rate())
+	})
+
+	t.Run("Refunded token is taken again", func(t *testing.T) {
+		limiter := NewRateLimiter(0.001, 0.001, 1, 1)
+		assert.NoError(t, limiter.Wait(context.Background()))
+		limiter.Refund()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.NoError(t, limiter.Wait(ctx))
+	})
+
+	t.Run("Wait is paused for retry-after", func(t *testing.T) {
+		limiter := NewRateLimiter(1000, 1, 1000, 10)
+		limiter.OnThrottled(100*time.Millisecond, 1000)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Error(t, limiter.Wait(ctx))
+
+		start := time.Now()
+		assert.NoError(t, limiter.Wait(context.Background()))
+		assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	})
+}
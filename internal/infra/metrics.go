@@ -0,0 +1,42 @@
+package infra
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// metrics are published once per process, so every App and WorkerPool
+// created in it reports to the same map
+var metrics = expvar.NewMap("gophermart")
+
+// responses counts responses by method, route pattern and status
+var responses = new(expvar.Map).Init()
+
+func init() {
+	metrics.Set("http_responses", responses)
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	wrapWrite(w, []byte(metrics.String()))
+}
+
+func countResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		pattern := chi.RouteContext(r.Context()).RoutePattern()
+		if pattern == "" {
+			return
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		responses.Add(fmt.Sprintf("%s %s %d", r.Method, pattern, status), 1)
+	})
+}
@@ -0,0 +1,283 @@
+package infra
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// openAPIDocument describes every route of the API, requests are validated
+// against schemas of their bodies before handlers run
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+var openAPI = mustParseOpenAPI(openAPIDocument)
+
+type securityRequirements = []map[string][]string
+
+// openAPISpec is the part of the document requests are validated with
+type openAPISpec struct {
+	Security   securityRequirements                    `json:"security"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Security    *securityRequirements      `json:"security"`
+	RequestBody *openAPIRequestBody        `json:"requestBody"`
+	Responses   map[string]json.RawMessage `json:"responses"`
+}
+
+type openAPIRequestBody struct {
+	Required bool `json:"required"`
+	Content  map[string]struct {
+		Schema *openAPISchema `json:"schema"`
+	} `json:"content"`
+}
+
+// openAPISchema supports the subset of JSON Schema request bodies are
+// described with
+type openAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       schemaTypes               `json:"type"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Required   []string                  `json:"required"`
+	Items      *openAPISchema            `json:"items"`
+	AllOf      []*openAPISchema          `json:"allOf"`
+	Enum       []string                  `json:"enum"`
+	MinLength  *int                      `json:"minLength"`
+	MaxLength  *int                      `json:"maxLength"`
+	MinItems   *int                      `json:"minItems"`
+}
+
+// schemaTypes are types a value may be of, the document lists either one
+// or several
+type schemaTypes []string
+
+func (types *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*types = schemaTypes{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(types))
+}
+
+func mustParseOpenAPI(document []byte) *openAPISpec {
+	spec := new(openAPISpec)
+	err := json.Unmarshal(document, spec)
+	if err != nil {
+		panic(fmt.Sprintf("malformed OpenAPI document: %v", err))
+	}
+	return spec
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	wrapWrite(w, openAPIDocument)
+}
+
+func (spec *openAPISpec) operation(method string, pattern string) *openAPIOperation {
+	return spec.Paths[pattern][strings.ToLower(method)]
+}
+
+// validateRequest checks the body of the request against the schema of its
+// route. Requests which are not authorized to call the route are left for
+// the handler to reject, so that clients learn about that first.
+func (app *App) validateRequest(r *http.Request) error {
+	pattern := chi.RouteContext(r.Context()).RoutePattern()
+	op := openAPI.operation(r.Method, pattern)
+	if op == nil || op.RequestBody == nil || !openAPI.authorized(op, r) {
+		return nil
+	}
+	content, ok := op.RequestBody.Content["application/json"]
+	if !ok || content.Schema == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, "request body is required")
+		}
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	err = decoder.Decode(&value)
+	if err != nil {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+
+	err = openAPI.validate(content.Schema, value, "request body")
+	if err != nil {
+		return newProblem(http.StatusBadRequest, MALFORMED_REQUEST, err.Error())
+	}
+	return nil
+}
+
+// authorized tells whether the request carries credentials the operation
+// requires, requests signed by the accrual system are verified by the handler
+// only
+func (spec *openAPISpec) authorized(op *openAPIOperation, r *http.Request) bool {
+	security := spec.Security
+	if op.Security != nil {
+		security = *op.Security
+	}
+	if len(security) == 0 {
+		return true
+	}
+	for _, requirement := range security {
+		if _, ok := requirement["bearerAuth"]; ok && currentUser(r) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec *openAPISpec) resolve(schema *openAPISchema) *openAPISchema {
+	for schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		resolved, ok := spec.Components.Schemas[name]
+		if !ok {
+			panic(fmt.Sprintf("unknown schema %s", schema.Ref))
+		}
+		schema = resolved
+	}
+	return schema
+}
+
+func (spec *openAPISpec) validate(schema *openAPISchema, value interface{}, path string) error {
+	schema = spec.resolve(schema)
+
+	for _, sub := range schema.AllOf {
+		err := spec.validate(sub, value, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(schema.Type) > 0 && !schema.Type.match(value) {
+		return fmt.Errorf("%s: should be %s", path, strings.Join(schema.Type, " or "))
+	}
+
+	switch value := value.(type) {
+	case string:
+		if len(schema.Enum) > 0 && !contains(schema.Enum, value) {
+			return fmt.Errorf("%s: should be one of %s", path, strings.Join(schema.Enum, ", "))
+		}
+		length := utf8.RuneCountInString(value)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s: should be at least %d characters long", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s: should be at most %d characters long", path, *schema.MaxLength)
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			return fmt.Errorf("%s: should have at least %d items", path, *schema.MinItems)
+		}
+		if schema.Items != nil {
+			for i, item := range value {
+				err := spec.validate(schema.Items, item, fmt.Sprintf("%s[%d]", path, i))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				return fmt.Errorf("%s: is required", spec.join(path, name))
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			field, ok := value[name]
+			if !ok {
+				continue
+			}
+			err := spec.validate(schema.Properties[name], field, spec.join(path, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// join names the field of the value at path, fields of the body itself are
+// named as they are
+func (spec *openAPISpec) join(path string, name string) string {
+	if path == "request body" {
+		return name
+	}
+	return path + "." + name
+}
+
+func (types schemaTypes) match(value interface{}) bool {
+	for _, t := range types {
+		switch value := value.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if _, err := value.Int64(); err == nil && t == "integer" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
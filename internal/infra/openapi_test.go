@@ -0,0 +1,215 @@
+package infra
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/notify"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain fails the run if any test got a response the document does not
+// describe
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	var undocumented []string
+	responses.Do(func(kv expvar.KeyValue) {
+		parts := strings.SplitN(kv.Key, " ", 3)
+		method, pattern, status := parts[0], parts[1], parts[2]
+		if status == strconv.Itoa(http.StatusMethodNotAllowed) {
+			return
+		}
+		op := openAPI.operation(method, pattern)
+		if op == nil {
+			undocumented = append(undocumented, kv.Key)
+			return
+		}
+		if _, ok := op.Responses[status]; !ok {
+			undocumented = append(undocumented, kv.Key)
+		}
+	})
+	if len(undocumented) > 0 {
+		fmt.Printf("Responses missing from openapi.json:\n\t%s\n", strings.Join(undocumented, "\n\t"))
+		if code == 0 {
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "outbox")
+	app := NewApp(
+		storage.NewMemStorage(),
+		WithNotifier(notify.NewFileNotifier(path)),
+		WithAccrualCallback("secret", time.Hour),
+	)
+
+	routed := make(map[string]bool)
+	err := chi.Walk(app.Router, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routed[method+" "+route] = true
+		assert.NotNil(openAPI.operation(method, route), "%s %s is not documented", method, route)
+		return nil
+	})
+	assert.NoError(err)
+
+	for route, operations := range openAPI.Paths {
+		for method, op := range operations {
+			method = strings.ToUpper(method)
+			assert.True(routed[method+" "+route], "%s %s is not routed", method, route)
+			assert.NotEmpty(op.OperationID, "%s %s has no operationId", method, route)
+			assert.NotEmpty(op.Responses, "%s %s has no responses", method, route)
+		}
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	_, server := app(t)
+	defer server.Close()
+
+	res, err := http.Get(fmt.Sprintf("%s/api/openapi.json", server.URL))
+	if !assert.NoError(err) {
+		return
+	}
+	defer res.Body.Close()
+
+	assert.Equal(http.StatusOK, res.StatusCode)
+	assert.Equal("application/json", res.Header.Get("Content-Type"))
+
+	var document map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&document)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("3.1.0", document["openapi"])
+}
+
+func TestRequestValidation(t *testing.T) {
+	t.Parallel()
+
+	app, server := app(t)
+	defer server.Close()
+	_, authorizationAlice := alice(t, app)
+
+	client := http.Client{}
+
+	type testCase struct {
+		name           string
+		method         string
+		endpoint       string
+		auth           string
+		body           string
+		expectedStatus int
+		expectedDetail string
+	}
+
+	var testCases = []testCase{
+		{"Wrong type", http.MethodPost, "/api/user/register", "", `{"login": 42, "password": "sikret"}`, http.StatusBadRequest, "login: should be string"},
+		{"Missing field", http.MethodPost, "/api/user/register", "", `{"login": "carol"}`, http.StatusBadRequest, "password: is required"},
+		{"Empty field", http.MethodPost, "/api/user/login", "", `{"login": "", "password": "sikret"}`, http.StatusBadRequest, "login: should be at least 1 characters long"},
+		{"Not an object", http.MethodPost, "/api/user/token/refresh", "", `["token"]`, http.StatusBadRequest, "request body: should be object"},
+		{"Missing body", http.MethodPost, "/api/user/register", "", ``, http.StatusBadRequest, "request body is required"},
+		{"Unknown scope", http.MethodPost, "/api/user/api-keys", authorizationAlice, `{"name": "ci", "scopes": ["orders:read", "orders:delete"]}`, http.StatusBadRequest, "scopes[1]: should be one of orders:read, orders:write, balance:read, withdrawals:read, withdrawals:write"},
+		{"Name too long", http.MethodPost, "/api/user/api-keys", authorizationAlice, fmt.Sprintf(`{"name": "%s", "scopes": ["orders:read"]}`, strings.Repeat("k", 101)), http.StatusBadRequest, "name: should be at most 100 characters long"},
+		{"Sum of wrong type", http.MethodPost, "/api/user/balance/withdraw", authorizationAlice, `{"order": "2377225624", "sum": true}`, http.StatusBadRequest, "sum: should be number or string"},
+		{"Sum as string", http.MethodPost, "/api/user/balance/withdraw", authorizationAlice, `{"order": "2377225624", "sum": "4.2"}`, http.StatusOK, ""},
+		{"Unauthorized first", http.MethodPost, "/api/user/balance/withdraw", "", `{"sum": true}`, http.StatusUnauthorized, ""},
+	}
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			req, err := http.NewRequest(tCase.method, fmt.Sprintf("%s%s", server.URL, tCase.endpoint), strings.NewReader(tCase.body))
+			if !assert.NoError(err) {
+				return
+			}
+			req.Header.Set("Authorization", tCase.auth)
+
+			res, err := client.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(tCase.expectedStatus, res.StatusCode)
+			if tCase.expectedDetail == "" {
+				return
+			}
+			var problem Problem
+			err = json.NewDecoder(res.Body).Decode(&problem)
+			if !assert.NoError(err) {
+				return
+			}
+			assert.Equal(MALFORMED_REQUEST, problem.Code)
+			assert.Equal(tCase.expectedDetail, problem.Detail)
+		})
+	}
+}
+
+func TestWithdrawalsRoutes(t *testing.T) {
+	t.Parallel()
+
+	app, server := app(t)
+	defer server.Close()
+	_, authorizationBob := bob(t, app)
+
+	client := http.Client{}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/user/balance/withdraw", server.URL), strings.NewReader(`{"order": "2377225624", "sum": 42}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Set("Authorization", authorizationBob)
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	for _, endpoint := range []string{"/api/user/balance/withdrawals", "/api/user/withdrawals"} {
+		endpoint := endpoint
+		t.Run(endpoint, func(t *testing.T) {
+			assert := assert.New(t)
+			req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s", server.URL, endpoint), nil)
+			if !assert.NoError(err) {
+				return
+			}
+			req.Header.Set("Authorization", authorizationBob)
+
+			res, err := client.Do(req)
+			if !assert.NoError(err) {
+				return
+			}
+			defer res.Body.Close()
+
+			assert.Equal(http.StatusOK, res.StatusCode)
+			var withdrawals []map[string]interface{}
+			err = json.NewDecoder(res.Body).Decode(&withdrawals)
+			if !assert.NoError(err) {
+				return
+			}
+			if assert.Len(withdrawals, 1) {
+				assert.Equal("2377225624", withdrawals[0]["order"])
+			}
+		})
+	}
+}
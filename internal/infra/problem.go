@@ -0,0 +1,185 @@
+package infra
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// ProblemCode tells clients what went wrong, unlike titles and details codes
+// never change
+type ProblemCode = string
+
+const (
+	INTERNAL_ERROR                 = "internal_error"
+	SERVICE_BUSY                   = "service_busy"
+	MALFORMED_REQUEST              = "malformed_request"
+	INVALID_QUERY                  = "invalid_query"
+	UNAUTHORIZED                   = "unauthorized"
+	INVALID_CREDENTIALS            = "invalid_credentials"
+	INVALID_SECOND_FACTOR          = "invalid_second_factor"
+	INVALID_TOKEN                  = "invalid_token"
+	INVALID_SIGNATURE              = "invalid_signature"
+	TOO_MANY_ATTEMPTS              = "too_many_attempts"
+	FORBIDDEN                      = "forbidden"
+	INSUFFICIENT_SCOPE             = "insufficient_scope"
+	ACCOUNT_DISABLED               = "account_disabled"
+	NOT_FOUND                      = "not_found"
+	METHOD_NOT_ALLOWED             = "method_not_allowed"
+	LOGIN_TAKEN                    = "login_taken"
+	TWO_FACTOR_NOT_ENROLLED        = "two_factor_not_enrolled"
+	TWO_FACTOR_ENABLED             = "two_factor_enabled"
+	INVALID_SCOPE                  = "invalid_scope"
+	INVALID_ADJUSTMENT             = "invalid_adjustment"
+	INVALID_ORDER_NUMBER           = "invalid_order_number"
+	ORDER_UPLOADED_BY_ANOTHER_USER = "order_uploaded_by_another_user"
+	ORDER_NUMBER_USED              = "order_number_used"
+	BALANCE_EXCEEDED               = "balance_exceeded"
+	CANNOT_DISABLE_SELF            = "cannot_disable_self"
+	INVALID_IDEMPOTENCY_KEY        = "invalid_idempotency_key"
+	IDEMPOTENCY_KEY_IN_USE         = "idempotency_key_in_use"
+	IDEMPOTENCY_KEY_REUSED         = "idempotency_key_reused"
+	JOB_LEASED                     = "job_leased"
+)
+
+var problemTitles = map[ProblemCode]string{
+	INTERNAL_ERROR:                 "Internal server error",
+	SERVICE_BUSY:                   "The service is busy, retry later",
+	MALFORMED_REQUEST:              "The request body is malformed",
+	INVALID_QUERY:                  "The query parameters are invalid",
+	UNAUTHORIZED:                   "Authentication is required",
+	INVALID_CREDENTIALS:            "The login or password is wrong",
+	INVALID_SECOND_FACTOR:          "The one-time or recovery code is wrong",
+	INVALID_TOKEN:                  "The token is invalid or expired",
+	INVALID_SIGNATURE:              "The request signature is invalid",
+	TOO_MANY_ATTEMPTS:              "Too many failed attempts, retry later",
+	FORBIDDEN:                      "You are not allowed to do this",
+	INSUFFICIENT_SCOPE:             "The API key is not granted the scope needed",
+	ACCOUNT_DISABLED:               "The account is disabled",
+	NOT_FOUND:                      "Not found",
+	METHOD_NOT_ALLOWED:             "The method is not allowed",
+	LOGIN_TAKEN:                    "The login is taken already",
+	TWO_FACTOR_NOT_ENROLLED:        "Two-factor authentication is not enrolled",
+	TWO_FACTOR_ENABLED:             "Two-factor authentication is enabled already",
+	INVALID_SCOPE:                  "The scope is unknown",
+	INVALID_ADJUSTMENT:             "The adjustment is invalid",
+	INVALID_ORDER_NUMBER:           "The order number is invalid",
+	ORDER_UPLOADED_BY_ANOTHER_USER: "The order has been uploaded by another user",
+	ORDER_NUMBER_USED:              "The order number has been used already",
+	BALANCE_EXCEEDED:               "The balance is not sufficient",
+	CANNOT_DISABLE_SELF:            "You cannot disable your own account",
+	INVALID_IDEMPOTENCY_KEY:        "The idempotency key is invalid",
+	IDEMPOTENCY_KEY_IN_USE:         "The request with this idempotency key is still being processed",
+	IDEMPOTENCY_KEY_REUSED:         "The idempotency key has been used for another request",
+	JOB_LEASED:                     "The order is being processed by a worker, retry later",
+}
+
+// Problem is an error response in RFC 7807 format. Handlers return problems
+// to respond with them, other errors are mapped with problemFor.
+type Problem struct {
+	Type      string      `json:"type"`
+	Title     string      `json:"title"`
+	Status    int         `json:"status"`
+	Code      ProblemCode `json:"code"`
+	Detail    string      `json:"detail,omitempty"`
+	Instance  string      `json:"instance,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+
+	retryAfter time.Duration
+}
+
+func newProblem(status int, code ProblemCode, detail string) *Problem {
+	return &Problem{
+		Type:   "urn:gophermart:problem:" + code,
+		Title:  problemTitles[code],
+		Status: status,
+		Code:   code,
+		Detail: detail,
+	}
+}
+
+// retryLater is the problem telling the client to retry after delay, which
+// is rounded up to whole seconds
+func retryLater(status int, code ProblemCode, delay time.Duration) *Problem {
+	if delay < time.Second {
+		delay = time.Second
+	}
+	problem := newProblem(status, code, "")
+	problem.retryAfter = delay
+	return problem
+}
+
+func (problem *Problem) Error() string {
+	if problem.Detail == "" {
+		return problem.Title
+	}
+	return problem.Title + ": " + problem.Detail
+}
+
+// problemFor maps errors to the problems clients get for them unless the
+// handler responds otherwise, errors it does not know are internal
+func problemFor(err error) *Problem {
+	switch err := err.(type) {
+	case *Problem:
+		return err
+	case *ErrHashingBusy:
+		return retryLater(http.StatusServiceUnavailable, SERVICE_BUSY, time.Second)
+	case *core.ErrInvalidOrder:
+		return newProblem(http.StatusUnprocessableEntity, INVALID_ORDER_NUMBER, err.Error())
+	case *core.ErrInvalidScope:
+		return newProblem(http.StatusBadRequest, INVALID_SCOPE, err.Error())
+	case *core.ErrInvalidAdjustment:
+		return newProblem(http.StatusBadRequest, INVALID_ADJUSTMENT, err.Error())
+	case *core.ErrInvalidIdempotencyKey:
+		return newProblem(http.StatusBadRequest, INVALID_IDEMPOTENCY_KEY, "")
+	case *storage.ErrBalanceExceeded:
+		return newProblem(http.StatusPaymentRequired, BALANCE_EXCEEDED, "")
+	case *storage.ErrOrderIDCollission:
+		return newProblem(http.StatusConflict, ORDER_UPLOADED_BY_ANOTHER_USER, "")
+	case *storage.ErrConflictingUserLogin:
+		return newProblem(http.StatusConflict, LOGIN_TAKEN, "")
+	case *storage.ErrTwoFactorNotFound:
+		return newProblem(http.StatusNotFound, TWO_FACTOR_NOT_ENROLLED, "")
+	case *storage.ErrTwoFactorEnabled:
+		return newProblem(http.StatusConflict, TWO_FACTOR_ENABLED, "")
+	case *storage.ErrJobLeased:
+		return newProblem(http.StatusConflict, JOB_LEASED, "")
+	case *storage.ErrIdempotencyKeyExists:
+		return newProblem(http.StatusConflict, IDEMPOTENCY_KEY_IN_USE, "")
+	case *storage.ErrOrderNotFound, *storage.ErrAPIKeyNotFound, *storage.ErrJobNotFound:
+		return newProblem(http.StatusNotFound, NOT_FOUND, "")
+	default:
+		log.Printf("Unhandled error: %v", err)
+		return newProblem(http.StatusInternalServerError, INTERNAL_ERROR, "")
+	}
+}
+
+// writeError responds with the problem err is mapped to
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := *problemFor(err)
+	problem.Instance = r.URL.Path
+	problem.RequestID = middleware.GetReqID(r.Context())
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		log.Printf("Error while marshalling problem: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	if problem.retryAfter != 0 {
+		seconds := int((problem.retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.WriteHeader(problem.Status)
+	wrapWrite(w, body)
+}
@@ -0,0 +1,77 @@
+package infra
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemFor(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name           string
+		err            error
+		expectedStatus int
+		expectedCode   ProblemCode
+	}
+
+	var testCases = []testCase{
+		{"Balance exceeded", &storage.ErrBalanceExceeded{}, http.StatusPaymentRequired, BALANCE_EXCEEDED},
+		{"Invalid order", &core.ErrInvalidOrder{}, http.StatusUnprocessableEntity, INVALID_ORDER_NUMBER},
+		{"Order of another user", &storage.ErrOrderIDCollission{}, http.StatusConflict, ORDER_UPLOADED_BY_ANOTHER_USER},
+		{"Login taken", &storage.ErrConflictingUserLogin{}, http.StatusConflict, LOGIN_TAKEN},
+		{"Order not found", &storage.ErrOrderNotFound{}, http.StatusNotFound, NOT_FOUND},
+		{"Hashing busy", &ErrHashingBusy{}, http.StatusServiceUnavailable, SERVICE_BUSY},
+		{"Problem", newProblem(http.StatusConflict, CANNOT_DISABLE_SELF, ""), http.StatusConflict, CANNOT_DISABLE_SELF},
+		{"Unknown error", errors.New("connection refused"), http.StatusInternalServerError, INTERNAL_ERROR},
+	}
+
+	for _, tCase := range testCases {
+		tCase := tCase
+		t.Run(tCase.name, func(t *testing.T) {
+			assert := assert.New(t)
+			problem := problemFor(tCase.err)
+			assert.Equal(tCase.expectedStatus, problem.Status)
+			assert.Equal(tCase.expectedCode, problem.Code)
+			assert.NotEmpty(problem.Title)
+			assert.Equal("urn:gophermart:problem:"+tCase.expectedCode, problem.Type)
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Internal errors are not disclosed", func(t *testing.T) {
+		assert := assert.New(t)
+		w := httptest.NewRecorder()
+		writeError(w, httptest.NewRequest(http.MethodGet, "/api/user/balance", nil), errors.New("pq: password authentication failed"))
+
+		assert.Equal(http.StatusInternalServerError, w.Code)
+		assert.Equal(ProblemContentType, w.Header().Get("Content-Type"))
+		assert.NotContains(w.Body.String(), "pq:")
+
+		var problem Problem
+		if assert.NoError(json.Unmarshal(w.Body.Bytes(), &problem)) {
+			assert.Equal(INTERNAL_ERROR, problem.Code)
+			assert.Equal("/api/user/balance", problem.Instance)
+		}
+	})
+
+	t.Run("Retry delay is rounded up", func(t *testing.T) {
+		assert := assert.New(t)
+		w := httptest.NewRecorder()
+		writeError(w, httptest.NewRequest(http.MethodPost, "/api/user/login", nil), retryLater(http.StatusTooManyRequests, TOO_MANY_ATTEMPTS, 1500*time.Millisecond))
+
+		assert.Equal(http.StatusTooManyRequests, w.Code)
+		assert.Equal("2", w.Header().Get("Retry-After"))
+	})
+}
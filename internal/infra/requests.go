@@ -1,6 +1,9 @@
 package infra
 
-import "github.com/shopspring/decimal"
+import (
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/shopspring/decimal"
+)
 
 type userRegisterRequest struct {
 	Login    string `json:"login"`
@@ -9,6 +12,51 @@ type userRegisterRequest struct {
 
 type userLoginRequest userRegisterRequest
 
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type passwordChangeRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type passwordResetRequest struct {
+	Login string `json:"login"`
+}
+
+type passwordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type twoFactorEnableRequest struct {
+	Code string `json:"code"`
+}
+
+type twoFactorDisableRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type twoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type apiKeyRequest struct {
+	Name   string       `json:"name"`
+	Scopes []core.Scope `json:"scopes"`
+}
+
+type adjustmentRequest struct {
+	Amount decimal.Decimal       `json:"amount"`
+	Reason core.AdjustmentReason `json:"reason"`
+	Note   string                `json:"note"`
+}
+
 type WithdrawalRequest struct {
 	Order string          `json:"order"`
 	Sum   decimal.Decimal `json:"sum"`
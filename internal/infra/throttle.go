@@ -0,0 +1,150 @@
+package infra
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+// password hashing requests give up after waiting for a free slot that long
+const DefaultHashQueueTimeout = 5 * time.Second
+
+type ErrHashingBusy struct {
+	waited time.Duration
+}
+
+func (err *ErrHashingBusy) Error() string {
+	return fmt.Sprintf("no password hashing slot got free in %s", err.waited)
+}
+
+// hash runs fn, which hashes a password, once a hashing slot is free. Every
+// hash takes tens of megabytes of memory, so only a few may be computed at
+// once whatever the number of requests.
+func (app *App) hash(ctx context.Context, fn func() error) error {
+	timer := time.NewTimer(app.hashTimeout)
+	defer timer.Stop()
+
+	select {
+	case app.hashing <- struct{}{}:
+	case <-timer.C:
+		metrics.Add("password_hash_rejected_total", 1)
+		return &ErrHashingBusy{app.hashTimeout}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-app.hashing
+	}()
+
+	return fn()
+}
+
+// throttledKey is a key failed attempts are counted under, along with the
+// policy they are throttled with
+type throttledKey struct {
+	key    string
+	policy core.ThrottlePolicy
+}
+
+// loginKeys are keys password attempts as login from ip are throttled by
+func (app *App) loginKeys(login string, ip string) []throttledKey {
+	return []throttledKey{
+		{core.LoginKey(login), app.loginThrottle},
+		{core.AddressKey(ip), app.addressThrottle},
+	}
+}
+
+// twoFactorKeys are keys second factor attempts of user from ip are
+// throttled by, password attempts do not count towards them
+func (app *App) twoFactorKeys(user *core.User, ip string) []throttledKey {
+	return []throttledKey{
+		{core.TwoFactorKey(user.ID), app.loginThrottle},
+		{core.AddressKey(ip), app.addressThrottle},
+	}
+}
+
+// blockedUntil returns the moment attempts throttled by keys are allowed
+// again, it is not after now if they are allowed already
+func (app *App) blockedUntil(store storage.Storage, keys []throttledKey, now time.Time) (time.Time, error) {
+	until := now
+	for _, k := range keys {
+		attempts, err := store.ExtractLoginAttempts(k.key)
+		if err != nil {
+			return now, err
+		}
+		blocked := k.policy.BlockedUntil(attempts, now)
+		if blocked.After(until) {
+			until = blocked
+		}
+	}
+	return until, nil
+}
+
+// attemptFailed counts a failed attempt under keys and audits it, lockouts
+// are audited as eventType. User is nil if the login does not belong to
+// anybody. Failures are counted whether or not the audit log is available,
+// otherwise guesses would go unthrottled while it is down.
+func (app *App) attemptFailed(ctx context.Context, store storage.Storage, keys []throttledKey, eventType core.AuditEventType, user *core.User, login string, now time.Time) error {
+	metrics.Add("login_failures_total", 1)
+
+	var lockouts []map[string]string
+	for _, k := range keys {
+		attempts, err := store.RecordLoginFailure(k.key, now, k.policy.Window)
+		if err != nil {
+			return err
+		}
+		if !k.policy.LocksOut(attempts.Failures) {
+			continue
+		}
+
+		until := now.Add(k.policy.LockoutPeriod)
+		log.Printf("Locked out logins by %s after %d failures until %s", k.key, attempts.Failures, until)
+		metrics.Add("login_lockouts_total", 1)
+		lockouts = append(lockouts, map[string]string{
+			"key":          k.key,
+			"failures":     strconv.Itoa(attempts.Failures),
+			"locked_until": until.Format(time.RFC3339),
+		})
+	}
+
+	step := "password"
+	if eventType == core.TWO_FACTOR_LOCKED {
+		step = "second_factor"
+	}
+	app.auditAttempt(ctx, core.LOGIN_FAILED, user, login, now, map[string]string{"step": step})
+	for _, details := range lockouts {
+		app.auditAttempt(ctx, eventType, user, login, now, details)
+	}
+
+	return nil
+}
+
+// auditAttempt records an event about an attempt to log in as login, the
+// attempt has been counted already, so failing to record it is only logged
+func (app *App) auditAttempt(ctx context.Context, eventType core.AuditEventType, user *core.User, login string, now time.Time, details map[string]string) {
+	event, err := core.NewAuditEvent(eventType, now)
+	if err != nil {
+		auditFailed(eventType, err)
+		return
+	}
+	if user != nil {
+		event.UserID = user.ID
+	}
+	event.Login = login
+	for key, value := range details {
+		event.Details[key] = value
+	}
+	recordAuditEvent(ctx, app.auditLog, event)
+}
+
+// attemptSucceeded forgets failures counted under the first of keys, failures
+// from the address are kept, otherwise an attacker could reset them with an
+// account of their own
+func (app *App) attemptSucceeded(store storage.Storage, keys []throttledKey) error {
+	return store.ResetLoginAttempts(keys[0].key)
+}
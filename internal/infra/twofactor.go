@@ -0,0 +1,44 @@
+package infra
+
+import (
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+)
+
+// verifySecondFactor accepts either a TOTP code or a recovery code, each of
+// them is accepted only once
+func (app *App) verifySecondFactor(store storage.Storage, twoFactor *core.TwoFactor, code string, recoveryCode string, now time.Time) (bool, error) {
+	if code != "" {
+		counter, valid := twoFactor.Validate(code, now)
+		if !valid {
+			return false, nil
+		}
+
+		err := store.UseTOTPCounter(twoFactor.UserID, counter)
+		switch err.(type) {
+		case nil:
+			return true, nil
+		case *storage.ErrTOTPCodeReused:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if recoveryCode != "" {
+		err := store.UseRecoveryCode(twoFactor.UserID, core.HashRecoveryCode(recoveryCode))
+		switch err.(type) {
+		case nil:
+			metrics.Add("recovery_codes_used_total", 1)
+			return true, nil
+		case *storage.ErrRecoveryCodeNotFound:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return false, nil
+}
@@ -1,28 +1,156 @@
 package infra
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/devsagul/gophemart/internal/audit"
 	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/google/uuid"
 )
 
 func auth(w http.ResponseWriter, r *http.Request) *core.User {
-	ctx := r.Context()
-	rawUser := ctx.Value(UserKey)
-	user, ok := rawUser.(*core.User)
-	if !ok {
-		user = nil
-	}
+	user := currentUser(r)
 	if user == nil {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeError(w, r, newProblem(http.StatusUnauthorized, UNAUTHORIZED, ""))
 	}
 	return user
 }
 
+// currentUser returns the user the request is authenticated as, nil for
+// anonymous requests
+func currentUser(r *http.Request) *core.User {
+	user, ok := r.Context().Value(UserKey).(*core.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// session returns id of the session request's access token was issued for,
+// uuid.Nil for tokens issued before sessions were introduced
+func session(r *http.Request) uuid.UUID {
+	sessionID, ok := r.Context().Value(SessionKey).(uuid.UUID)
+	if !ok {
+		return uuid.Nil
+	}
+	return sessionID
+}
+
+// clientIP returns address the request came from, proxies in front of the
+// server are not trusted to report the original one
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordAudit records the event of an action which has been committed
+// already, failing to record it does not fail the action
+func recordAudit(ctx context.Context, auditLog *audit.Log, eventType core.AuditEventType, user *core.User, details map[string]string) {
+	err := auditLog.Record(ctx, eventType, user, details)
+	if err != nil {
+		auditFailed(eventType, err)
+	}
+}
+
+// recordAuditEvent is recordAudit for events the caller has built
+func recordAuditEvent(ctx context.Context, auditLog *audit.Log, event *core.AuditEvent) {
+	err := auditLog.RecordEvent(ctx, event)
+	if err != nil {
+		auditFailed(event.Type, err)
+	}
+}
+
+func auditFailed(eventType core.AuditEventType, err error) {
+	metrics.Add("audit_failures_total", 1)
+	log.Printf("Error while recording %s audit event: %v", eventType, err)
+}
+
 func wrapWrite(w http.ResponseWriter, body []byte) {
 	_, err := w.Write(body)
 	if err != nil {
 		log.Printf("Error while writing response: %v", err)
 	}
 }
+
+func parsePagination(r *http.Request, defaultLimit int, maxLimit int) (limit int, offset int, err error) {
+	limit = defaultLimit
+	query := r.URL.Query()
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil {
+			return 0, 0, err
+		}
+		if limit <= 0 || limit > maxLimit {
+			return 0, 0, fmt.Errorf("limit should be between 1 and %d, got %d", maxLimit, limit)
+		}
+	}
+
+	if raw := query.Get("offset"); raw != "" {
+		offset, err = strconv.Atoi(raw)
+		if err != nil {
+			return 0, 0, err
+		}
+		if offset < 0 {
+			return 0, 0, fmt.Errorf("offset should not be negative, got %d", offset)
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// parsePage reads the page of a listing from the query: limit, cursor
+// returned with the previous page, RFC 3339 time range [from, to) and sort
+// direction, asc or desc
+func parsePage(r *http.Request, defaultLimit int, maxLimit int) (storage.Page, error) {
+	var page storage.Page
+	var err error
+	query := r.URL.Query()
+
+	page.Limit, _, err = parsePagination(r, defaultLimit, maxLimit)
+	if err != nil {
+		return page, err
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		page.After, err = core.ParseCursor(raw)
+		if err != nil {
+			return page, err
+		}
+	}
+	if raw := query.Get("from"); raw != "" {
+		page.From, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return page, err
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		page.To, err = time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return page, err
+		}
+	}
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return page, fmt.Errorf("sort should be asc or desc, got %s", query.Get("sort"))
+	}
+	return page, nil
+}
+
+// nextCursor sets the header clients fetch the next page with, provided
+// there is one
+func nextCursor(w http.ResponseWriter, cursor core.Cursor) {
+	w.Header().Set(NextCursorHeader, cursor.Encode())
+}
@@ -1,88 +1,252 @@
 package infra
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
-	"path"
-	"strconv"
+	"sync"
 	"time"
 
+	"github.com/devsagul/gophemart/internal/accrual"
+	"github.com/devsagul/gophemart/internal/audit"
 	"github.com/devsagul/gophemart/internal/core"
 	"github.com/devsagul/gophemart/internal/storage"
-	"github.com/shopspring/decimal"
 )
 
-type orderResponse struct {
-	Order   string           `json:"order"`
-	Status  string           `json:"status"`
-	Accrual *decimal.Decimal `json:"accrual"`
-}
+const JobLeasePeriod = 2 * time.Minute
+const JobRecheckInterval = 30 * time.Second
+const IdlePollInterval = time.Second
 
-func Worker(
-	orders <-chan *core.Order,
-	apiAddress string,
-	store storage.Storage,
-) error {
-	originalAPIURL, err := url.Parse(apiAddress)
+// auditAccrual records final statuses applied to orders, intermediate ones
+// are polled too often to keep them all
+func auditAccrual(ctx context.Context, auditLog *audit.Log, orderID string, data *accrual.Response, source string) {
+	if data.Status != core.PROCESSED && data.Status != core.INVALID {
+		return
+	}
 
-	if err != nil {
+	details := map[string]string{
+		"order":  orderID,
+		"status": data.Status,
+		"source": source,
+	}
+	if data.Accrual != nil {
+		details["accrual"] = data.Accrual.String()
+	}
+	recordAudit(ctx, auditLog, core.ACCRUAL_APPLIED, nil, details)
+}
+
+func applyAccrual(ctx context.Context, store storage.Storage, auditLog *audit.Log, job *core.AccrualJob, owner string, data *accrual.Response) error {
+	err := store.ProcessAccrual(job.OrderID, data.Status, data.Accrual)
+	if _, ok := err.(*storage.ErrOrderAlreadyProcessed); ok {
+		// final status has already been pushed by the accrual system
+		err = store.CompleteJob(job.OrderID, owner)
+		if _, ok := err.(*storage.ErrJobLeaseLost); ok {
+			return nil
+		}
 		return err
 	}
+	if err != nil {
+		return fmt.Errorf("error while processing accrual in db: %w", err)
+	}
 
-	for order := range orders {
-		apiURL := *originalAPIURL
+	auditAccrual(ctx, auditLog, job.OrderID, data, "poll")
 
-		apiURL.Path = path.Join(originalAPIURL.Path, fmt.Sprintf("/api/orders/%s", order.ID))
-		resp, err := http.Get(apiURL.String())
-		if err != nil {
-			log.Printf("Error during orders processing: %v", err)
-			continue
+	if data.Status == core.PROCESSED || data.Status == core.INVALID {
+		return store.CompleteJob(job.OrderID, owner)
+	}
+
+	return store.RescheduleJob(job.OrderID, owner, time.Now().Add(JobRecheckInterval))
+}
+
+type WorkerPool struct {
+	store   storage.Storage
+	client  accrual.Client
+	owner   string
+	size    int
+	lease   time.Duration
+	limiter *RateLimiter
+	retry   core.RetryPolicy
+	breaker *CircuitBreaker
+	audit   *audit.Log
+}
+
+// NewWorkerPool creates a pool of size workers, which share limiter for
+// requests to the accrual system through client. Several pools, possibly in
+// different processes, may share the same storage as long as their owners
+// differ.
+func NewWorkerPool(store storage.Storage, client accrual.Client, owner string, size int, limiter *RateLimiter, retry core.RetryPolicy, breaker *CircuitBreaker) (*WorkerPool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("worker pool size should be positive, got %d", size)
+	}
+
+	pool := new(WorkerPool)
+	pool.store = store
+	pool.client = client
+	pool.owner = owner
+	pool.size = size
+	pool.lease = JobLeasePeriod
+	pool.limiter = limiter
+	pool.retry = retry
+	pool.breaker = breaker
+	pool.audit = audit.NewLog(store)
+	return pool, nil
+}
+
+// work processes jobs it is handed, it tells it is ready for the next one
+// through ready
+func (pool *WorkerPool) work(ctx context.Context, ready chan<- struct{}, jobs <-chan *core.AccrualJob) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ready <- struct{}{}:
 		}
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("Error while reading accrual system's response: %v", err)
-			continue
+		job, ok := <-jobs
+		if !ok {
+			return
 		}
+		pool.process(ctx, job)
+	}
+}
 
-		err = resp.Body.Close()
+// process requests accrual of the job, the request has been allowed by the
+// limiter already
+func (pool *WorkerPool) process(ctx context.Context, job *core.AccrualJob) {
+	err := pool.breaker.Allow()
+	if circuitOpen, ok := err.(*ErrCircuitOpen); ok {
+		err = pool.store.RescheduleJob(job.OrderID, pool.owner, circuitOpen.retryAt)
 		if err != nil {
-			log.Printf("Could not close response body: %v", err)
-			continue
+			log.Printf("Error while rescheduling accrual job: %v", err)
 		}
+		return
+	}
 
-		if resp.StatusCode == http.StatusTooManyRequests {
-			retryAfter := resp.Header.Get("Retry-After")
-			retrySeconds, err := strconv.Atoi(retryAfter)
-			if err != nil {
-				log.Printf("Error while processing retrry-after header: %v", err)
-				time.Sleep(time.Minute)
-			}
-			time.Sleep(time.Duration(retrySeconds) * time.Second)
-			continue
+	data, err := pool.client.GetAccrual(ctx, job.OrderID)
+	if _, ok := err.(*accrual.ErrUnavailable); ok {
+		pool.breaker.OnFailure()
+	} else {
+		pool.breaker.OnSuccess()
+	}
+
+	if err == nil {
+		pool.limiter.OnSuccess()
+		err = applyAccrual(ctx, pool.store, pool.audit, job, pool.owner, data)
+		if err == nil {
+			return
 		}
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Accrual system returned non-200 code: %d %s", resp.StatusCode, (body))
-			continue
+	if _, ok := err.(*accrual.ErrNotRegistered); ok {
+		// not a failure, the accrual system may take its time to register
+		// the order
+		pool.limiter.OnSuccess()
+		err = pool.store.RescheduleJob(job.OrderID, pool.owner, time.Now().Add(JobRecheckInterval))
+		if err != nil {
+			log.Printf("Error while rescheduling accrual job: %v", err)
 		}
+		return
+	}
+
+	if tooManyRequests, ok := err.(*accrual.ErrTooManyRequests); ok {
+		pool.limiter.OnThrottled(tooManyRequests.RetryAfter, tooManyRequests.Limit)
+		log.Printf("Accrual system throttled requests, rate is lowered to %.2f rps", pool.limiter.Rate())
 
-		var data orderResponse
-		err = json.Unmarshal(body, &data)
+		err = pool.store.RescheduleJob(job.OrderID, pool.owner, time.Now().Add(tooManyRequests.RetryAfter))
 		if err != nil {
-			log.Printf("Error while unmarshalling accrual system's response: %v", err)
-			continue
+			log.Printf("Error while rescheduling accrual job: %v", err)
 		}
+		return
+	}
+
+	pool.fail(job, err)
+}
+
+func (pool *WorkerPool) fail(job *core.AccrualJob, reason error) {
+	failures := job.Failures + 1
 
-		err = store.ProcessAccrual(data.Order, data.Status, data.Accrual)
+	if pool.retry.Exhausted(failures) {
+		log.Printf("Giving up on order %s after %d failures: %v", job.OrderID, failures, reason)
+		err := pool.store.BuryJob(job.OrderID, pool.owner, reason.Error())
 		if err != nil {
-			log.Printf("Error while processing accrual id db: %v", err)
+			log.Printf("Error while moving accrual job to dead letters: %v", err)
 		}
+		return
+	}
+
+	backoff := pool.retry.Backoff(failures)
+	log.Printf("Error during processing of order %s, retrying in %s: %v", job.OrderID, backoff, reason)
+	err := pool.store.FailJob(job.OrderID, pool.owner, reason.Error(), time.Now().Add(backoff))
+	if err != nil {
+		log.Printf("Error while rescheduling accrual job: %v", err)
+	}
+}
+
+// Run leases accrual jobs from the storage and distributes them between
+// workers until ctx is done. A job is leased only once a worker is ready to
+// take it and the limiter allows a request, so that it does not wait out its
+// lease in a queue.
+func (pool *WorkerPool) Run(ctx context.Context) {
+	ready := make(chan struct{})
+	jobs := make(chan *core.AccrualJob)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < pool.size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.work(ctx, ready, jobs)
+		}()
 	}
 
-	return nil
+	defer wg.Wait()
+	defer close(jobs)
+
+	idle := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(IdlePollInterval):
+			return true
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ready:
+		}
+
+		// the worker keeps waiting for a job until one is leased
+		for {
+			if pool.breaker.State() == BreakerOpen {
+				// jobs would be handed back right away, so there is no point in leasing them
+				if !idle() {
+					return
+				}
+				continue
+			}
+
+			err := pool.limiter.Wait(ctx)
+			if err != nil {
+				return
+			}
+
+			leased, err := pool.store.LeaseJobs(pool.owner, 1, pool.lease)
+			if err != nil {
+				log.Printf("Error while leasing accrual jobs: %v", err)
+				leased = nil
+			}
+			if len(leased) > 0 {
+				jobs <- leased[0]
+				break
+			}
+
+			pool.limiter.Refund()
+			if !idle() {
+				return
+			}
+		}
+	}
 }
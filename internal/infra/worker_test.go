@@ -0,0 +1,251 @@
+package infra
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/accrual"
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/devsagul/gophemart/internal/storage"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorker(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	fake := accrual.NewFake()
+	fake.Script("4561261212345467", accrual.Processed(decimal.New(500, 0)))
+
+	store := storage.NewMemStorage()
+
+	user, err := core.NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateUser(user)
+	if !assert.NoError(err) {
+		return
+	}
+
+	order, err := core.NewOrder("4561261212345467", user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateOrder(order, order.UploadedAt)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool, err := NewWorkerPool(store, fake, "test-worker", 2, NewRateLimiter(100, 1, 100, 1), core.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute, MaxFailures: 3}, NewCircuitBreaker(5, time.Minute))
+	if !assert.NoError(err) {
+		return
+	}
+	go pool.Run(ctx)
+
+	assert.Eventually(func() bool {
+		user, err := store.ExtractUserByID(user.ID)
+		return err == nil && user.Balance.Equal(decimal.New(500, 0))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	jobs, err := store.LeaseJobs("other-worker", 1, JobLeasePeriod)
+	assert.NoError(err)
+	assert.Empty(jobs)
+}
+
+func TestWorkerDeadLetters(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	fake := accrual.NewFake()
+	fake.Script("4561261212345467", accrual.Failure(http.StatusBadRequest))
+
+	store := storage.NewMemStorage()
+
+	user, err := core.NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateUser(user)
+	if !assert.NoError(err) {
+		return
+	}
+
+	order, err := core.NewOrder("4561261212345467", user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateOrder(order, order.UploadedAt)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retry := core.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxFailures: 3}
+	pool, err := NewWorkerPool(store, fake, "test-worker", 1, NewRateLimiter(100, 1, 100, 1), retry, NewCircuitBreaker(100, time.Minute))
+	if !assert.NoError(err) {
+		return
+	}
+	go pool.Run(ctx)
+
+	var dead []*core.AccrualJob
+	assert.Eventually(func() bool {
+		dead, err = store.ExtractDeadJobs()
+		return err == nil && len(dead) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	cancel()
+
+	if !assert.Len(dead, 1) {
+		return
+	}
+	assert.Equal(order.ID, dead[0].OrderID)
+	assert.Equal(3, dead[0].Failures)
+	assert.Equal(3, fake.Calls(order.ID))
+	assert.NotEmpty(dead[0].LastError)
+
+	err = store.RequeueJob(order.ID)
+	assert.NoError(err)
+	dead, err = store.ExtractDeadJobs()
+	assert.NoError(err)
+	assert.Empty(dead)
+}
+
+func TestWorkerNotRegistered(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	fake := accrual.NewFake()
+
+	store := storage.NewMemStorage()
+
+	user, err := core.NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateUser(user)
+	if !assert.NoError(err) {
+		return
+	}
+
+	order, err := core.NewOrder("4561261212345467", user, time.Now())
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateOrder(order, order.UploadedAt)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retry := core.RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, MaxFailures: 1}
+	pool, err := NewWorkerPool(store, fake, "test-worker", 1, NewRateLimiter(100, 1, 100, 1), retry, NewCircuitBreaker(100, time.Minute))
+	if !assert.NoError(err) {
+		return
+	}
+	go pool.Run(ctx)
+
+	var details *core.OrderDetails
+	assert.Eventually(func() bool {
+		details, err = store.ExtractOrder(order.ID)
+		return err == nil && details.Job != nil && details.Job.NextAttemptAt.After(time.Now().Add(JobRecheckInterval/2))
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+
+	assert.Equal(1, fake.Calls(order.ID))
+	if assert.NotNil(details.Job) {
+		assert.Equal(core.PENDING, details.Job.Status)
+		assert.Equal(0, details.Job.Failures)
+	}
+	dead, err := store.ExtractDeadJobs()
+	assert.NoError(err)
+	assert.Empty(dead)
+}
+
+// leaseCheckingClient counts requests for jobs which the pool does not hold
+// under lease any more, another pool could be processing them as well
+type leaseCheckingClient struct {
+	accrual.Client
+	store   storage.Storage
+	owner   string
+	mu      sync.Mutex
+	expired []string
+}
+
+func (client *leaseCheckingClient) GetAccrual(ctx context.Context, orderID string) (*accrual.Response, error) {
+	details, err := client.store.ExtractOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+	job := details.Job
+	if job == nil || job.LockedBy != client.owner || !job.Leased(time.Now()) {
+		client.mu.Lock()
+		client.expired = append(client.expired, orderID)
+		client.mu.Unlock()
+	}
+	return client.Client.GetAccrual(ctx, orderID)
+}
+
+func TestWorkerLease(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	fake := accrual.NewFake()
+	fake.SetDefault(accrual.Processed(decimal.New(1, 0)))
+
+	store := storage.NewMemStorage()
+	client := &leaseCheckingClient{Client: fake, store: store, owner: "test-worker"}
+
+	user, err := core.NewUser("alice", "correct-horse")
+	if !assert.NoError(err) {
+		return
+	}
+	err = store.CreateUser(user)
+	if !assert.NoError(err) {
+		return
+	}
+
+	orderIDs := []string{"1000000008", "1000000016", "1000000024", "1000000032", "1000000040", "1000000057"}
+	for _, orderID := range orderIDs {
+		order, err := core.NewOrder(orderID, user, time.Now())
+		if !assert.NoError(err) {
+			return
+		}
+		err = store.CreateOrder(order, order.UploadedAt)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	// requests are let through far less often than leases expire, jobs
+	// leased ahead of them would outlive their leases
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	retry := core.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute, MaxFailures: 3}
+	pool, err := NewWorkerPool(store, client, "test-worker", 4, NewRateLimiter(10, 10, 10, 1), retry, NewCircuitBreaker(5, time.Minute))
+	if !assert.NoError(err) {
+		return
+	}
+	pool.lease = 50 * time.Millisecond
+	go pool.Run(ctx)
+
+	assert.Eventually(func() bool {
+		user, err := store.ExtractUserByID(user.ID)
+		return err == nil && user.Balance.Equal(decimal.New(int64(len(orderIDs)), 0))
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	assert.Empty(client.expired)
+	for _, orderID := range orderIDs {
+		assert.Equal(1, fake.Calls(orderID), orderID)
+	}
+}
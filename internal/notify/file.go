@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileNotifier appends messages to a file as JSON lines, so that they can
+// be picked up by tests and local tooling
+type FileNotifier struct {
+	sync.Mutex
+	path string
+}
+
+func NewFileNotifier(path string) *FileNotifier {
+	notifier := new(FileNotifier)
+	notifier.path = path
+	return notifier
+}
+
+func (notifier *FileNotifier) Notify(ctx context.Context, message Message) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	notifier.Lock()
+	defer notifier.Unlock()
+
+	f, err := os.OpenFile(notifier.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadFile returns messages written by FileNotifier in the order they were
+// sent
+func ReadFile(path string) ([]Message, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	messages := []Message{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var message Message
+		err = json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, scanner.Err()
+}
@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileNotifier(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "notifications.jsonl")
+	notifier := NewFileNotifier(path)
+
+	_, err := ReadFile(path)
+	assert.Error(err)
+
+	messages := []Message{
+		{PasswordReset, "alice", map[string]string{"token": "first"}},
+		{PasswordReset, "bob", map[string]string{"token": "second"}},
+	}
+	for _, message := range messages {
+		err = notifier.Notify(context.Background(), message)
+		if !assert.NoError(err) {
+			return
+		}
+	}
+
+	sent, err := ReadFile(path)
+	if assert.NoError(err) {
+		assert.Equal(messages, sent)
+	}
+}
@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+)
+
+// kinds of notifications
+const (
+	PasswordReset = "password_reset"
+)
+
+// Message is addressed to a user by login. Notifiers delivering messages to
+// people are expected to render them from templates chosen by Kind.
+type Message struct {
+	Kind      string            `json:"kind"`
+	Recipient string            `json:"recipient"`
+	Params    map[string]string `json:"params"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
+
+// LogNotifier writes messages to the log, it is meant for local development
+// only, since messages may contain secrets
+type LogNotifier struct{}
+
+func NewLogNotifier() *LogNotifier {
+	return new(LogNotifier)
+}
+
+func (notifier *LogNotifier) Notify(ctx context.Context, message Message) error {
+	params := make([]string, 0, len(message.Params))
+	for name, value := range message.Params {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+
+	log.Printf("Notification %s for %s: %s", message.Kind, message.Recipient, strings.Join(params, " "))
+	return nil
+}
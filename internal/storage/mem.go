@@ -17,13 +17,24 @@ import (
 
 type memStorage struct {
 	sync.RWMutex
-	keys        map[uuid.UUID]core.HmacKey
+	keys        map[uuid.UUID]core.SigningKey
 	orders      map[string]core.Order
 	users       map[string]core.User
 	withdrawals map[uuid.UUID]core.Withdrawal
+	ledger      []core.LedgerEntry
+	jobs        map[string]core.AccrualJob
+	sessions    map[uuid.UUID]core.Session
+	refresh     map[string]core.RefreshToken
+	resets      map[string]core.PasswordResetToken
+	attempts    map[string]core.LoginAttempts
+	twoFactors  map[uuid.UUID]core.TwoFactor
+	recovery    map[uuid.UUID]map[string]bool
+	apiKeys     map[uuid.UUID]core.APIKey
+	idempotency map[idempotencyKey]core.IdempotencyRecord
+	audit       []core.AuditEvent
 }
 
-func (store *memStorage) CreateKey(key *core.HmacKey) error {
+func (store *memStorage) CreateKey(key *core.SigningKey) error {
 	store.Lock()
 	defer store.Unlock()
 
@@ -31,7 +42,7 @@ func (store *memStorage) CreateKey(key *core.HmacKey) error {
 	return nil
 }
 
-func (store *memStorage) ExtractKey(id uuid.UUID) (*core.HmacKey, error) {
+func (store *memStorage) ExtractKey(id uuid.UUID) (*core.SigningKey, error) {
 	store.RLock()
 	defer store.RUnlock()
 
@@ -42,15 +53,15 @@ func (store *memStorage) ExtractKey(id uuid.UUID) (*core.HmacKey, error) {
 	return &key, nil
 }
 
-func (store *memStorage) ExtractRandomKey() (*core.HmacKey, error) {
+func (store *memStorage) ExtractRandomKey(algorithm string) (*core.SigningKey, error) {
 	store.RLock()
 	defer store.RUnlock()
 
-	keys := []*core.HmacKey{}
+	keys := []*core.SigningKey{}
 
 	for _, key := range store.keys {
 		key := key
-		if key.Fresh() {
+		if key.Fresh() && key.Algorithm == algorithm {
 			keys = append(keys, &key)
 		}
 	}
@@ -66,11 +77,11 @@ func (store *memStorage) ExtractRandomKey() (*core.HmacKey, error) {
 	return keys[i], nil
 }
 
-func (store *memStorage) ExtractAllKeys() (map[uuid.UUID]core.HmacKey, error) {
+func (store *memStorage) ExtractAllKeys() (map[uuid.UUID]core.SigningKey, error) {
 	store.RLock()
 	defer store.RUnlock()
 
-	keys := make(map[uuid.UUID]core.HmacKey)
+	keys := make(map[uuid.UUID]core.SigningKey)
 
 	for _, key := range store.keys {
 		keys[key.ID] = key
@@ -79,7 +90,460 @@ func (store *memStorage) ExtractAllKeys() (map[uuid.UUID]core.HmacKey, error) {
 	return keys, nil
 }
 
-func (store *memStorage) CreateOrder(order *core.Order) error {
+func (store *memStorage) DeleteExpiredKeys() (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	deleted := 0
+	for id, key := range store.keys {
+		if key.Expired() {
+			delete(store.keys, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (store *memStorage) DeleteKeysExcept(keep []uuid.UUID) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	kept := make(map[uuid.UUID]bool)
+	for _, id := range keep {
+		kept[id] = true
+	}
+
+	deleted := 0
+	for id := range store.keys {
+		if !kept[id] {
+			delete(store.keys, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (store *memStorage) CreateSession(session *core.Session, token *core.RefreshToken) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.sessions[session.ID] = *session
+	store.refresh[string(token.Hash)] = *token
+	return nil
+}
+
+func (store *memStorage) ExtractSession(id uuid.UUID) (*core.Session, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	session, found := store.sessions[id]
+	if !found {
+		return nil, &ErrSessionNotFound{id}
+	}
+	return &session, nil
+}
+
+func (store *memStorage) RevokeSession(id uuid.UUID) error {
+	store.Lock()
+	defer store.Unlock()
+
+	session, found := store.sessions[id]
+	if !found {
+		return &ErrSessionNotFound{id}
+	}
+	if session.RevokedAt == nil {
+		now := time.Now()
+		session.RevokedAt = &now
+		store.sessions[id] = session
+	}
+	return nil
+}
+
+func (store *memStorage) RevokeAllSessions() (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	revoked := 0
+	for id, session := range store.sessions {
+		if session.RevokedAt == nil {
+			session.RevokedAt = &now
+			store.sessions[id] = session
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (store *memStorage) RevokeUserSessions(userID uuid.UUID, keep uuid.UUID) ([]uuid.UUID, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	now := time.Now()
+	revoked := []uuid.UUID{}
+	for id, session := range store.sessions {
+		if session.UserID == userID && id != keep && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			store.sessions[id] = session
+			revoked = append(revoked, id)
+		}
+	}
+	return revoked, nil
+}
+
+func (store *memStorage) ExtractRefreshToken(hash []byte) (*core.RefreshToken, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	token, found := store.refresh[string(hash)]
+	if !found {
+		return nil, &ErrRefreshTokenNotFound{}
+	}
+	return &token, nil
+}
+
+func (store *memStorage) RotateRefreshToken(used *core.RefreshToken, next *core.RefreshToken) error {
+	store.Lock()
+	defer store.Unlock()
+
+	token, found := store.refresh[string(used.Hash)]
+	if !found {
+		return &ErrRefreshTokenNotFound{}
+	}
+	if token.UsedAt != nil {
+		return &ErrRefreshTokenReused{token.ID}
+	}
+
+	now := time.Now()
+	token.UsedAt = &now
+	store.refresh[string(used.Hash)] = token
+	store.refresh[string(next.Hash)] = *next
+	return nil
+}
+
+func (store *memStorage) CreatePasswordResetToken(token *core.PasswordResetToken) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.resets[string(token.Hash)] = *token
+	return nil
+}
+
+func (store *memStorage) ExtractPasswordResetToken(hash []byte) (*core.PasswordResetToken, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	token, found := store.resets[string(hash)]
+	if !found {
+		return nil, &ErrPasswordResetTokenNotFound{}
+	}
+	return &token, nil
+}
+
+func (store *memStorage) ResetPassword(used *core.PasswordResetToken, user *core.User) error {
+	store.Lock()
+	defer store.Unlock()
+
+	token, found := store.resets[string(used.Hash)]
+	if !found {
+		return &ErrPasswordResetTokenNotFound{}
+	}
+	if token.UsedAt != nil {
+		return &ErrPasswordResetTokenUsed{token.ID}
+	}
+
+	for login, u := range store.users {
+		if u.ID == user.ID {
+			now := time.Now()
+			token.UsedAt = &now
+			store.resets[string(used.Hash)] = token
+
+			u.PasswordHash = user.PasswordHash
+			store.users[login] = u
+			return nil
+		}
+	}
+	return &ErrUserNotFoundByID{user.ID}
+}
+
+func (store *memStorage) CreateTwoFactor(twoFactor *core.TwoFactor) error {
+	store.Lock()
+	defer store.Unlock()
+
+	prev, found := store.twoFactors[twoFactor.UserID]
+	if found && prev.Enabled {
+		return &ErrTwoFactorEnabled{twoFactor.UserID}
+	}
+	store.twoFactors[twoFactor.UserID] = *twoFactor
+	return nil
+}
+
+func (store *memStorage) ExtractTwoFactor(userID uuid.UUID) (*core.TwoFactor, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	twoFactor, found := store.twoFactors[userID]
+	if !found {
+		return nil, &ErrTwoFactorNotFound{userID}
+	}
+	return &twoFactor, nil
+}
+
+func (store *memStorage) EnableTwoFactor(userID uuid.UUID, counter int64, recoveryCodes [][]byte) error {
+	store.Lock()
+	defer store.Unlock()
+
+	twoFactor, found := store.twoFactors[userID]
+	if !found {
+		return &ErrTwoFactorNotFound{userID}
+	}
+	if twoFactor.Enabled {
+		return &ErrTwoFactorEnabled{userID}
+	}
+	if counter <= twoFactor.LastCounter {
+		return &ErrTOTPCodeReused{userID, counter}
+	}
+
+	now := time.Now()
+	twoFactor.Enabled = true
+	twoFactor.EnabledAt = &now
+	twoFactor.LastCounter = counter
+	store.twoFactors[userID] = twoFactor
+
+	codes := make(map[string]bool)
+	for _, hash := range recoveryCodes {
+		codes[string(hash)] = true
+	}
+	store.recovery[userID] = codes
+	return nil
+}
+
+func (store *memStorage) DisableTwoFactor(userID uuid.UUID) error {
+	store.Lock()
+	defer store.Unlock()
+
+	_, found := store.twoFactors[userID]
+	if !found {
+		return &ErrTwoFactorNotFound{userID}
+	}
+	delete(store.twoFactors, userID)
+	delete(store.recovery, userID)
+	return nil
+}
+
+func (store *memStorage) UseTOTPCounter(userID uuid.UUID, counter int64) error {
+	store.Lock()
+	defer store.Unlock()
+
+	twoFactor, found := store.twoFactors[userID]
+	if !found {
+		return &ErrTwoFactorNotFound{userID}
+	}
+	if counter <= twoFactor.LastCounter {
+		return &ErrTOTPCodeReused{userID, counter}
+	}
+	twoFactor.LastCounter = counter
+	store.twoFactors[userID] = twoFactor
+	return nil
+}
+
+func (store *memStorage) UseRecoveryCode(userID uuid.UUID, hash []byte) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if !store.recovery[userID][string(hash)] {
+		return &ErrRecoveryCodeNotFound{}
+	}
+	delete(store.recovery[userID], string(hash))
+	return nil
+}
+
+func (store *memStorage) CreateAPIKey(key *core.APIKey) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.apiKeys[key.ID] = *key
+	return nil
+}
+
+func (store *memStorage) ExtractAPIKey(hash []byte) (*core.APIKey, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	for _, key := range store.apiKeys {
+		key := key
+		if string(key.Hash) == string(hash) {
+			return &key, nil
+		}
+	}
+	return nil, &ErrAPIKeyNotFound{}
+}
+
+func (store *memStorage) ExtractAPIKeysByUser(userID uuid.UUID) ([]*core.APIKey, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	keys := []*core.APIKey{}
+	for _, key := range store.apiKeys {
+		key := key
+		if key.UserID == userID {
+			keys = append(keys, &key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+func (store *memStorage) RevokeAPIKey(userID uuid.UUID, id uuid.UUID) error {
+	store.Lock()
+	defer store.Unlock()
+
+	key, found := store.apiKeys[id]
+	if !found || key.UserID != userID {
+		return &ErrAPIKeyNotFound{id}
+	}
+	delete(store.apiKeys, id)
+	return nil
+}
+
+func (store *memStorage) RevokeUserAPIKeys(userID uuid.UUID) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	revoked := 0
+	for id, key := range store.apiKeys {
+		if key.UserID == userID {
+			delete(store.apiKeys, id)
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (store *memStorage) TouchAPIKey(id uuid.UUID, usedAt time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	key, found := store.apiKeys[id]
+	if !found {
+		return &ErrAPIKeyNotFound{id}
+	}
+	key.LastUsedAt = &usedAt
+	store.apiKeys[id] = key
+	return nil
+}
+
+type idempotencyKey struct {
+	userID uuid.UUID
+	key    string
+}
+
+func (store *memStorage) CreateIdempotencyRecord(record *core.IdempotencyRecord) error {
+	store.Lock()
+	defer store.Unlock()
+
+	id := idempotencyKey{record.UserID, record.Key}
+	prev, found := store.idempotency[id]
+	if found && !prev.Expired() {
+		return &ErrIdempotencyKeyExists{record.Key}
+	}
+	store.idempotency[id] = *record
+	return nil
+}
+
+func (store *memStorage) ExtractIdempotencyRecord(userID uuid.UUID, key string) (*core.IdempotencyRecord, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	record, found := store.idempotency[idempotencyKey{userID, key}]
+	if !found || record.Expired() {
+		return nil, &ErrIdempotencyRecordNotFound{key}
+	}
+	return &record, nil
+}
+
+func (store *memStorage) CompleteIdempotencyRecord(record *core.IdempotencyRecord) error {
+	store.Lock()
+	defer store.Unlock()
+
+	id := idempotencyKey{record.UserID, record.Key}
+	stored, found := store.idempotency[id]
+	if !found {
+		return &ErrIdempotencyRecordNotFound{record.Key}
+	}
+	stored.Status = record.Status
+	stored.Body = record.Body
+	store.idempotency[id] = stored
+	return nil
+}
+
+func (store *memStorage) DeleteIdempotencyRecord(userID uuid.UUID, key string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.idempotency, idempotencyKey{userID, key})
+	return nil
+}
+
+func (store *memStorage) DeleteExpiredIdempotencyRecords() (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	deleted := 0
+	for id, record := range store.idempotency {
+		if record.Expired() {
+			delete(store.idempotency, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (store *memStorage) ExtractLoginAttempts(key string) (*core.LoginAttempts, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	attempts, found := store.attempts[key]
+	if !found {
+		return &core.LoginAttempts{Key: key}, nil
+	}
+	return &attempts, nil
+}
+
+func (store *memStorage) RecordLoginFailure(key string, at time.Time, window time.Duration) (*core.LoginAttempts, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	attempts, found := store.attempts[key]
+	if !found || attempts.LastFailureAt.Before(at.Add(-window)) {
+		attempts = core.LoginAttempts{Key: key}
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = at
+	store.attempts[key] = attempts
+	return &attempts, nil
+}
+
+func (store *memStorage) ResetLoginAttempts(key string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.attempts, key)
+	return nil
+}
+
+func (store *memStorage) CreateAuditEvent(event *core.AuditEvent) error {
+	store.Lock()
+	defer store.Unlock()
+
+	store.audit = append(store.audit, *event)
+	return nil
+}
+
+func (store *memStorage) CreateOrder(order *core.Order, firstAttemptAt time.Time) error {
 	userID := order.UserID
 	orderID := order.ID
 
@@ -94,9 +558,35 @@ func (store *memStorage) CreateOrder(order *core.Order) error {
 		return &ErrOrderIDCollission{orderID}
 	}
 	store.orders[orderID] = *order
+	store.jobs[orderID] = *core.NewAccrualJob(order, firstAttemptAt)
 	return nil
 }
 
+func (store *memStorage) ExtractOrder(orderID string) (*core.OrderDetails, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	order, found := store.orders[orderID]
+	if !found {
+		return nil, &ErrOrderNotFound{orderID}
+	}
+	details := &core.OrderDetails{Order: &order}
+
+	job, found := store.jobs[orderID]
+	if found {
+		details.Job = &job
+	}
+	for _, withdrawal := range store.withdrawals {
+		withdrawal := withdrawal
+		if withdrawal.OrderID == orderID {
+			details.Withdrawal = &withdrawal
+			break
+		}
+	}
+
+	return details, nil
+}
+
 func (store *memStorage) ExtractOrdersByUser(user *core.User) ([]*core.Order, error) {
 	userID := user.ID
 	res := []*core.Order{}
@@ -141,6 +631,15 @@ func (store *memStorage) CreateUser(user *core.User) error {
 	if found {
 		return &ErrConflictingUserLogin{login}
 	}
+
+	entry, err := core.NewOpeningEntry(user, time.Now())
+	if err != nil {
+		return err
+	}
+	if entry != nil {
+		store.ledger = append(store.ledger, *entry)
+	}
+
 	store.users[login] = *user
 	return nil
 }
@@ -177,6 +676,48 @@ func (store *memStorage) ExtractUserByID(id uuid.UUID) (*core.User, error) {
 	return user, nil
 }
 
+func (store *memStorage) UpdatePasswordHash(user *core.User) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for login, u := range store.users {
+		if u.ID == user.ID {
+			u.PasswordHash = user.PasswordHash
+			store.users[login] = u
+			return nil
+		}
+	}
+	return &ErrUserNotFoundByID{user.ID}
+}
+
+func (store *memStorage) UpdateUserRole(userID uuid.UUID, role core.Role) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for login, u := range store.users {
+		if u.ID == userID {
+			u.Role = role
+			store.users[login] = u
+			return nil
+		}
+	}
+	return &ErrUserNotFoundByID{userID}
+}
+
+func (store *memStorage) SetUserDisabled(userID uuid.UUID, disabled bool) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for login, u := range store.users {
+		if u.ID == userID {
+			u.Disabled = disabled
+			store.users[login] = u
+			return nil
+		}
+	}
+	return &ErrUserNotFoundByID{userID}
+}
+
 func (store *memStorage) CreateWithdrawal(withdrawal *core.Withdrawal, order *core.Order) error {
 	store.Lock()
 	defer store.Unlock()
@@ -207,7 +748,13 @@ func (store *memStorage) CreateWithdrawal(withdrawal *core.Withdrawal, order *co
 		}
 		return &ErrOrderIDCollission{orderID}
 	}
+	entry, err := core.NewWithdrawalEntry(withdrawal, order)
+	if err != nil {
+		return err
+	}
+
 	store.orders[orderID] = *order
+	store.ledger = append(store.ledger, *entry)
 
 	user.Balance = user.Balance.Sub(withdrawal.Sum)
 
@@ -216,6 +763,66 @@ func (store *memStorage) CreateWithdrawal(withdrawal *core.Withdrawal, order *co
 	return nil
 }
 
+func (store *memStorage) ExtractOrdersPage(user *core.User, page OrdersPage) ([]*core.Order, error) {
+	res := []*core.Order{}
+
+	store.RLock()
+	defer store.RUnlock()
+	for _, order := range store.orders {
+		order := order
+		if order.UserID != user.ID || !page.match(order.UploadedAt, order.ID) {
+			continue
+		}
+		if len(page.Statuses) > 0 {
+			found := false
+			for _, status := range page.Statuses {
+				if order.Status == status {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		res = append(res, &order)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return page.less(res[i].UploadedAt, res[i].ID, res[j].UploadedAt, res[j].ID)
+	})
+	if page.Limit > 0 && len(res) > page.Limit {
+		res = res[:page.Limit]
+	}
+
+	return res, nil
+}
+
+func (store *memStorage) ExtractWithdrawalsPage(user *core.User, page Page) ([]*core.Withdrawal, error) {
+	res := []*core.Withdrawal{}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	for _, withdrawal := range store.withdrawals {
+		withdrawal := withdrawal
+		order, found := store.orders[withdrawal.OrderID]
+		if !found || order.UserID != user.ID || !page.match(withdrawal.ProcessedAt, withdrawal.ID.String()) {
+			continue
+		}
+		res = append(res, &withdrawal)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return page.less(res[i].ProcessedAt, res[i].ID.String(), res[j].ProcessedAt, res[j].ID.String())
+	})
+	if page.Limit > 0 && len(res) > page.Limit {
+		res = res[:page.Limit]
+	}
+
+	return res, nil
+}
+
 func (store *memStorage) ExtractWithdrawalsByUser(user *core.User) ([]*core.Withdrawal, error) {
 	userOrders := make(map[string]bool)
 	res := []*core.Withdrawal{}
@@ -272,13 +879,19 @@ func (store *memStorage) ProcessAccrual(orderID string, status string, sum *deci
 	if status != core.NEW && status != core.PROCESSING && status != core.INVALID && status != core.PROCESSED {
 		return fmt.Errorf("invalid order status: %v", status)
 	}
+	if sum != nil && sum.IsNegative() {
+		return &ErrNegativeAccrual{orderID, *sum}
+	}
 
 	store.Lock()
 	defer store.Unlock()
 
 	order, found := store.orders[orderID]
 	if !found {
-		return fmt.Errorf("order with id %s does not exist", orderID)
+		return &ErrOrderNotFound{orderID}
+	}
+	if order.Status == core.PROCESSED || order.Status == core.INVALID {
+		return &ErrOrderAlreadyProcessed{orderID, order.Status}
 	}
 
 	order.Status = status
@@ -299,15 +912,275 @@ func (store *memStorage) ProcessAccrual(orderID string, status string, sum *deci
 	}
 
 	if sum != nil {
-		user.Balance = user.Balance.Add(*sum)
 		order.Accrual = sum
 	}
+	if sum != nil && sum.IsPositive() {
+		entry, err := core.NewAccrualEntry(&order, *sum, time.Now())
+		if err != nil {
+			return err
+		}
+		store.ledger = append(store.ledger, *entry)
+		user.Balance = user.Balance.Add(*sum)
+	}
 
 	store.orders[orderID] = order
 	store.users[user.Login] = *user
 	return nil
 }
 
+func (store *memStorage) AdjustBalance(entry *core.LedgerEntry) error {
+	store.Lock()
+	defer store.Unlock()
+
+	for login, user := range store.users {
+		if user.ID != entry.UserID {
+			continue
+		}
+
+		balance := user.Balance.Add(entry.Delta(core.UserAccount(user.ID)))
+		if balance.IsNegative() {
+			return &ErrBalanceExceeded{}
+		}
+
+		user.Balance = balance
+		store.users[login] = user
+		store.ledger = append(store.ledger, *entry)
+		return nil
+	}
+	return &ErrUserNotFoundByID{entry.UserID}
+}
+
+func (store *memStorage) ExtractAuditEvents(filter AuditFilter) ([]*core.AuditEvent, error) {
+	res := []*core.AuditEvent{}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	skipped := 0
+	for i := len(store.audit) - 1; i >= 0 && (filter.Limit <= 0 || len(res) < filter.Limit); i-- {
+		event := store.audit[i]
+		if !filter.match(&event) {
+			continue
+		}
+		if skipped < filter.Offset {
+			skipped++
+			continue
+		}
+		res = append(res, &event)
+	}
+
+	return res, nil
+}
+
+func (store *memStorage) ExtractLedgerEntries(user *core.User, limit int, offset int) ([]*core.LedgerEntry, error) {
+	res := []*core.LedgerEntry{}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	// ledger is append-only, so walking it backwards yields the newest entries first
+	skipped := 0
+	for i := len(store.ledger) - 1; i >= 0 && len(res) < limit; i-- {
+		entry := store.ledger[i]
+		if entry.UserID != user.ID {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		res = append(res, &entry)
+	}
+
+	return res, nil
+}
+
+func (store *memStorage) ExtractBalanceMismatches() ([]*core.BalanceMismatch, error) {
+	res := []*core.BalanceMismatch{}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	balances := make(map[uuid.UUID]decimal.Decimal)
+	for _, entry := range store.ledger {
+		account := core.UserAccount(entry.UserID)
+		balances[entry.UserID] = balances[entry.UserID].Add(entry.Delta(account))
+	}
+
+	for _, user := range store.users {
+		ledger := balances[user.ID]
+		if !ledger.Equal(user.Balance) {
+			res = append(res, &core.BalanceMismatch{
+				UserID: user.ID,
+				Cached: user.Balance,
+				Ledger: ledger,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func (store *memStorage) LeaseJobs(owner string, limit int, lease time.Duration) ([]*core.AccrualJob, error) {
+	now := time.Now()
+	due := []*core.AccrualJob{}
+
+	store.Lock()
+	defer store.Unlock()
+
+	for _, job := range store.jobs {
+		job := job
+		if job.Status != core.PENDING || job.NextAttemptAt.After(now) || job.Leased(now) {
+			continue
+		}
+		due = append(due, &job)
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttemptAt.Before(due[j].NextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	lockedUntil := now.Add(lease)
+	for _, job := range due {
+		job.LockedBy = owner
+		job.LockedUntil = &lockedUntil
+		job.Attempts++
+		store.jobs[job.OrderID] = *job
+	}
+
+	return due, nil
+}
+
+func (store *memStorage) CompleteJob(orderID string, owner string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	job, found := store.jobs[orderID]
+	if !found || job.LockedBy != owner {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+
+	delete(store.jobs, orderID)
+	return nil
+}
+
+func (store *memStorage) RescheduleJob(orderID string, owner string, nextAttemptAt time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	job, found := store.jobs[orderID]
+	if !found || job.LockedBy != owner {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+
+	job.NextAttemptAt = nextAttemptAt
+	job.LockedBy = ""
+	job.LockedUntil = nil
+	store.jobs[orderID] = job
+	return nil
+}
+
+func (store *memStorage) FailJob(orderID string, owner string, reason string, nextAttemptAt time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	job, found := store.jobs[orderID]
+	if !found || job.LockedBy != owner {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+
+	job.Failures++
+	job.LastError = reason
+	job.NextAttemptAt = nextAttemptAt
+	job.LockedBy = ""
+	job.LockedUntil = nil
+	store.jobs[orderID] = job
+	return nil
+}
+
+func (store *memStorage) BuryJob(orderID string, owner string, reason string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	job, found := store.jobs[orderID]
+	if !found || job.LockedBy != owner {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+
+	job.Status = core.DEAD
+	job.Failures++
+	job.LastError = reason
+	job.LockedBy = ""
+	job.LockedUntil = nil
+	store.jobs[orderID] = job
+	return nil
+}
+
+func (store *memStorage) ExtractDeadJobs() ([]*core.AccrualJob, error) {
+	jobs := []*core.AccrualJob{}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	for _, job := range store.jobs {
+		job := job
+		if job.Status == core.DEAD {
+			jobs = append(jobs, &job)
+		}
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+
+	return jobs, nil
+}
+
+func (store *memStorage) RequeueJob(orderID string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	job, found := store.jobs[orderID]
+	if !found {
+		return &ErrJobNotFound{orderID}
+	}
+	now := time.Now()
+	if job.Leased(now) {
+		return &ErrJobLeased{orderID}
+	}
+
+	job.Status = core.PENDING
+	job.Failures = 0
+	job.NextAttemptAt = now
+	store.jobs[orderID] = job
+	return nil
+}
+
+func (store *memStorage) SettleJob(orderID string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	delete(store.jobs, orderID)
+	return nil
+}
+
+func (store *memStorage) DeferJob(orderID string, nextAttemptAt time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+
+	job, found := store.jobs[orderID]
+	if !found || job.Status != core.PENDING || !job.NextAttemptAt.Before(nextAttemptAt) {
+		return nil
+	}
+
+	job.NextAttemptAt = nextAttemptAt
+	store.jobs[orderID] = job
+	return nil
+}
+
 func (store *memStorage) Ping(context.Context) error {
 	return nil
 }
@@ -318,9 +1191,20 @@ func (store *memStorage) WithContext(context.Context) Storage {
 
 func NewMemStorage() Storage {
 	store := new(memStorage)
-	store.keys = make(map[uuid.UUID]core.HmacKey)
+	store.keys = make(map[uuid.UUID]core.SigningKey)
 	store.orders = make(map[string]core.Order)
 	store.users = make(map[string]core.User)
 	store.withdrawals = make(map[uuid.UUID]core.Withdrawal)
+	store.ledger = []core.LedgerEntry{}
+	store.jobs = make(map[string]core.AccrualJob)
+	store.sessions = make(map[uuid.UUID]core.Session)
+	store.refresh = make(map[string]core.RefreshToken)
+	store.resets = make(map[string]core.PasswordResetToken)
+	store.attempts = make(map[string]core.LoginAttempts)
+	store.twoFactors = make(map[uuid.UUID]core.TwoFactor)
+	store.recovery = make(map[uuid.UUID]map[string]bool)
+	store.apiKeys = make(map[uuid.UUID]core.APIKey)
+	store.idempotency = make(map[idempotencyKey]core.IdempotencyRecord)
+	store.audit = []core.AuditEvent{}
 	return store
 }
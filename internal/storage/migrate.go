@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// arbitrary key for pg_advisory_lock, shared by every gophermart replica
+const migrationLockID = 42420001
+
+// version of the schema which used to be created by the bootstrap code
+// prior to introduction of migrations
+const baselineVersion = 1
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+}
+
+type Migrator struct {
+	db         *sql.DB
+	migrations []*Migration
+}
+
+type ErrNoMigrationsApplied struct{}
+
+func (err *ErrNoMigrationsApplied) Error() string {
+	return "there are no applied migrations to roll back"
+}
+
+type ErrIrreversibleMigration struct {
+	version int64
+}
+
+func (err *ErrIrreversibleMigration) Error() string {
+	return fmt.Sprintf("migration %04d has no down script", err.version)
+}
+
+func loadMigrations() ([]*Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+
+	for _, entry := range entries {
+		filename := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file: %s", filename)
+		}
+
+		base := strings.TrimSuffix(filename, fmt.Sprintf(".%s.sql", direction))
+		parts := strings.SplitN(base, "_", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("migration file name should look like 0001_name.up.sql, got %s", filename)
+		}
+
+		version, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", filename, err)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", filename))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, found := byVersion[version]
+		if !found {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+		if migration.Name != parts[1] {
+			return nil, fmt.Errorf("migration %04d has conflicting names: %s and %s", version, migration.Name, parts[1])
+		}
+
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := []*Migration{}
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %04d has no up script", migration.Version)
+		}
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(Migrator)
+	m.db = db
+	m.migrations = migrations
+	return m, nil
+}
+
+func NewPostgresMigrator(dsn string) (*Migrator, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return NewMigrator(db)
+}
+
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// withLock runs f on a dedicated connection holding the migration advisory
+// lock, so that concurrently starting replicas do not migrate at once
+func (m *Migrator) withLock(ctx context.Context, f func(*sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := conn.Close()
+		if err != nil {
+			log.Printf("error while closing migration connection: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+		if err != nil {
+			log.Printf("error while releasing migration lock: %v", err)
+		}
+	}()
+
+	err = m.prepare(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+// prepare creates schema_migrations table if needed and adopts deployments
+// bootstrapped before migrations were introduced as the baseline version
+func (m *Migrator) prepare(ctx context.Context, conn *sql.Conn) error {
+	var migrationsTable, userTable sql.NullString
+	row := conn.QueryRowContext(ctx, "SELECT to_regclass('schema_migrations')::TEXT, to_regclass('app_user')::TEXT")
+	err := row.Scan(&migrationsTable, &userTable)
+	if err != nil {
+		return err
+	}
+
+	if migrationsTable.Valid {
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, "CREATE TABLE schema_migrations (version BIGINT PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMP WITH TIME ZONE NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	if userTable.Valid {
+		log.Printf("Found schema created before migrations were introduced, adopting it as version %04d", baselineVersion)
+		for _, migration := range m.migrations {
+			if migration.Version > baselineVersion {
+				break
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations(version, name, applied_at) VALUES($1, $2, $3)", migration.Version, migration.Name, time.Now())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	applied := make(map[int64]time.Time)
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt.Local()
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, script string, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, record, args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Up applies all pending migrations and returns the number of applied ones
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	count := 0
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, found := applied[migration.Version]; found {
+				continue
+			}
+
+			log.Printf("Applying migration %04d_%s", migration.Version, migration.Name)
+			err = m.run(
+				ctx,
+				conn,
+				migration.Up,
+				"INSERT INTO schema_migrations(version, name, applied_at) VALUES($1, $2, $3)",
+				migration.Version,
+				migration.Name,
+				time.Now(),
+			)
+			if err != nil {
+				return fmt.Errorf("could not apply migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// Down rolls back the latest applied migration and returns it
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var rolledBack *Migration
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, found := applied[migration.Version]; !found {
+				continue
+			}
+
+			if migration.Down == "" {
+				return &ErrIrreversibleMigration{migration.Version}
+			}
+
+			log.Printf("Rolling back migration %04d_%s", migration.Version, migration.Name)
+			err = m.run(
+				ctx,
+				conn,
+				migration.Down,
+				"DELETE FROM schema_migrations WHERE version = $1",
+				migration.Version,
+			)
+			if err != nil {
+				return fmt.Errorf("could not roll back migration %04d_%s: %w", migration.Version, migration.Name, err)
+			}
+			rolledBack = migration
+			return nil
+		}
+
+		return &ErrNoMigrationsApplied{}
+	})
+
+	return rolledBack, err
+}
+
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	statuses := []MigrationStatus{}
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+			if appliedAt, found := applied[migration.Version]; found {
+				appliedAt := appliedAt
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
@@ -0,0 +1,4 @@
+DROP TABLE withdrawal;
+DROP TABLE app_order;
+DROP TABLE app_user;
+DROP TABLE hmac_key;
@@ -0,0 +1,35 @@
+CREATE TABLE hmac_key (
+    id UUID PRIMARY KEY,
+    sign BYTEA NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX expires_index ON hmac_key (expires_at);
+
+CREATE TABLE app_user (
+    id UUID PRIMARY KEY,
+    login TEXT NOT NULL,
+    password_hash TEXT NOT NULL,
+    balance NUMERIC NOT NULL DEFAULT 0
+);
+
+CREATE TABLE app_order (
+    id TEXT PRIMARY KEY,
+    status VARCHAR(255) NOT NULL,
+    uploaded_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    user_id UUID NOT NULL,
+    accrual NUMERIC NULL DEFAULT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id)
+);
+CREATE INDEX uploaded_at_index ON app_order (uploaded_at);
+CREATE INDEX user_index ON app_order (user_id);
+CREATE INDEX status_index ON app_order (status);
+
+CREATE TABLE withdrawal (
+    id UUID PRIMARY KEY,
+    order_id TEXT NOT NULL,
+    processed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    withdrawal_sum NUMERIC NOT NULL DEFAULT 0,
+    CONSTRAINT fk_order FOREIGN KEY(order_id) REFERENCES app_order(id)
+);
+CREATE INDEX order_index ON withdrawal (order_id);
+CREATE INDEX processed_index ON withdrawal (processed_at);
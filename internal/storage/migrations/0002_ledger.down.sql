@@ -0,0 +1,2 @@
+DROP TABLE ledger_entry;
+DROP FUNCTION ledger_entry_immutable();
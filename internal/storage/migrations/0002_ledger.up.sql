@@ -0,0 +1,70 @@
+CREATE TABLE ledger_entry (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    entry_type VARCHAR(32) NOT NULL,
+    debit_account TEXT NOT NULL,
+    credit_account TEXT NOT NULL,
+    amount NUMERIC NOT NULL CHECK (amount > 0),
+    order_id TEXT NULL DEFAULT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id),
+    CONSTRAINT fk_order FOREIGN KEY(order_id) REFERENCES app_order(id)
+);
+CREATE INDEX ledger_user_created_index ON ledger_entry (user_id, created_at);
+
+CREATE FUNCTION ledger_entry_immutable() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger entries are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entry_immutable
+    BEFORE UPDATE OR DELETE ON ledger_entry
+    FOR EACH ROW EXECUTE PROCEDURE ledger_entry_immutable();
+
+-- backfill history of existing balances
+INSERT INTO ledger_entry (id, user_id, entry_type, debit_account, credit_account, amount, order_id, created_at)
+SELECT md5(random()::TEXT || clock_timestamp()::TEXT || app_order.id)::UUID,
+       app_order.user_id,
+       'ACCRUAL',
+       'system:accrual',
+       'user:' || app_order.user_id,
+       app_order.accrual,
+       app_order.id,
+       app_order.uploaded_at
+FROM app_order
+WHERE app_order.accrual > 0;
+
+INSERT INTO ledger_entry (id, user_id, entry_type, debit_account, credit_account, amount, order_id, created_at)
+SELECT md5(random()::TEXT || clock_timestamp()::TEXT || withdrawal.id::TEXT)::UUID,
+       app_order.user_id,
+       'WITHDRAWAL',
+       'user:' || app_order.user_id,
+       'system:withdrawal',
+       withdrawal.withdrawal_sum,
+       withdrawal.order_id,
+       withdrawal.processed_at
+FROM withdrawal
+INNER JOIN app_order ON withdrawal.order_id = app_order.id
+WHERE withdrawal.withdrawal_sum > 0;
+
+-- whatever can not be explained by orders and withdrawals becomes an opening entry
+INSERT INTO ledger_entry (id, user_id, entry_type, debit_account, credit_account, amount, order_id, created_at)
+SELECT md5(random()::TEXT || clock_timestamp()::TEXT || diff.id::TEXT)::UUID,
+       diff.id,
+       'OPENING',
+       CASE WHEN diff.amount > 0 THEN 'system:adjustment' ELSE 'user:' || diff.id END,
+       CASE WHEN diff.amount > 0 THEN 'user:' || diff.id ELSE 'system:adjustment' END,
+       ABS(diff.amount),
+       NULL,
+       NOW()
+FROM (
+    SELECT app_user.id,
+           app_user.balance - COALESCE(SUM(
+               CASE WHEN ledger_entry.credit_account = 'user:' || app_user.id THEN ledger_entry.amount ELSE -ledger_entry.amount END
+           ), 0) AS amount
+    FROM app_user
+    LEFT JOIN ledger_entry ON ledger_entry.user_id = app_user.id
+    GROUP BY app_user.id, app_user.balance
+) AS diff
+WHERE diff.amount != 0;
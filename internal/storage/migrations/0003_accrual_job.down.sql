@@ -0,0 +1 @@
+DROP TABLE accrual_job;
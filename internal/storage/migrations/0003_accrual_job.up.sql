@@ -0,0 +1,16 @@
+CREATE TABLE accrual_job (
+    order_id TEXT PRIMARY KEY,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_by TEXT NULL DEFAULT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    CONSTRAINT fk_order FOREIGN KEY(order_id) REFERENCES app_order(id)
+);
+CREATE INDEX accrual_job_next_attempt_index ON accrual_job (next_attempt_at);
+
+INSERT INTO accrual_job (order_id, attempts, next_attempt_at, created_at)
+SELECT app_order.id, 0, NOW(), app_order.uploaded_at
+FROM app_order
+WHERE app_order.status NOT IN ('PROCESSED', 'INVALID')
+AND NOT EXISTS (SELECT 1 FROM withdrawal WHERE withdrawal.order_id = app_order.id);
@@ -0,0 +1,4 @@
+DROP INDEX accrual_job_status_index;
+ALTER TABLE accrual_job DROP COLUMN last_error;
+ALTER TABLE accrual_job DROP COLUMN failures;
+ALTER TABLE accrual_job DROP COLUMN status;
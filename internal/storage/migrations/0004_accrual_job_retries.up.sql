@@ -0,0 +1,4 @@
+ALTER TABLE accrual_job ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'PENDING';
+ALTER TABLE accrual_job ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE accrual_job ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+CREATE INDEX accrual_job_status_index ON accrual_job (status);
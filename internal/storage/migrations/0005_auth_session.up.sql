@@ -0,0 +1,20 @@
+CREATE TABLE auth_session (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id)
+);
+CREATE INDEX auth_session_user_index ON auth_session (user_id);
+
+CREATE TABLE refresh_token (
+    id UUID PRIMARY KEY,
+    session_id UUID NOT NULL,
+    hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    CONSTRAINT fk_session FOREIGN KEY(session_id) REFERENCES auth_session(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX refresh_token_hash_index ON refresh_token (hash);
+CREATE INDEX refresh_token_session_index ON refresh_token (session_id);
@@ -0,0 +1,5 @@
+DELETE FROM signing_key WHERE algorithm != 'HS256';
+DROP INDEX signing_key_algorithm_index;
+ALTER TABLE signing_key DROP COLUMN algorithm;
+ALTER INDEX signing_key_expires_index RENAME TO expires_index;
+ALTER TABLE signing_key RENAME TO hmac_key;
@@ -0,0 +1,4 @@
+ALTER TABLE hmac_key RENAME TO signing_key;
+ALTER INDEX expires_index RENAME TO signing_key_expires_index;
+ALTER TABLE signing_key ADD COLUMN algorithm VARCHAR(16) NOT NULL DEFAULT 'HS256';
+CREATE INDEX signing_key_algorithm_index ON signing_key (algorithm);
@@ -0,0 +1,2 @@
+DROP INDEX signing_key_retires_index;
+ALTER TABLE signing_key DROP COLUMN retires_at;
@@ -0,0 +1,4 @@
+ALTER TABLE signing_key ADD COLUMN retires_at TIMESTAMP WITH TIME ZONE NULL;
+UPDATE signing_key SET retires_at = expires_at - INTERVAL '24 hours';
+ALTER TABLE signing_key ALTER COLUMN retires_at SET NOT NULL;
+CREATE INDEX signing_key_retires_index ON signing_key (retires_at);
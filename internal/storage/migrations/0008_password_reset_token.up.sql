@@ -0,0 +1,11 @@
+CREATE TABLE password_reset_token (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    hash BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX password_reset_token_hash_index ON password_reset_token (hash);
+CREATE INDEX password_reset_token_user_index ON password_reset_token (user_id);
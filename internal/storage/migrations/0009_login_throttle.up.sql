@@ -0,0 +1,17 @@
+CREATE TABLE login_attempt (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE audit_event (
+    id UUID PRIMARY KEY,
+    event_type VARCHAR(255) NOT NULL,
+    user_id UUID NULL DEFAULT NULL,
+    login TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX audit_event_created_at_index ON audit_event (created_at);
+CREATE INDEX audit_event_user_index ON audit_event (user_id);
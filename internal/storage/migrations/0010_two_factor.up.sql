@@ -0,0 +1,17 @@
+CREATE TABLE two_factor (
+    user_id UUID PRIMARY KEY,
+    secret BYTEA NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    last_counter BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    enabled_at TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id) ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_code (
+    user_id UUID NOT NULL,
+    hash BYTEA NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    PRIMARY KEY (user_id, hash),
+    CONSTRAINT fk_two_factor FOREIGN KEY(user_id) REFERENCES two_factor(user_id) ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+CREATE TABLE api_key (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL,
+    name TEXT NOT NULL,
+    hint TEXT NOT NULL,
+    hash BYTEA NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_used_at TIMESTAMP WITH TIME ZONE NULL DEFAULT NULL,
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX api_key_hash_index ON api_key (hash);
+CREATE INDEX api_key_user_index ON api_key (user_id);
@@ -0,0 +1,5 @@
+DROP INDEX audit_event_actor_index;
+ALTER TABLE audit_event DROP COLUMN actor_id;
+
+ALTER TABLE app_user DROP COLUMN disabled;
+ALTER TABLE app_user DROP COLUMN role;
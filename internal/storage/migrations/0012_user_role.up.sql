@@ -0,0 +1,5 @@
+ALTER TABLE app_user ADD COLUMN role VARCHAR(255) NOT NULL DEFAULT 'user';
+ALTER TABLE app_user ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE audit_event ADD COLUMN actor_id UUID NULL DEFAULT NULL;
+CREATE INDEX audit_event_actor_index ON audit_event (actor_id);
@@ -0,0 +1,5 @@
+ALTER TABLE ledger_entry DROP CONSTRAINT adjustment_reason;
+ALTER TABLE ledger_entry DROP CONSTRAINT fk_operator;
+ALTER TABLE ledger_entry DROP COLUMN operator_id;
+ALTER TABLE ledger_entry DROP COLUMN note;
+ALTER TABLE ledger_entry DROP COLUMN reason;
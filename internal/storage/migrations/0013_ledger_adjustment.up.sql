@@ -0,0 +1,5 @@
+ALTER TABLE ledger_entry ADD COLUMN reason VARCHAR(32) NULL DEFAULT NULL;
+ALTER TABLE ledger_entry ADD COLUMN note TEXT NOT NULL DEFAULT '';
+ALTER TABLE ledger_entry ADD COLUMN operator_id UUID NULL DEFAULT NULL;
+ALTER TABLE ledger_entry ADD CONSTRAINT fk_operator FOREIGN KEY(operator_id) REFERENCES app_user(id);
+ALTER TABLE ledger_entry ADD CONSTRAINT adjustment_reason CHECK (entry_type != 'ADJUSTMENT' OR (reason IS NOT NULL AND operator_id IS NOT NULL));
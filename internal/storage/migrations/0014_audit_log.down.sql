@@ -0,0 +1,5 @@
+DROP TRIGGER audit_event_immutable ON audit_event;
+DROP FUNCTION audit_event_immutable();
+
+DROP INDEX audit_event_type_created_at_index;
+ALTER TABLE audit_event DROP COLUMN request_id;
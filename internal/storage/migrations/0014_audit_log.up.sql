@@ -0,0 +1,12 @@
+ALTER TABLE audit_event ADD COLUMN request_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX audit_event_type_created_at_index ON audit_event (event_type, created_at);
+
+CREATE FUNCTION audit_event_immutable() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit events are immutable';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_event_immutable
+    BEFORE UPDATE OR DELETE ON audit_event
+    FOR EACH ROW EXECUTE PROCEDURE audit_event_immutable();
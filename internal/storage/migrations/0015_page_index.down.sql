@@ -0,0 +1,2 @@
+DROP INDEX withdrawal_processed_id_index;
+DROP INDEX order_user_uploaded_index;
@@ -0,0 +1,2 @@
+CREATE INDEX order_user_uploaded_index ON app_order (user_id, uploaded_at, id COLLATE "C");
+CREATE INDEX withdrawal_processed_id_index ON withdrawal (processed_at, id);
@@ -0,0 +1,12 @@
+CREATE TABLE idempotency_record (
+    user_id UUID NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    request_hash BYTEA NOT NULL,
+    status INTEGER NOT NULL DEFAULT 0,
+    body BYTEA NULL DEFAULT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, key),
+    CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id)
+);
+CREATE INDEX idempotency_record_expires_index ON idempotency_record (expires_at);
@@ -3,14 +3,17 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/devsagul/gophemart/internal/core"
 	"github.com/google/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/shopspring/decimal"
 )
 
@@ -19,19 +22,19 @@ type postgresStorage struct {
 	ctx context.Context
 }
 
-func (store *postgresStorage) CreateKey(key *core.HmacKey) error {
-	putQuery, err := store.db.Prepare("INSERT INTO hmac_key(id, sign, expires_at) VALUES($1, $2, $3)")
+func (store *postgresStorage) CreateKey(key *core.SigningKey) error {
+	putQuery, err := store.db.Prepare("INSERT INTO signing_key(id, algorithm, sign, retires_at, expires_at) VALUES($1, $2, $3, $4, $5)")
 	if err != nil {
 		return err
 	}
-	_, err = putQuery.ExecContext(store.ctx, key.ID, key.Sign, key.ExpiresAt)
+	_, err = putQuery.ExecContext(store.ctx, key.ID, key.Algorithm, key.Sign, key.RetiresAt, key.ExpiresAt)
 	return err
 }
 
-func (store *postgresStorage) ExtractKey(id uuid.UUID) (*core.HmacKey, error) {
+func (store *postgresStorage) ExtractKey(id uuid.UUID) (*core.SigningKey, error) {
 	now := time.Now()
 
-	query, err := store.db.PrepareContext(store.ctx, "SELECT id, sign, expires_at from hmac_key WHERE id = $1 AND expires_at > $2")
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, algorithm, sign, retires_at, expires_at from signing_key WHERE id = $1 AND expires_at > $2")
 
 	if err != nil {
 		return nil, err
@@ -43,8 +46,37 @@ func (store *postgresStorage) ExtractKey(id uuid.UUID) (*core.HmacKey, error) {
 	}
 	for rows.Next() {
 
-		var key core.HmacKey
-		err = rows.Scan(&key.ID, &key.Sign, &key.ExpiresAt)
+		var key core.SigningKey
+		err = rows.Scan(&key.ID, &key.Algorithm, &key.Sign, &key.RetiresAt, &key.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		return &key, nil
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, &ErrKeyNotFound{id}
+}
+func (store *postgresStorage) ExtractRandomKey(algorithm string) (*core.SigningKey, error) {
+	now := time.Now()
+
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, algorithm, sign, retires_at, expires_at from signing_key WHERE retires_at > $1 AND algorithm = $2 ORDER BY RANDOM()")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := query.QueryContext(store.ctx, now, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+
+		var key core.SigningKey
+		err = rows.Scan(&key.ID, &key.Algorithm, &key.Sign, &key.RetiresAt, &key.ExpiresAt)
 		if err != nil {
 			return nil, err
 		}
@@ -53,78 +85,997 @@ func (store *postgresStorage) ExtractKey(id uuid.UUID) (*core.HmacKey, error) {
 			return &key, nil
 		}
 	}
-	err = rows.Err()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, &ErrNoKeys{}
+}
+
+func (store *postgresStorage) ExtractAllKeys() (map[uuid.UUID]core.SigningKey, error) {
+	keys := make(map[uuid.UUID]core.SigningKey)
+	now := time.Now()
+
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, algorithm, sign, retires_at, expires_at from signing_key WHERE expires_at > $1")
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := query.QueryContext(store.ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+
+		var key core.SigningKey
+		err = rows.Scan(&key.ID, &key.Algorithm, &key.Sign, &key.RetiresAt, &key.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		keys[key.ID] = key
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (store *postgresStorage) deleteKeys(condition string, args ...interface{}) (int, error) {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM signing_key"+condition)
+	if err != nil {
+		return 0, err
+	}
+	res, err := query.ExecContext(store.ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (store *postgresStorage) DeleteExpiredKeys() (int, error) {
+	return store.deleteKeys(" WHERE expires_at <= $1", time.Now())
+}
+
+func (store *postgresStorage) DeleteKeysExcept(keep []uuid.UUID) (int, error) {
+	ids := make([]string, 0, len(keep))
+	for _, id := range keep {
+		ids = append(ids, id.String())
+	}
+	return store.deleteKeys(" WHERE NOT (id = ANY($1::uuid[]))", pq.Array(ids))
+}
+
+// sessions
+func (store *postgresStorage) createRefreshToken(tx *sql.Tx, token *core.RefreshToken) error {
+	putQuery, err := tx.PrepareContext(store.ctx, "INSERT INTO refresh_token(id, session_id, hash, created_at, expires_at) VALUES($1, $2, $3, $4, $5)")
+	if err != nil {
+		return err
+	}
+	_, err = putQuery.ExecContext(store.ctx, token.ID, token.SessionID, token.Hash, token.CreatedAt, token.ExpiresAt)
+	return err
+}
+
+func (store *postgresStorage) CreateSession(session *core.Session, token *core.RefreshToken) error {
+	tx, err := store.db.BeginTx(store.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+
+	putQuery, err := tx.PrepareContext(store.ctx, "INSERT INTO auth_session(id, user_id, created_at) VALUES($1, $2, $3)")
+	if err != nil {
+		return err
+	}
+	_, err = putQuery.ExecContext(store.ctx, session.ID, session.UserID, session.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = store.createRefreshToken(tx, token)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *postgresStorage) ExtractSession(id uuid.UUID) (*core.Session, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, user_id, created_at, revoked_at FROM auth_session WHERE id = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	var session core.Session
+	var revokedAt sql.NullTime
+	err = query.QueryRowContext(store.ctx, id).Scan(&session.ID, &session.UserID, &session.CreatedAt, &revokedAt)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrSessionNotFound{id}
+	default:
+		return nil, err
+	}
+
+	session.CreatedAt = session.CreatedAt.Local()
+	if revokedAt.Valid {
+		at := revokedAt.Time.Local()
+		session.RevokedAt = &at
+	}
+	return &session, nil
+}
+
+func (store *postgresStorage) RevokeSession(id uuid.UUID) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE auth_session SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, id, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrSessionNotFound{id}
+	}
+	return nil
+}
+
+func (store *postgresStorage) RevokeAllSessions() (int, error) {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE auth_session SET revoked_at = $1 WHERE revoked_at IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	res, err := query.ExecContext(store.ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (store *postgresStorage) RevokeUserSessions(userID uuid.UUID, keep uuid.UUID) ([]uuid.UUID, error) {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE auth_session SET revoked_at = $3 WHERE user_id = $1 AND id != $2 AND revoked_at IS NULL RETURNING id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := query.QueryContext(store.ctx, userID, keep, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, id)
+	}
+	return revoked, rows.Err()
+}
+
+func (store *postgresStorage) ExtractRefreshToken(hash []byte) (*core.RefreshToken, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, session_id, hash, created_at, expires_at, used_at FROM refresh_token WHERE hash = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	var token core.RefreshToken
+	var usedAt sql.NullTime
+	err = query.QueryRowContext(store.ctx, hash).Scan(&token.ID, &token.SessionID, &token.Hash, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrRefreshTokenNotFound{}
+	default:
+		return nil, err
+	}
+
+	token.CreatedAt = token.CreatedAt.Local()
+	token.ExpiresAt = token.ExpiresAt.Local()
+	if usedAt.Valid {
+		at := usedAt.Time.Local()
+		token.UsedAt = &at
+	}
+	return &token, nil
+}
+
+func (store *postgresStorage) RotateRefreshToken(used *core.RefreshToken, next *core.RefreshToken) error {
+	tx, err := store.db.BeginTx(store.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+
+	// of two concurrent refreshes with the same token only one may succeed
+	query, err := tx.PrepareContext(store.ctx, "UPDATE refresh_token SET used_at = $2 WHERE id = $1 AND used_at IS NULL")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, used.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrRefreshTokenReused{used.ID}
+	}
+
+	err = store.createRefreshToken(tx, next)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// password reset
+func (store *postgresStorage) CreatePasswordResetToken(token *core.PasswordResetToken) error {
+	query, err := store.db.PrepareContext(store.ctx, "INSERT INTO password_reset_token(id, user_id, hash, created_at, expires_at) VALUES($1, $2, $3, $4, $5)")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, token.ID, token.UserID, token.Hash, token.CreatedAt, token.ExpiresAt)
+	return err
+}
+
+func (store *postgresStorage) ExtractPasswordResetToken(hash []byte) (*core.PasswordResetToken, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, user_id, hash, created_at, expires_at, used_at FROM password_reset_token WHERE hash = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	var token core.PasswordResetToken
+	var usedAt sql.NullTime
+	err = query.QueryRowContext(store.ctx, hash).Scan(&token.ID, &token.UserID, &token.Hash, &token.CreatedAt, &token.ExpiresAt, &usedAt)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrPasswordResetTokenNotFound{}
+	default:
+		return nil, err
+	}
+
+	token.CreatedAt = token.CreatedAt.Local()
+	token.ExpiresAt = token.ExpiresAt.Local()
+	if usedAt.Valid {
+		at := usedAt.Time.Local()
+		token.UsedAt = &at
+	}
+	return &token, nil
+}
+
+func (store *postgresStorage) ResetPassword(token *core.PasswordResetToken, user *core.User) error {
+	tx, err := store.db.BeginTx(store.ctx, nil)
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	// of two concurrent resets with the same token only one may succeed
+	query, err := tx.PrepareContext(store.ctx, "UPDATE password_reset_token SET used_at = $2 WHERE id = $1 AND used_at IS NULL")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, token.ID, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrPasswordResetTokenUsed{token.ID}
+	}
+
+	query, err = tx.PrepareContext(store.ctx, "UPDATE app_user SET password_hash = $2 WHERE id = $1")
+	if err != nil {
+		return err
+	}
+	res, err = query.ExecContext(store.ctx, user.ID, user.PasswordHash)
+	if err != nil {
+		return err
+	}
+	n, err = res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrUserNotFoundByID{user.ID}
+	}
+
+	return tx.Commit()
+}
+
+// two factor authentication
+func (store *postgresStorage) CreateTwoFactor(twoFactor *core.TwoFactor) error {
+	// pending enrollment is replaced, enabled one is kept
+	query, err := store.db.PrepareContext(store.ctx, `INSERT INTO two_factor(user_id, secret, enabled, last_counter, created_at) VALUES($1, $2, FALSE, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_counter = $3, created_at = $4 WHERE NOT two_factor.enabled`)
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, twoFactor.UserID, twoFactor.Secret, twoFactor.LastCounter, twoFactor.CreatedAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrTwoFactorEnabled{twoFactor.UserID}
+	}
+	return nil
+}
+
+func (store *postgresStorage) ExtractTwoFactor(userID uuid.UUID) (*core.TwoFactor, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT user_id, secret, enabled, last_counter, created_at, enabled_at FROM two_factor WHERE user_id = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	var twoFactor core.TwoFactor
+	var enabledAt sql.NullTime
+	err = query.QueryRowContext(store.ctx, userID).Scan(&twoFactor.UserID, &twoFactor.Secret, &twoFactor.Enabled, &twoFactor.LastCounter, &twoFactor.CreatedAt, &enabledAt)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrTwoFactorNotFound{userID}
+	default:
+		return nil, err
+	}
+
+	twoFactor.CreatedAt = twoFactor.CreatedAt.Local()
+	if enabledAt.Valid {
+		at := enabledAt.Time.Local()
+		twoFactor.EnabledAt = &at
+	}
+	return &twoFactor, nil
+}
+
+func (store *postgresStorage) EnableTwoFactor(userID uuid.UUID, counter int64, recoveryCodes [][]byte) error {
+	tx, err := store.db.BeginTx(store.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+
+	query, err := tx.PrepareContext(store.ctx, "SELECT enabled, last_counter FROM two_factor WHERE user_id = $1 FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	var enabled bool
+	var lastCounter int64
+	err = query.QueryRowContext(store.ctx, userID).Scan(&enabled, &lastCounter)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return &ErrTwoFactorNotFound{userID}
+	default:
+		return err
+	}
+	if enabled {
+		return &ErrTwoFactorEnabled{userID}
+	}
+	if counter <= lastCounter {
+		return &ErrTOTPCodeReused{userID, counter}
+	}
+
+	updateQuery, err := tx.PrepareContext(store.ctx, "UPDATE two_factor SET enabled = TRUE, last_counter = $2, enabled_at = $3 WHERE user_id = $1")
+	if err != nil {
+		return err
+	}
+	_, err = updateQuery.ExecContext(store.ctx, userID, counter, time.Now())
+	if err != nil {
+		return err
+	}
+
+	deleteQuery, err := tx.PrepareContext(store.ctx, "DELETE FROM recovery_code WHERE user_id = $1")
+	if err != nil {
+		return err
+	}
+	_, err = deleteQuery.ExecContext(store.ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	insertQuery, err := tx.PrepareContext(store.ctx, "INSERT INTO recovery_code(user_id, hash) VALUES($1, $2)")
+	if err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodes {
+		_, err = insertQuery.ExecContext(store.ctx, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (store *postgresStorage) DisableTwoFactor(userID uuid.UUID) error {
+	// recovery codes are removed by cascade
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM two_factor WHERE user_id = $1")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrTwoFactorNotFound{userID}
+	}
+	return nil
+}
+
+func (store *postgresStorage) UseTOTPCounter(userID uuid.UUID, counter int64) error {
+	// of two concurrent logins with the same code only one may succeed
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE two_factor SET last_counter = $2 WHERE user_id = $1 AND last_counter < $2")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, userID, counter)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrTOTPCodeReused{userID, counter}
+	}
+	return nil
+}
+
+func (store *postgresStorage) UseRecoveryCode(userID uuid.UUID, hash []byte) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE recovery_code SET used_at = $3 WHERE user_id = $1 AND hash = $2 AND used_at IS NULL")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, userID, hash, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrRecoveryCodeNotFound{}
+	}
+	return nil
+}
+
+// api keys
+func (store *postgresStorage) CreateAPIKey(key *core.APIKey) error {
+	query, err := store.db.PrepareContext(store.ctx, "INSERT INTO api_key(id, user_id, name, hint, hash, scopes, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, key.ID, key.UserID, key.Name, key.Hint, key.Hash, pq.Array(key.Scopes), key.CreatedAt)
+	return err
+}
+
+func scanAPIKey(scan func(dest ...interface{}) error) (*core.APIKey, error) {
+	var key core.APIKey
+	var lastUsedAt sql.NullTime
+	err := scan(&key.ID, &key.UserID, &key.Name, &key.Hint, &key.Hash, pq.Array(&key.Scopes), &key.CreatedAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	key.CreatedAt = key.CreatedAt.Local()
+	if lastUsedAt.Valid {
+		at := lastUsedAt.Time.Local()
+		key.LastUsedAt = &at
+	}
+	return &key, nil
+}
+
+func (store *postgresStorage) ExtractAPIKey(hash []byte) (*core.APIKey, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, user_id, name, hint, hash, scopes, created_at, last_used_at FROM api_key WHERE hash = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scanAPIKey(query.QueryRowContext(store.ctx, hash).Scan)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrAPIKeyNotFound{}
+	default:
+		return nil, err
+	}
+	return key, nil
+}
+
+func (store *postgresStorage) ExtractAPIKeysByUser(userID uuid.UUID) ([]*core.APIKey, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, user_id, name, hint, hash, scopes, created_at, last_used_at FROM api_key WHERE user_id = $1 ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := query.QueryContext(store.ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*core.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (store *postgresStorage) RevokeAPIKey(userID uuid.UUID, id uuid.UUID) error {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM api_key WHERE id = $1 AND user_id = $2")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrAPIKeyNotFound{id}
+	}
+	return nil
+}
+
+func (store *postgresStorage) RevokeUserAPIKeys(userID uuid.UUID) (int, error) {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM api_key WHERE user_id = $1")
+	if err != nil {
+		return 0, err
+	}
+	res, err := query.ExecContext(store.ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (store *postgresStorage) TouchAPIKey(id uuid.UUID, usedAt time.Time) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE api_key SET last_used_at = $2 WHERE id = $1")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, id, usedAt)
+	return err
+}
+
+// idempotency
+func (store *postgresStorage) CreateIdempotencyRecord(record *core.IdempotencyRecord) error {
+	// a concurrent request with the same key either inserts first or finds
+	// the unexpired record and updates nothing
+	query, err := store.db.PrepareContext(store.ctx, `INSERT INTO idempotency_record(user_id, key, request_hash, created_at, expires_at) VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, key) DO UPDATE SET
+			request_hash = $3,
+			status = 0,
+			body = NULL,
+			created_at = $4,
+			expires_at = $5
+		WHERE idempotency_record.expires_at < $4`)
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, record.UserID, record.Key, record.RequestHash, record.CreatedAt, record.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrIdempotencyKeyExists{record.Key}
+	}
+	return nil
+}
+
+func (store *postgresStorage) ExtractIdempotencyRecord(userID uuid.UUID, key string) (*core.IdempotencyRecord, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT user_id, key, request_hash, status, body, created_at, expires_at FROM idempotency_record WHERE user_id = $1 AND key = $2 AND expires_at >= $3")
+	if err != nil {
+		return nil, err
+	}
+
+	var record core.IdempotencyRecord
+	err = query.QueryRowContext(store.ctx, userID, key, time.Now()).Scan(&record.UserID, &record.Key, &record.RequestHash, &record.Status, &record.Body, &record.CreatedAt, &record.ExpiresAt)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrIdempotencyRecordNotFound{key}
+	default:
+		return nil, err
+	}
+
+	record.CreatedAt = record.CreatedAt.Local()
+	record.ExpiresAt = record.ExpiresAt.Local()
+	return &record, nil
+}
+
+func (store *postgresStorage) CompleteIdempotencyRecord(record *core.IdempotencyRecord) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE idempotency_record SET status = $3, body = $4 WHERE user_id = $1 AND key = $2")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, record.UserID, record.Key, record.Status, record.Body)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrIdempotencyRecordNotFound{record.Key}
+	}
+	return nil
+}
+
+func (store *postgresStorage) DeleteIdempotencyRecord(userID uuid.UUID, key string) error {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM idempotency_record WHERE user_id = $1 AND key = $2")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, userID, key)
+	return err
+}
+
+func (store *postgresStorage) DeleteExpiredIdempotencyRecords() (int, error) {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM idempotency_record WHERE expires_at < $1")
+	if err != nil {
+		return 0, err
+	}
+	res, err := query.ExecContext(store.ctx, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// login attempts
+func (store *postgresStorage) ExtractLoginAttempts(key string) (*core.LoginAttempts, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT key, failures, last_failure_at FROM login_attempt WHERE key = $1")
 	if err != nil {
 		return nil, err
 	}
 
-	return nil, &ErrKeyNotFound{id}
+	var attempts core.LoginAttempts
+	err = query.QueryRowContext(store.ctx, key).Scan(&attempts.Key, &attempts.Failures, &attempts.LastFailureAt)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return &core.LoginAttempts{Key: key}, nil
+	default:
+		return nil, err
+	}
+
+	attempts.LastFailureAt = attempts.LastFailureAt.Local()
+	return &attempts, nil
 }
-func (store *postgresStorage) ExtractRandomKey() (*core.HmacKey, error) {
-	now := time.Now()
 
-	query, err := store.db.PrepareContext(store.ctx, "SELECT id, sign, expires_at from hmac_key WHERE expires_at > $1 ORDER BY RANDOM()")
+func (store *postgresStorage) RecordLoginFailure(key string, at time.Time, window time.Duration) (*core.LoginAttempts, error) {
+	// concurrent failures are counted by the database, so none of them is lost
+	query, err := store.db.PrepareContext(store.ctx, `INSERT INTO login_attempt(key, failures, last_failure_at) VALUES($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempt.last_failure_at < $3 THEN 1 ELSE login_attempt.failures + 1 END,
+			last_failure_at = $2
+		RETURNING key, failures, last_failure_at`)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := query.QueryContext(store.ctx, now)
+	var attempts core.LoginAttempts
+	err = query.QueryRowContext(store.ctx, key, at, at.Add(-window)).Scan(&attempts.Key, &attempts.Failures, &attempts.LastFailureAt)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts.LastFailureAt = attempts.LastFailureAt.Local()
+	return &attempts, nil
+}
+
+func (store *postgresStorage) ResetLoginAttempts(key string) error {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM login_attempt WHERE key = $1")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, key)
+	return err
+}
+
+// audit
+func (store *postgresStorage) CreateAuditEvent(event *core.AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	var userID uuid.NullUUID
+	if event.UserID != uuid.Nil {
+		userID = uuid.NullUUID{UUID: event.UserID, Valid: true}
+	}
+
+	var actorID uuid.NullUUID
+	if event.ActorID != uuid.Nil {
+		actorID = uuid.NullUUID{UUID: event.ActorID, Valid: true}
+	}
+
+	query, err := store.db.PrepareContext(store.ctx, "INSERT INTO audit_event(id, event_type, user_id, actor_id, request_id, login, ip, details, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, event.ID, event.Type, userID, actorID, event.RequestID, event.Login, event.IP, details, event.CreatedAt)
+	return err
+}
+
+func (store *postgresStorage) ExtractAuditEvents(filter AuditFilter) ([]*core.AuditEvent, error) {
+	conditions := []string{"TRUE"}
+	args := []interface{}{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.UserID != uuid.Nil {
+		conditions = append(conditions, "user_id = "+arg(filter.UserID))
+	}
+	if filter.ActorID != uuid.Nil {
+		conditions = append(conditions, "actor_id = "+arg(filter.ActorID))
+	}
+	if len(filter.Types) > 0 {
+		conditions = append(conditions, "event_type = ANY("+arg(pq.Array(filter.Types))+")")
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(filter.To))
+	}
+
+	statement := "SELECT id, event_type, user_id, actor_id, request_id, login, ip, details, created_at FROM audit_event WHERE " + strings.Join(conditions, " AND ") + " ORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		statement += " LIMIT " + arg(filter.Limit)
+	}
+	statement += " OFFSET " + arg(filter.Offset)
+
+	query, err := store.db.PrepareContext(store.ctx, statement)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := query.QueryContext(store.ctx, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	events := []*core.AuditEvent{}
 	for rows.Next() {
+		var event core.AuditEvent
+		var userID, actorID uuid.NullUUID
+		var details []byte
 
-		var key core.HmacKey
-		err = rows.Scan(&key.ID, &key.Sign, &key.ExpiresAt)
+		err = rows.Scan(&event.ID, &event.Type, &userID, &actorID, &event.RequestID, &event.Login, &event.IP, &details, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(details, &event.Details)
 		if err != nil {
 			return nil, err
 		}
 
-		if key.Fresh() {
-			return &key, nil
+		event.UserID = userID.UUID
+		event.ActorID = actorID.UUID
+		event.CreatedAt = event.CreatedAt.Local()
+		events = append(events, &event)
+	}
+	return events, rows.Err()
+}
+
+// ledger
+func (store *postgresStorage) createLedgerEntry(tx *sql.Tx, entry *core.LedgerEntry) error {
+	var orderID sql.NullString
+	if entry.OrderID != "" {
+		orderID = sql.NullString{String: entry.OrderID, Valid: true}
+	}
+
+	var reason sql.NullString
+	if entry.Reason != "" {
+		reason = sql.NullString{String: entry.Reason, Valid: true}
+	}
+	var operatorID uuid.NullUUID
+	if entry.OperatorID != uuid.Nil {
+		operatorID = uuid.NullUUID{UUID: entry.OperatorID, Valid: true}
+	}
+
+	putQuery, err := tx.PrepareContext(store.ctx, "INSERT INTO ledger_entry(id, user_id, entry_type, debit_account, credit_account, amount, order_id, reason, note, operator_id, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)")
+	if err != nil {
+		return err
+	}
+	_, err = putQuery.ExecContext(store.ctx, entry.ID, entry.UserID, entry.Type, entry.Debit, entry.Credit, entry.Amount, orderID, reason, entry.Note, operatorID, entry.CreatedAt)
+	return err
+}
+
+func (store *postgresStorage) AdjustBalance(entry *core.LedgerEntry) error {
+	tx, err := store.db.BeginTx(store.ctx, nil)
+	defer func() {
+		err := tx.Rollback()
+		if err != nil {
+			if err.Error() != "sql: transaction has already been committed or rolled back" {
+				log.Printf("error during transaction rollback: %v", err)
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	selectQuery, err := tx.PrepareContext(store.ctx, "SELECT balance FROM app_user WHERE id = $1 FOR UPDATE")
+	if err != nil {
+		return err
+	}
+
+	var balance decimal.Decimal
+	err = selectQuery.QueryRowContext(store.ctx, entry.UserID).Scan(&balance)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return &ErrUserNotFoundByID{entry.UserID}
+	default:
+		return err
+	}
+
+	balance = balance.Add(entry.Delta(core.UserAccount(entry.UserID)))
+	if balance.IsNegative() {
+		return &ErrBalanceExceeded{}
+	}
+
+	updateQuery, err := tx.PrepareContext(store.ctx, "UPDATE app_user SET balance = $1 WHERE id = $2")
+	if err != nil {
+		return err
+	}
+	_, err = updateQuery.ExecContext(store.ctx, balance, entry.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = store.createLedgerEntry(tx, entry)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *postgresStorage) ExtractLedgerEntries(user *core.User, limit int, offset int) ([]*core.LedgerEntry, error) {
+	entries := []*core.LedgerEntry{}
+
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, user_id, entry_type, debit_account, credit_account, amount, order_id, reason, note, operator_id, created_at FROM ledger_entry WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3")
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := query.QueryContext(store.ctx, user.ID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var entry core.LedgerEntry
+		var orderID, reason sql.NullString
+		var operatorID uuid.NullUUID
+
+		err = rows.Scan(&entry.ID, &entry.UserID, &entry.Type, &entry.Debit, &entry.Credit, &entry.Amount, &orderID, &reason, &entry.Note, &operatorID, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
 		}
+
+		entry.OrderID = orderID.String
+		entry.Reason = reason.String
+		entry.OperatorID = operatorID.UUID
+		entry.CreatedAt = entry.CreatedAt.Local()
+		entries = append(entries, &entry)
 	}
 	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	return nil, &ErrNoKeys{}
+	return entries, nil
 }
 
-func (store *postgresStorage) ExtractAllKeys() (map[uuid.UUID]core.HmacKey, error) {
-	keys := make(map[uuid.UUID]core.HmacKey)
-	now := time.Now()
-
-	query, err := store.db.PrepareContext(store.ctx, "SELECT id, sign, expires_at from hmac_key WHERE expires_at > $1")
+func (store *postgresStorage) ExtractBalanceMismatches() ([]*core.BalanceMismatch, error) {
+	mismatches := []*core.BalanceMismatch{}
 
+	query, err := store.db.PrepareContext(store.ctx, `
+		SELECT app_user.id, app_user.balance, COALESCE(SUM(ledger_entry.amount * CASE WHEN ledger_entry.credit_account = 'user:' || app_user.id THEN 1 ELSE -1 END), 0) AS ledger_balance
+		FROM app_user
+		LEFT JOIN ledger_entry ON ledger_entry.user_id = app_user.id
+		GROUP BY app_user.id, app_user.balance
+		HAVING app_user.balance != COALESCE(SUM(ledger_entry.amount * CASE WHEN ledger_entry.credit_account = 'user:' || app_user.id THEN 1 ELSE -1 END), 0)`)
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := query.QueryContext(store.ctx, now)
+	rows, err := query.QueryContext(store.ctx)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-
-		var key core.HmacKey
-		err = rows.Scan(&key.ID, &key.Sign, &key.ExpiresAt)
+		var mismatch core.BalanceMismatch
+		err = rows.Scan(&mismatch.UserID, &mismatch.Cached, &mismatch.Ledger)
 		if err != nil {
 			return nil, err
 		}
-		keys[key.ID] = key
+		mismatches = append(mismatches, &mismatch)
 	}
 	err = rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	return keys, nil
+	return mismatches, nil
 }
 
 // orders
-func (store *postgresStorage) CreateOrder(order *core.Order) error {
+func (store *postgresStorage) CreateOrder(order *core.Order, firstAttemptAt time.Time) error {
 	tx, err := store.db.BeginTx(store.ctx, nil)
 	defer func() {
 		err := tx.Rollback()
@@ -169,14 +1120,90 @@ func (store *postgresStorage) CreateOrder(order *core.Order) error {
 	if err != nil {
 		return err
 	}
+
+	job := core.NewAccrualJob(order, firstAttemptAt)
+	putQuery, err = tx.PrepareContext(store.ctx, "INSERT INTO accrual_job(order_id, status, attempts, next_attempt_at, created_at) VALUES($1, $2, $3, $4, $5)")
+	if err != nil {
+		return err
+	}
+	_, err = putQuery.ExecContext(store.ctx, job.OrderID, job.Status, job.Attempts, job.NextAttemptAt, job.CreatedAt)
+	if err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
+func (store *postgresStorage) ExtractOrder(orderID string) (*core.OrderDetails, error) {
+	query, err := store.db.PrepareContext(store.ctx, `
+		SELECT app_order.id, app_order.status, app_order.user_id, app_order.uploaded_at, app_order.accrual,
+			accrual_job.status, accrual_job.attempts, accrual_job.failures, accrual_job.last_error,
+			accrual_job.next_attempt_at, accrual_job.created_at,
+			withdrawal.id, withdrawal.withdrawal_sum, withdrawal.processed_at
+		FROM app_order
+		LEFT JOIN accrual_job ON accrual_job.order_id = app_order.id
+		LEFT JOIN withdrawal ON withdrawal.order_id = app_order.id
+		WHERE app_order.id = $1
+		LIMIT 1`)
+	if err != nil {
+		return nil, err
+	}
+
+	var order core.Order
+	var accrual decimal.NullDecimal
+	var jobStatus, lastError sql.NullString
+	var attempts, failures sql.NullInt64
+	var nextAttemptAt, createdAt sql.NullTime
+	var withdrawalID uuid.NullUUID
+	var sum decimal.NullDecimal
+	var processedAt sql.NullTime
+
+	err = query.QueryRowContext(store.ctx, orderID).Scan(
+		&order.ID, &order.Status, &order.UserID, &order.UploadedAt, &accrual,
+		&jobStatus, &attempts, &failures, &lastError, &nextAttemptAt, &createdAt,
+		&withdrawalID, &sum, &processedAt,
+	)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, &ErrOrderNotFound{orderID}
+	default:
+		return nil, err
+	}
+
+	if accrual.Valid {
+		order.Accrual = &accrual.Decimal
+	}
+	order.UploadedAt = order.UploadedAt.Local()
+	details := &core.OrderDetails{Order: &order}
+
+	if jobStatus.Valid {
+		details.Job = &core.AccrualJob{
+			OrderID:       order.ID,
+			Status:        jobStatus.String,
+			Attempts:      int(attempts.Int64),
+			Failures:      int(failures.Int64),
+			LastError:     lastError.String,
+			NextAttemptAt: nextAttemptAt.Time.Local(),
+			CreatedAt:     createdAt.Time.Local(),
+		}
+	}
+	if withdrawalID.Valid {
+		details.Withdrawal = &core.Withdrawal{
+			ID:          withdrawalID.UUID,
+			OrderID:     order.ID,
+			Sum:         sum.Decimal,
+			ProcessedAt: processedAt.Time.Local(),
+		}
+	}
+
+	return details, nil
+}
+
 func (store *postgresStorage) ExtractOrdersByUser(user *core.User) ([]*core.Order, error) {
 	userID := user.ID
 	orders := []*core.Order{}
 
-	query, err := store.db.PrepareContext(store.ctx, "SELECT id, status, user_id, uploaded_at, accrual from app_order WHERE user_id = $1")
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, status, user_id, uploaded_at, accrual from app_order WHERE user_id = $1 ORDER BY uploaded_at")
 
 	if err != nil {
 		return nil, err
@@ -278,20 +1305,32 @@ func (store *postgresStorage) CreateUser(user *core.User) error {
 		return err
 	}
 
-	putQuery, err := tx.PrepareContext(store.ctx, "INSERT INTO app_user(id, login, password_hash, balance) VALUES($1, $2, $3, $4)")
+	putQuery, err := tx.PrepareContext(store.ctx, "INSERT INTO app_user(id, login, password_hash, balance, role, disabled) VALUES($1, $2, $3, $4, $5, $6)")
+	if err != nil {
+		return err
+	}
+	_, err = putQuery.Exec(user.ID, user.Login, user.PasswordHash, user.Balance, user.Role, user.Disabled)
 	if err != nil {
 		return err
 	}
-	_, err = putQuery.Exec(user.ID, user.Login, user.PasswordHash, user.Balance)
+
+	entry, err := core.NewOpeningEntry(user, time.Now())
 	if err != nil {
 		return err
 	}
+	if entry != nil {
+		err = store.createLedgerEntry(tx, entry)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = tx.Commit()
 	return err
 }
 
 func (store *postgresStorage) ExtractUser(login string) (*core.User, error) {
-	query, err := store.db.PrepareContext(store.ctx, "SELECT id, login, password_hash, balance from app_user WHERE login = $1")
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, login, password_hash, balance, role, disabled from app_user WHERE login = $1")
 	if err != nil {
 		return nil, err
 	}
@@ -306,36 +1345,93 @@ func (store *postgresStorage) ExtractUser(login string) (*core.User, error) {
 	}
 
 	var user core.User
-	err = row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Balance)
+	err = row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Balance, &user.Role, &user.Disabled)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (store *postgresStorage) ExtractUserByID(id uuid.UUID) (*core.User, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, login, password_hash, balance, role, disabled from app_user WHERE id = $1")
+	if err != nil {
+		return nil, err
+	}
+
+	row := query.QueryRowContext(store.ctx, id)
+	switch row.Err() {
+	case sql.ErrNoRows:
+		return nil, &ErrUserNotFoundByID{id}
+	case nil:
+	default:
+		return nil, err
+	}
+
+	var user core.User
+	err = row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Balance, &user.Role, &user.Disabled)
 	if err != nil {
 		return nil, err
 	}
-
-	return &user, nil
+
+	return &user, nil
+}
+
+func (store *postgresStorage) UpdatePasswordHash(user *core.User) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE app_user SET password_hash = $2 WHERE id = $1")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, user.ID, user.PasswordHash)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrUserNotFoundByID{user.ID}
+	}
+	return nil
+}
+
+func (store *postgresStorage) UpdateUserRole(userID uuid.UUID, role core.Role) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE app_user SET role = $2 WHERE id = $1")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, userID, role)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrUserNotFoundByID{userID}
+	}
+	return nil
 }
 
-func (store *postgresStorage) ExtractUserByID(id uuid.UUID) (*core.User, error) {
-	query, err := store.db.PrepareContext(store.ctx, "SELECT id, login, password_hash, balance from app_user WHERE id = $1")
+func (store *postgresStorage) SetUserDisabled(userID uuid.UUID, disabled bool) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE app_user SET disabled = $2 WHERE id = $1")
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	row := query.QueryRowContext(store.ctx, id)
-	switch row.Err() {
-	case sql.ErrNoRows:
-		return nil, &ErrUserNotFoundByID{id}
-	case nil:
-	default:
-		return nil, err
+	res, err := query.ExecContext(store.ctx, userID, disabled)
+	if err != nil {
+		return err
 	}
-
-	var user core.User
-	err = row.Scan(&user.ID, &user.Login, &user.PasswordHash, &user.Balance)
+	n, err := res.RowsAffected()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &user, nil
+	if n != 1 {
+		return &ErrUserNotFoundByID{userID}
+	}
+	return nil
 }
 
 // withdrawals
@@ -418,10 +1514,122 @@ func (store *postgresStorage) CreateWithdrawal(withdrawal *core.Withdrawal, orde
 		return err
 	}
 
+	entry, err := core.NewWithdrawalEntry(withdrawal, order)
+	if err != nil {
+		return err
+	}
+	err = store.createLedgerEntry(tx, entry)
+	if err != nil {
+		return err
+	}
+
 	err = tx.Commit()
 	return err
 }
 
+// pageConditions returns conditions and ordering selecting page of records
+// by timeColumn and idColumn, arg binds query arguments
+func pageConditions(page Page, timeColumn string, idColumn string, arg func(interface{}) string) ([]string, string) {
+	conditions := []string{}
+	if !page.From.IsZero() {
+		conditions = append(conditions, timeColumn+" >= "+arg(page.From))
+	}
+	if !page.To.IsZero() {
+		conditions = append(conditions, timeColumn+" < "+arg(page.To))
+	}
+
+	comparison, direction := ">", "ASC"
+	if page.Descending {
+		comparison, direction = "<", "DESC"
+	}
+	if page.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(%s, %s) %s (%s, %s)", timeColumn, idColumn, comparison, arg(page.After.At), arg(page.After.ID)))
+	}
+
+	order := fmt.Sprintf("ORDER BY %s %s, %s %s", timeColumn, direction, idColumn, direction)
+	if page.Limit > 0 {
+		order += " LIMIT " + arg(page.Limit)
+	}
+	return conditions, order
+}
+
+func (store *postgresStorage) ExtractOrdersPage(user *core.User, page OrdersPage) ([]*core.Order, error) {
+	args := []interface{}{user.ID}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// ids are compared byte by byte, the same way cursors are
+	conditions, order := pageConditions(page.Page, "uploaded_at", "id COLLATE \"C\"", arg)
+	conditions = append([]string{"user_id = $1"}, conditions...)
+	if len(page.Statuses) > 0 {
+		conditions = append(conditions, "status = ANY("+arg(pq.Array(page.Statuses))+")")
+	}
+
+	query, err := store.db.PrepareContext(store.ctx, "SELECT id, status, user_id, uploaded_at, accrual FROM app_order WHERE "+strings.Join(conditions, " AND ")+" "+order)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := query.QueryContext(store.ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []*core.Order{}
+	for rows.Next() {
+		var order core.Order
+		var accrual decimal.NullDecimal
+
+		err = rows.Scan(&order.ID, &order.Status, &order.UserID, &order.UploadedAt, &accrual)
+		if err != nil {
+			return nil, err
+		}
+		if accrual.Valid {
+			order.Accrual = &accrual.Decimal
+		}
+
+		order.UploadedAt = order.UploadedAt.Local()
+		orders = append(orders, &order)
+	}
+	return orders, rows.Err()
+}
+
+func (store *postgresStorage) ExtractWithdrawalsPage(user *core.User, page Page) ([]*core.Withdrawal, error) {
+	args := []interface{}{user.ID}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions, order := pageConditions(page, "withdrawal.processed_at", "withdrawal.id", arg)
+	conditions = append([]string{"app_order.user_id = $1"}, conditions...)
+
+	query, err := store.db.PrepareContext(store.ctx, "SELECT withdrawal.id, order_id, withdrawal_sum, processed_at FROM withdrawal INNER JOIN app_order ON withdrawal.order_id = app_order.id WHERE "+strings.Join(conditions, " AND ")+" "+order)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := query.QueryContext(store.ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	withdrawals := []*core.Withdrawal{}
+	for rows.Next() {
+		var withdrawal core.Withdrawal
+		err = rows.Scan(&withdrawal.ID, &withdrawal.OrderID, &withdrawal.Sum, &withdrawal.ProcessedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		withdrawal.ProcessedAt = withdrawal.ProcessedAt.Local()
+		withdrawals = append(withdrawals, &withdrawal)
+	}
+	return withdrawals, rows.Err()
+}
+
 func (store *postgresStorage) ExtractWithdrawalsByUser(user *core.User) ([]*core.Withdrawal, error) {
 	var withdrawals []*core.Withdrawal
 
@@ -489,6 +1697,9 @@ func (store *postgresStorage) ProcessAccrual(orderID string, status string, sum
 	if status != core.NEW && status != core.PROCESSING && status != core.INVALID && status != core.PROCESSED {
 		return fmt.Errorf("invalid order status: %s", status)
 	}
+	if sum != nil && sum.IsNegative() {
+		return &ErrNegativeAccrual{orderID, *sum}
+	}
 
 	tx, err := store.db.BeginTx(store.ctx, nil)
 	defer func() {
@@ -503,11 +1714,28 @@ func (store *postgresStorage) ProcessAccrual(orderID string, status string, sum
 		return err
 	}
 
-	query, err := tx.PrepareContext(store.ctx, "UPDATE app_order SET status = $2 WHERE id = $1 AND status != $3 AND status != $4")
+	query, err := tx.PrepareContext(store.ctx, "SELECT status FROM app_order WHERE id = $1 FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	var current string
+	err = query.QueryRowContext(store.ctx, orderID).Scan(&current)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return &ErrOrderNotFound{orderID}
+	default:
+		return err
+	}
+	if current == core.PROCESSED || current == core.INVALID {
+		return &ErrOrderAlreadyProcessed{orderID, current}
+	}
+
+	query, err = tx.PrepareContext(store.ctx, "UPDATE app_order SET status = $2 WHERE id = $1")
 	if err != nil {
 		return err
 	}
-	res, err := query.ExecContext(store.ctx, orderID, status, core.PROCESSED, core.INVALID)
+	res, err := query.ExecContext(store.ctx, orderID, status)
 	if err != nil {
 		return err
 	}
@@ -536,82 +1764,279 @@ func (store *postgresStorage) ProcessAccrual(orderID string, status string, sum
 			return fmt.Errorf("expected one row to be affected, got %d", n)
 		}
 
-		query, err = tx.PrepareContext(store.ctx, "UPDATE app_user SET balance = balance + $2 FROM app_order WHERE app_order.id = $1 AND app_user.id = app_order.user_id")
-		if err != nil {
-			return err
-		}
-		res, err = query.ExecContext(store.ctx, orderID, *sum)
-		if err != nil {
-			return err
-		}
-		n, err = res.RowsAffected()
-		if err != nil {
-			return err
-		}
-		if n != 1 {
-			return fmt.Errorf("expected one row to be affected, got %d", n)
+		if sum.IsPositive() {
+			query, err = tx.PrepareContext(store.ctx, "SELECT user_id FROM app_order WHERE id = $1")
+			if err != nil {
+				return err
+			}
+			order := core.Order{ID: orderID}
+			err = query.QueryRowContext(store.ctx, orderID).Scan(&order.UserID)
+			if err != nil {
+				return err
+			}
+
+			entry, err := core.NewAccrualEntry(&order, *sum, time.Now())
+			if err != nil {
+				return err
+			}
+			err = store.createLedgerEntry(tx, entry)
+			if err != nil {
+				return err
+			}
+
+			query, err = tx.PrepareContext(store.ctx, "UPDATE app_user SET balance = balance + $2 FROM app_order WHERE app_order.id = $1 AND app_user.id = app_order.user_id")
+			if err != nil {
+				return err
+			}
+			res, err = query.ExecContext(store.ctx, orderID, *sum)
+			if err != nil {
+				return err
+			}
+			n, err = res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if n != 1 {
+				return fmt.Errorf("expected one row to be affected, got %d", n)
+			}
 		}
 	}
 
 	return tx.Commit()
 }
 
-func (store *postgresStorage) Ping(ctx context.Context) error {
-	return store.db.PingContext(ctx)
-}
+// jobs
+const jobColumns = "order_id, status, attempts, failures, last_error, next_attempt_at, locked_by, locked_until, created_at"
 
-func (store *postgresStorage) WithContext(ctx context.Context) Storage {
-	newStore := *store
-	newStore.ctx = ctx
-	return &newStore
-}
+func scanJobs(rows *sql.Rows) ([]*core.AccrualJob, error) {
+	jobs := []*core.AccrualJob{}
 
-func NewPostgresStorage(dsn string) (Storage, error) {
-	db, err := sql.Open("postgres", dsn)
+	for rows.Next() {
+		var job core.AccrualJob
+		var lockedBy sql.NullString
+		var lockedUntil sql.NullTime
+
+		err := rows.Scan(&job.OrderID, &job.Status, &job.Attempts, &job.Failures, &job.LastError, &job.NextAttemptAt, &lockedBy, &lockedUntil, &job.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		job.LockedBy = lockedBy.String
+		if lockedUntil.Valid {
+			until := lockedUntil.Time.Local()
+			job.LockedUntil = &until
+		}
+		job.NextAttemptAt = job.NextAttemptAt.Local()
+		job.CreatedAt = job.CreatedAt.Local()
+		jobs = append(jobs, &job)
+	}
+	err := rows.Err()
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS hmac_key (id UUID PRIMARY KEY, sign BYTEA NOT NULL, expires_at TIMESTAMP WITH TIME ZONE NOT NULL)")
+	return jobs, nil
+}
+
+func (store *postgresStorage) LeaseJobs(owner string, limit int, lease time.Duration) ([]*core.AccrualJob, error) {
+	now := time.Now()
+
+	// SKIP LOCKED lets concurrent replicas lease disjoint batches of jobs
+	query, err := store.db.PrepareContext(store.ctx, `
+		UPDATE accrual_job SET locked_by = $1, locked_until = $2, attempts = attempts + 1
+		WHERE order_id IN (
+			SELECT order_id FROM accrual_job
+			WHERE status = $5 AND next_attempt_at <= $3 AND (locked_until IS NULL OR locked_until < $3)
+			ORDER BY next_attempt_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns)
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS expires_index ON hmac_key (expires_at)")
+
+	rows, err := query.QueryContext(store.ctx, owner, now.Add(lease), now, limit, core.PENDING)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS app_user (id UUID PRIMARY KEY, login TEXT NOT NULL, password_hash TEXT NOT NULL, balance NUMERIC NOT NULL DEFAULT 0)")
+	jobs, err := scanJobs(rows)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS app_order (id TEXT PRIMARY KEY, status VARCHAR(255) NOT NULL, uploaded_at TIMESTAMP WITH TIME ZONE NOT NULL, user_id UUID NOT NULL, accrual NUMERIC NULL DEFAULT NULL, CONSTRAINT fk_user FOREIGN KEY(user_id) REFERENCES app_user(id))")
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].NextAttemptAt.Before(jobs[j].NextAttemptAt)
+	})
+
+	return jobs, nil
+}
+
+func (store *postgresStorage) CompleteJob(orderID string, owner string) error {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM accrual_job WHERE order_id = $1 AND locked_by = $2")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS uploaded_at_index ON app_order (uploaded_at)")
+	res, err := query.ExecContext(store.ctx, orderID, owner)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+	return nil
+}
+
+func (store *postgresStorage) RescheduleJob(orderID string, owner string, nextAttemptAt time.Time) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE accrual_job SET next_attempt_at = $3, locked_by = NULL, locked_until = NULL WHERE order_id = $1 AND locked_by = $2")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, orderID, owner, nextAttemptAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+	return nil
+}
+
+func (store *postgresStorage) FailJob(orderID string, owner string, reason string, nextAttemptAt time.Time) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE accrual_job SET failures = failures + 1, last_error = $3, next_attempt_at = $4, locked_by = NULL, locked_until = NULL WHERE order_id = $1 AND locked_by = $2")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, orderID, owner, reason, nextAttemptAt)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrJobLeaseLost{orderID, owner}
+	}
+	return nil
+}
+
+func (store *postgresStorage) BuryJob(orderID string, owner string, reason string) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE accrual_job SET status = $3, failures = failures + 1, last_error = $4, locked_by = NULL, locked_until = NULL WHERE order_id = $1 AND locked_by = $2")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, orderID, owner, core.DEAD, reason)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return &ErrJobLeaseLost{orderID, owner}
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS user_index ON app_order (user_id)")
+	return nil
+}
+
+func (store *postgresStorage) ExtractDeadJobs() ([]*core.AccrualJob, error) {
+	query, err := store.db.PrepareContext(store.ctx, "SELECT "+jobColumns+" FROM accrual_job WHERE status = $1 ORDER BY created_at")
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS status_index ON app_order (status)")
+
+	rows, err := query.QueryContext(store.ctx, core.DEAD)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS withdrawal (id UUID PRIMARY KEY, order_id TEXT NOT NULL, processed_at TIMESTAMP WITH TIME ZONE NOT NULL, withdrawal_sum NUMERIC NOT NULL DEFAULT 0, CONSTRAINT fk_order FOREIGN KEY(order_id) REFERENCES app_order(id))")
+	return scanJobs(rows)
+}
+
+func (store *postgresStorage) RequeueJob(orderID string) error {
+	// jobs held by workers are left alone, so that no order is processed
+	// by two workers at once
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE accrual_job SET status = $2, failures = 0, next_attempt_at = $3 WHERE order_id = $1 AND (locked_until IS NULL OR locked_until < $3)")
+	if err != nil {
+		return err
+	}
+	res, err := query.ExecContext(store.ctx, orderID, core.PENDING, time.Now())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 1 {
+		return nil
+	}
+
+	query, err = store.db.PrepareContext(store.ctx, "SELECT 1 FROM accrual_job WHERE order_id = $1")
+	if err != nil {
+		return err
+	}
+	var found int
+	err = query.QueryRowContext(store.ctx, orderID).Scan(&found)
+	switch err {
+	case nil:
+		return &ErrJobLeased{orderID}
+	case sql.ErrNoRows:
+		return &ErrJobNotFound{orderID}
+	default:
+		return err
+	}
+}
+
+func (store *postgresStorage) SettleJob(orderID string) error {
+	query, err := store.db.PrepareContext(store.ctx, "DELETE FROM accrual_job WHERE order_id = $1")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, orderID)
+	return err
+}
+
+func (store *postgresStorage) DeferJob(orderID string, nextAttemptAt time.Time) error {
+	query, err := store.db.PrepareContext(store.ctx, "UPDATE accrual_job SET next_attempt_at = $3 WHERE order_id = $1 AND status = $2 AND next_attempt_at < $3")
+	if err != nil {
+		return err
+	}
+	_, err = query.ExecContext(store.ctx, orderID, core.PENDING, nextAttemptAt)
+	return err
+}
+
+func (store *postgresStorage) Ping(ctx context.Context) error {
+	return store.db.PingContext(ctx)
+}
+
+func (store *postgresStorage) WithContext(ctx context.Context) Storage {
+	newStore := *store
+	newStore.ctx = ctx
+	return &newStore
+}
+
+func NewPostgresStorage(dsn string) (Storage, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS order_index ON withdrawal (order_id)")
+
+	migrator, err := NewMigrator(db)
 	if err != nil {
 		return nil, err
 	}
-	_, err = db.Exec("CREATE INDEX IF NOT EXISTS processed_index ON withdrawal (processed_at)")
+	_, err = migrator.Up(context.Background())
 	if err != nil {
 		return nil, err
 	}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/devsagul/gophemart/internal/core"
 	"github.com/google/uuid"
@@ -10,15 +11,181 @@ import (
 )
 
 type AuthStorage interface {
-	CreateKey(*core.HmacKey) error
-	ExtractKey(uuid.UUID) (*core.HmacKey, error)
-	ExtractRandomKey() (*core.HmacKey, error)
-	ExtractAllKeys() (map[uuid.UUID]core.HmacKey, error)
+	CreateKey(*core.SigningKey) error
+	ExtractKey(uuid.UUID) (*core.SigningKey, error)
+	ExtractRandomKey(algorithm string) (*core.SigningKey, error)
+	ExtractAllKeys() (map[uuid.UUID]core.SigningKey, error)
+	DeleteExpiredKeys() (int, error)
+	// DeleteKeysExcept invalidates every token issued so far with keys other
+	// than the ones to keep
+	DeleteKeysExcept(keep []uuid.UUID) (int, error)
+}
+
+type SessionsStorage interface {
+	CreateSession(*core.Session, *core.RefreshToken) error
+	ExtractSession(uuid.UUID) (*core.Session, error)
+	RevokeSession(uuid.UUID) error
+	RevokeAllSessions() (int, error)
+	// RevokeUserSessions revokes every session of the user but the one to
+	// keep, which may be uuid.Nil, and returns ids of the revoked ones
+	RevokeUserSessions(userID uuid.UUID, keep uuid.UUID) ([]uuid.UUID, error)
+	ExtractRefreshToken(hash []byte) (*core.RefreshToken, error)
+	// RotateRefreshToken marks used token as used and stores next one in its
+	// place, it fails with ErrRefreshTokenReused if used token was used already
+	RotateRefreshToken(used *core.RefreshToken, next *core.RefreshToken) error
+}
+
+type PasswordResetStorage interface {
+	CreatePasswordResetToken(*core.PasswordResetToken) error
+	ExtractPasswordResetToken(hash []byte) (*core.PasswordResetToken, error)
+	// ResetPassword marks token as used and stores the password hash of
+	// user at once, it fails with ErrPasswordResetTokenUsed if the token was
+	// used already
+	ResetPassword(token *core.PasswordResetToken, user *core.User) error
+}
+
+type TwoFactorStorage interface {
+	// CreateTwoFactor replaces pending enrollment of the user, it fails with
+	// ErrTwoFactorEnabled if two factor authentication is enabled already
+	CreateTwoFactor(*core.TwoFactor) error
+	ExtractTwoFactor(userID uuid.UUID) (*core.TwoFactor, error)
+	// EnableTwoFactor enables pending enrollment, counter is the time step
+	// of the code it was confirmed with, recovery codes of the user are
+	// replaced with the given ones
+	EnableTwoFactor(userID uuid.UUID, counter int64, recoveryCodes [][]byte) error
+	// DisableTwoFactor removes the enrollment along with recovery codes
+	DisableTwoFactor(userID uuid.UUID) error
+	// UseTOTPCounter fails with ErrTOTPCodeReused unless counter is past
+	// the one of the last accepted code, so that no code is accepted twice
+	UseTOTPCounter(userID uuid.UUID, counter int64) error
+	UseRecoveryCode(userID uuid.UUID, hash []byte) error
+}
+
+type APIKeysStorage interface {
+	CreateAPIKey(*core.APIKey) error
+	ExtractAPIKey(hash []byte) (*core.APIKey, error)
+	ExtractAPIKeysByUser(userID uuid.UUID) ([]*core.APIKey, error)
+	// RevokeAPIKey deletes the key, provided it belongs to the user
+	RevokeAPIKey(userID uuid.UUID, id uuid.UUID) error
+	// RevokeUserAPIKeys deletes every key of the user
+	RevokeUserAPIKeys(userID uuid.UUID) (int, error)
+	TouchAPIKey(id uuid.UUID, usedAt time.Time) error
+}
+
+type IdempotencyStorage interface {
+	// CreateIdempotencyRecord reserves the key of the record for its user,
+	// it fails with ErrIdempotencyKeyExists while an unexpired record for
+	// the key exists, expired ones are replaced
+	CreateIdempotencyRecord(*core.IdempotencyRecord) error
+	// ExtractIdempotencyRecord fails with ErrIdempotencyRecordNotFound for
+	// expired records as well
+	ExtractIdempotencyRecord(userID uuid.UUID, key string) (*core.IdempotencyRecord, error)
+	// CompleteIdempotencyRecord stores the status and the body of the record
+	CompleteIdempotencyRecord(*core.IdempotencyRecord) error
+	DeleteIdempotencyRecord(userID uuid.UUID, key string) error
+	// DeleteExpiredIdempotencyRecords purges records whose keys may be used
+	// again, so that their responses are not kept forever
+	DeleteExpiredIdempotencyRecords() (int, error)
+}
+
+type LoginAttemptsStorage interface {
+	// ExtractLoginAttempts returns zero failures for keys never failed
+	ExtractLoginAttempts(key string) (*core.LoginAttempts, error)
+	// RecordLoginFailure counts a failure at the given moment, failures
+	// which happened more than window before it are forgotten
+	RecordLoginFailure(key string, at time.Time, window time.Duration) (*core.LoginAttempts, error)
+	ResetLoginAttempts(key string) error
+}
+
+// AuditFilter selects audit events, zero fields match any event. Events are
+// matched if they were created within [From, To), zero Limit means no limit.
+type AuditFilter struct {
+	UserID  uuid.UUID
+	ActorID uuid.UUID
+	Types   []core.AuditEventType
+	From    time.Time
+	To      time.Time
+	Limit   int
+	Offset  int
+}
+
+func (filter *AuditFilter) match(event *core.AuditEvent) bool {
+	if filter.UserID != uuid.Nil && event.UserID != filter.UserID {
+		return false
+	}
+	if filter.ActorID != uuid.Nil && event.ActorID != filter.ActorID {
+		return false
+	}
+	if len(filter.Types) > 0 {
+		found := false
+		for _, eventType := range filter.Types {
+			if event.Type == eventType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !filter.From.IsZero() && event.CreatedAt.Before(filter.From) {
+		return false
+	}
+	if !filter.To.IsZero() && !event.CreatedAt.Before(filter.To) {
+		return false
+	}
+	return true
+}
+
+// AuditStorage is append-only, recorded events are never changed
+type AuditStorage interface {
+	CreateAuditEvent(*core.AuditEvent) error
+	// ExtractAuditEvents returns events matching filter, newest first
+	ExtractAuditEvents(filter AuditFilter) ([]*core.AuditEvent, error)
+}
+
+// Page selects up to Limit records created within [From, To) which follow
+// After, zero fields do not restrict anything. Records are ordered by time
+// and then by id, newest first if Descending is set.
+type Page struct {
+	After      *core.Cursor
+	From       time.Time
+	To         time.Time
+	Descending bool
+	Limit      int
+}
+
+func (page *Page) match(at time.Time, id string) bool {
+	if !page.From.IsZero() && at.Before(page.From) {
+		return false
+	}
+	if !page.To.IsZero() && !at.Before(page.To) {
+		return false
+	}
+	return page.After == nil || page.After.Follows(at, id, page.Descending)
+}
+
+func (page *Page) less(atI time.Time, idI string, atJ time.Time, idJ string) bool {
+	if !atI.Equal(atJ) {
+		return atI.Before(atJ) != page.Descending
+	}
+	return (idI < idJ) != page.Descending
+}
+
+type OrdersPage struct {
+	Page
+	Statuses []core.OrderStatus
 }
 
 type OrdersStorage interface {
-	CreateOrder(*core.Order) error
+	// CreateOrder creates the order along with its accrual job, which is
+	// first attempted at firstAttemptAt
+	CreateOrder(order *core.Order, firstAttemptAt time.Time) error
+	// ExtractOrder fails with ErrOrderNotFound whoever the order belongs to,
+	// callers check the owner themselves
+	ExtractOrder(orderID string) (*core.OrderDetails, error)
 	ExtractOrdersByUser(*core.User) ([]*core.Order, error)
+	ExtractOrdersPage(user *core.User, page OrdersPage) ([]*core.Order, error)
 	ExtractUnterminatedOrders() ([]*core.Order, error)
 }
 
@@ -26,26 +193,69 @@ type UsersStorage interface {
 	CreateUser(*core.User) error
 	ExtractUser(string) (*core.User, error)
 	ExtractUserByID(uuid.UUID) (*core.User, error)
+	UpdatePasswordHash(*core.User) error
+	UpdateUserRole(userID uuid.UUID, role core.Role) error
+	SetUserDisabled(userID uuid.UUID, disabled bool) error
 }
 
 type WithdrawalsStorage interface {
 	CreateWithdrawal(*core.Withdrawal, *core.Order) error
 	ExtractWithdrawalsByUser(*core.User) ([]*core.Withdrawal, error)
+	ExtractWithdrawalsPage(user *core.User, page Page) ([]*core.Withdrawal, error)
 	TotalWithdrawnSum(*core.User) (decimal.Decimal, error)
 }
 
 type AccrualStorage interface {
+	// ProcessAccrual fails with ErrOrderAlreadyProcessed once the order
+	// reached PROCESSED or INVALID status, so the sum is never credited twice.
+	// Negative sums are rejected with ErrNegativeAccrual, every change of the
+	// balance has a ledger entry.
 	ProcessAccrual(orderID string, status string, sum *decimal.Decimal) error
 }
 
+type JobsStorage interface {
+	LeaseJobs(owner string, limit int, lease time.Duration) ([]*core.AccrualJob, error)
+	CompleteJob(orderID string, owner string) error
+	RescheduleJob(orderID string, owner string, nextAttemptAt time.Time) error
+	FailJob(orderID string, owner string, reason string, nextAttemptAt time.Time) error
+	BuryJob(orderID string, owner string, reason string) error
+	ExtractDeadJobs() ([]*core.AccrualJob, error)
+	// RequeueJob makes the job due right away with failures forgotten, it
+	// fails with ErrJobLeased while a worker holds the job
+	RequeueJob(orderID string) error
+	// SettleJob removes the job whoever holds it, DeferJob postpones the
+	// next attempt of a pending job, they are used when the accrual system
+	// pushes order statuses itself
+	SettleJob(orderID string) error
+	DeferJob(orderID string, nextAttemptAt time.Time) error
+}
+
+type LedgerStorage interface {
+	ExtractLedgerEntries(user *core.User, limit int, offset int) ([]*core.LedgerEntry, error)
+	// AdjustBalance applies an adjustment entry to the balance of its user
+	// and records it, it fails with ErrBalanceExceeded if a debit would
+	// take the balance below zero
+	AdjustBalance(*core.LedgerEntry) error
+	ExtractBalanceMismatches() ([]*core.BalanceMismatch, error)
+}
+
 type Storage interface {
 	Ping(context.Context) error
 	WithContext(context.Context) Storage
 	AuthStorage
+	SessionsStorage
+	PasswordResetStorage
+	TwoFactorStorage
+	APIKeysStorage
+	IdempotencyStorage
+	LoginAttemptsStorage
+	AuditStorage
 	OrdersStorage
 	UsersStorage
 	WithdrawalsStorage
 	AccrualStorage
+	LedgerStorage
+	JobsStorage
 }
 
 // errors
@@ -65,6 +275,105 @@ func (err *ErrNoKeys) Error() string {
 	return "there are no active keys in storage"
 }
 
+// session
+type ErrSessionNotFound struct {
+	id uuid.UUID
+}
+
+func (err *ErrSessionNotFound) Error() string {
+	return fmt.Sprintf("session with id %s not found", err.id)
+}
+
+type ErrRefreshTokenNotFound struct{}
+
+func (err *ErrRefreshTokenNotFound) Error() string {
+	return "refresh token not found"
+}
+
+type ErrRefreshTokenReused struct {
+	id uuid.UUID
+}
+
+func (err *ErrRefreshTokenReused) Error() string {
+	return fmt.Sprintf("refresh token %s has already been used", err.id)
+}
+
+// password reset
+type ErrPasswordResetTokenNotFound struct{}
+
+func (err *ErrPasswordResetTokenNotFound) Error() string {
+	return "password reset token not found"
+}
+
+type ErrPasswordResetTokenUsed struct {
+	id uuid.UUID
+}
+
+func (err *ErrPasswordResetTokenUsed) Error() string {
+	return fmt.Sprintf("password reset token %s has already been used", err.id)
+}
+
+// two factor authentication
+type ErrTwoFactorNotFound struct {
+	userID uuid.UUID
+}
+
+func (err *ErrTwoFactorNotFound) Error() string {
+	return fmt.Sprintf("user %s has not enrolled in two factor authentication", err.userID)
+}
+
+type ErrTwoFactorEnabled struct {
+	userID uuid.UUID
+}
+
+func (err *ErrTwoFactorEnabled) Error() string {
+	return fmt.Sprintf("two factor authentication is enabled already for user %s", err.userID)
+}
+
+type ErrTOTPCodeReused struct {
+	userID  uuid.UUID
+	counter int64
+}
+
+func (err *ErrTOTPCodeReused) Error() string {
+	return fmt.Sprintf("code of time step %d has already been used by user %s", err.counter, err.userID)
+}
+
+type ErrRecoveryCodeNotFound struct{}
+
+func (err *ErrRecoveryCodeNotFound) Error() string {
+	return "recovery code not found or used already"
+}
+
+// api keys
+type ErrAPIKeyNotFound struct {
+	id uuid.UUID
+}
+
+func (err *ErrAPIKeyNotFound) Error() string {
+	if err.id == uuid.Nil {
+		return "api key not found"
+	}
+	return fmt.Sprintf("api key with id %s not found", err.id)
+}
+
+// idempotency
+type ErrIdempotencyKeyExists struct {
+	key string
+}
+
+func (err *ErrIdempotencyKeyExists) Error() string {
+	return fmt.Sprintf("idempotency key %s has already been used", err.key)
+}
+
+type ErrIdempotencyRecordNotFound struct {
+	key string
+}
+
+func (err *ErrIdempotencyRecordNotFound) Error() string {
+	return fmt.Sprintf("there is no response stored for idempotency key %s", err.key)
+}
+
 // order
 type ErrOrderExists struct {
 	orderID string
@@ -82,6 +391,58 @@ func (err *ErrOrderIDCollission) Error() string {
 	return fmt.Sprintf("order with id %s exists already for other user", err.orderID)
 }
 
+type ErrOrderNotFound struct {
+	orderID string
+}
+
+func (err *ErrOrderNotFound) Error() string {
+	return fmt.Sprintf("order with id %s does not exist", err.orderID)
+}
+
+type ErrOrderAlreadyProcessed struct {
+	orderID string
+	status  string
+}
+
+func (err *ErrOrderAlreadyProcessed) Error() string {
+	return fmt.Sprintf("order with id %s has already been processed with status %s", err.orderID, err.status)
+}
+
+type ErrNegativeAccrual struct {
+	orderID string
+	sum     decimal.Decimal
+}
+
+func (err *ErrNegativeAccrual) Error() string {
+	return fmt.Sprintf("accrual %s of order %s is negative", err.sum, err.orderID)
+}
+
+// jobs
+type ErrJobLeaseLost struct {
+	orderID string
+	owner   string
+}
+
+func (err *ErrJobLeaseLost) Error() string {
+	return fmt.Sprintf("job for order %s is not leased by %s anymore", err.orderID, err.owner)
+}
+
+type ErrJobNotFound struct {
+	orderID string
+}
+
+func (err *ErrJobNotFound) Error() string {
+	return fmt.Sprintf("there is no accrual job for order %s", err.orderID)
+}
+
+type ErrJobLeased struct {
+	orderID string
+}
+
+func (err *ErrJobLeased) Error() string {
+	return fmt.Sprintf("accrual job for order %s is being processed", err.orderID)
+}
+
 // user
 type ErrUserNotFound struct {
 	login string
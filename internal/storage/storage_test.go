@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/devsagul/gophemart/internal/core"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// backends are stores tests run against, Postgres is used if DATABASE_URI
+// points to a database which may be written to
+func backends(t *testing.T) map[string]Storage {
+	stores := map[string]Storage{"mem": NewMemStorage()}
+
+	dsn := os.Getenv("DATABASE_URI")
+	if dsn == "" {
+		return stores
+	}
+	store, err := NewPostgresStorage(dsn)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	stores["postgres"] = store
+	return stores
+}
+
+// orderID returns a random order number passing the Luhn check, so that
+// runs against the same database do not collide
+func orderID() string {
+	digits := fmt.Sprintf("%015d", rand.Int63n(1e15))
+	for check := 0; check < 10; check++ {
+		id := fmt.Sprintf("%s%d", digits, check)
+		if _, err := core.NewOrder(id, &core.User{}, time.Now()); err == nil {
+			return id
+		}
+	}
+	panic("no check digit fits")
+}
+
+func TestProcessAccrual(t *testing.T) {
+	t.Parallel()
+
+	for name, store := range backends(t) {
+		store := store
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			assert := assert.New(t)
+
+			user, err := core.NewUser(fmt.Sprintf("accrual-%s", uuid.New()), "sikret")
+			if !assert.NoError(err) {
+				return
+			}
+			err = store.CreateUser(user)
+			if !assert.NoError(err) {
+				return
+			}
+
+			orders := make([]*core.Order, 3)
+			for i := range orders {
+				orders[i], err = core.NewOrder(orderID(), user, time.Now())
+				if !assert.NoError(err) {
+					return
+				}
+				err = store.CreateOrder(orders[i], orders[i].UploadedAt)
+				if !assert.NoError(err) {
+					return
+				}
+			}
+
+			type testCase struct {
+				name            string
+				order           *core.Order
+				sum             decimal.Decimal
+				expectedErr     error
+				expectedBalance decimal.Decimal
+				expectedEntries int
+			}
+
+			var testCases = []testCase{
+				{"Negative accrual", orders[0], decimal.New(-500, 0), &ErrNegativeAccrual{}, decimal.Zero, 0},
+				{"Zero accrual", orders[1], decimal.Zero, nil, decimal.Zero, 0},
+				{"Positive accrual", orders[2], decimal.New(500, 0), nil, decimal.New(500, 0), 1},
+			}
+
+			for _, tCase := range testCases {
+				sum := tCase.sum
+				err = store.ProcessAccrual(tCase.order.ID, core.PROCESSED, &sum)
+				if tCase.expectedErr == nil {
+					assert.NoError(err, tCase.name)
+				} else {
+					assert.IsType(tCase.expectedErr, err, tCase.name)
+				}
+
+				extracted, err := store.ExtractUserByID(user.ID)
+				if assert.NoError(err, tCase.name) {
+					assert.True(tCase.expectedBalance.Equal(extracted.Balance), "%s: balance is %s", tCase.name, extracted.Balance)
+				}
+				entries, err := store.ExtractLedgerEntries(user, 10, 0)
+				if assert.NoError(err, tCase.name) {
+					assert.Len(entries, tCase.expectedEntries, tCase.name)
+				}
+			}
+
+			// the rejected accrual leaves the order as it was
+			details, err := store.ExtractOrder(orders[0].ID)
+			if assert.NoError(err) {
+				assert.Equal(core.NEW, details.Order.Status)
+				assert.Nil(details.Order.Accrual)
+			}
+		})
+	}
+}